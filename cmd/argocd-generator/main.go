@@ -0,0 +1,91 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+
+	"kubepack.dev/kubepack/cmd/internal"
+	"kubepack.dev/kubepack/pkg/lib"
+
+	flag "github.com/spf13/pflag"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/yaml"
+	releasesapi "x-helm.dev/apimachinery/apis/releases/v1alpha1"
+)
+
+var (
+	file           = "artifacts/kubedb-community/order.yaml"
+	archive        = ""
+	output         = "argocd"
+	namespace      = lib.DefaultArgoCDNamespace
+	project        = lib.DefaultArgoCDProject
+	server         = lib.DefaultArgoCDServer
+	appOfApps      = false
+	repoURL        = ""
+	repoPath       = ""
+	targetRevision = ""
+)
+
+func main() {
+	flag.StringVar(&file, "file", file, "Path to Order file")
+	flag.StringVar(&archive, "archive", archive, "Path to an archive or directory of chart archives used instead of the chart repositories")
+	flag.StringVar(&output, "output", output, "Directory where the Argo CD Applications are written")
+	flag.StringVar(&namespace, "namespace", namespace, "Namespace of the Argo CD Applications")
+	flag.StringVar(&project, "project", project, "Argo CD project of the Applications")
+	flag.StringVar(&server, "server", server, "Destination cluster of the Applications")
+	flag.BoolVar(&appOfApps, "app-of-apps", appOfApps, "Generate an Application that syncs the Applications of the order")
+	flag.StringVar(&repoURL, "repo-url", repoURL, "URL of the git repository the Applications are committed to")
+	flag.StringVar(&repoPath, "path", repoPath, "Path of the Applications in the git repository, defaults to <order name>")
+	flag.StringVar(&targetRevision, "target-revision", targetRevision, "Revision of the git repository synced by the app-of-apps Application, defaults to HEAD")
+	flag.Parse()
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		klog.Fatal(err)
+	}
+	var order releasesapi.Order
+	err = yaml.Unmarshal(data, &order)
+	if err != nil {
+		klog.Fatal(err)
+	}
+
+	reg, err := internal.NewRegistry(archive)
+	if err != nil {
+		klog.Fatal(err)
+	}
+
+	g := lib.ArgoCDGenerator{
+		Registry:       reg,
+		Order:          order,
+		Namespace:      namespace,
+		Project:        project,
+		Server:         server,
+		AppOfApps:      appOfApps,
+		RepoURL:        repoURL,
+		Path:           repoPath,
+		TargetRevision: targetRevision,
+	}
+	err = g.Do()
+	if err != nil {
+		klog.Fatal(err)
+	}
+	err = internal.WriteFiles(output, g.Result())
+	if err != nil {
+		klog.Fatal(err)
+	}
+}
@@ -0,0 +1,100 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"kubepack.dev/kubepack/cmd/internal"
+	"kubepack.dev/kubepack/pkg/lib"
+
+	flag "github.com/spf13/pflag"
+	"k8s.io/klog/v2"
+	kmapi "kmodules.xyz/client-go/api/v1"
+	"sigs.k8s.io/yaml"
+	releasesapi "x-helm.dev/apimachinery/apis/releases/v1alpha1"
+)
+
+var (
+	url        = "https://bundles.byte.builders/stable/"
+	oldURL     = ""
+	name       = "kubedb-community"
+	oldVersion = "v0.13.0"
+	newVersion = "v0.14.0"
+	output     = "text"
+	archive    = ""
+)
+
+func main() {
+	flag.StringVar(&url, "url", url, "Chart repo url")
+	flag.StringVar(&oldURL, "old-url", oldURL, "Chart repo url of the old bundle. Defaults to --url")
+	flag.StringVar(&name, "name", name, "Name of bundle")
+	flag.StringVar(&oldVersion, "old-version", oldVersion, "Old version of bundle")
+	flag.StringVar(&newVersion, "new-version", newVersion, "New version of bundle")
+	flag.StringVar(&output, "output", output, "Output format. One of: text, yaml, json")
+	flag.StringVar(&archive, "archive", archive, "Path to an archive or directory of chart archives used instead of the chart repositories")
+	flag.Parse()
+
+	reg, err := internal.NewRegistry(archive)
+	if err != nil {
+		klog.Fatal(err)
+	}
+
+	d, err := lib.DiffBundles(reg, bundleOption(lib.XorY(oldURL, url), oldVersion), bundleOption(url, newVersion))
+	if err != nil {
+		klog.Fatal(err)
+	}
+
+	switch output {
+	case "text":
+		f1 := &lib.BundleDiffPrinter{Diff: d, W: os.Stdout}
+		err = f1.Do()
+		if err != nil {
+			klog.Fatal(err)
+		}
+	case "yaml":
+		data, err := yaml.Marshal(d)
+		if err != nil {
+			klog.Fatal(err)
+		}
+		fmt.Print(string(data))
+	case "json":
+		data, err := json.MarshalIndent(d, "", "  ")
+		if err != nil {
+			klog.Fatal(err)
+		}
+		fmt.Println(string(data))
+	default:
+		klog.Fatalf("unknown output format %q", output)
+	}
+}
+
+func bundleOption(repoURL, version string) *releasesapi.BundleOption {
+	return &releasesapi.BundleOption{
+		BundleRef: releasesapi.BundleRef{
+			Name: name,
+			SourceRef: kmapi.TypedObjectReference{
+				APIGroup: releasesapi.SourceGroupLegacy,
+				Kind:     releasesapi.SourceKindLegacy,
+				Name:     repoURL,
+			},
+		},
+		Version: version,
+	}
+}
@@ -0,0 +1,50 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"kubepack.dev/kubepack/cmd/internal"
+	"kubepack.dev/kubepack/pkg/lib"
+
+	flag "github.com/spf13/pflag"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"k8s.io/klog/v2"
+)
+
+var chartDir = "testdata/charts/kubedb-community"
+
+func main() {
+	flag.StringVar(&chartDir, "chart-dir", chartDir, "Path to bundle chart directory or archive")
+	flag.Parse()
+
+	chrt, err := loader.Load(chartDir)
+	if err != nil {
+		klog.Fatal(err)
+	}
+
+	errs := lib.LintBundle(internal.DefaultRegistry, chrt)
+	for _, e := range errs {
+		fmt.Println(e.Error())
+	}
+	if len(errs) > 0 {
+		os.Exit(1)
+	}
+	fmt.Println("bundle is valid")
+}
@@ -24,6 +24,7 @@ import (
 	"kubepack.dev/kubepack/pkg/lib"
 
 	flag "github.com/spf13/pflag"
+	"helm.sh/helm/v3/pkg/chartutil"
 	"k8s.io/klog/v2"
 	kmapi "kmodules.xyz/client-go/api/v1"
 	"sigs.k8s.io/yaml"
@@ -34,15 +35,35 @@ var (
 	url     = "https://bundles.byte.builders/stable/"
 	name    = "kubedb-community"
 	version = "*"
+	depth   = lib.DefaultMaxBundleDepth
+
+	valuesFile string
+	archive    string
 )
 
 func main() {
 	flag.StringVar(&url, "url", url, "Chart repo url")
 	flag.StringVar(&name, "name", name, "Name of bundle")
 	flag.StringVar(&version, "version", version, "Version of bundle")
+	flag.IntVar(&depth, "max-depth", depth, "Maximum nesting depth of bundles")
+	flag.StringVar(&archive, "archive", archive, "Path to an archive or directory of chart archives used instead of the chart repositories")
+	flag.StringVar(&valuesFile, "values", valuesFile, "Path to values file used to render the bundle chart")
 	flag.Parse()
 
-	bv, err := lib.CreateBundleViewForBundle(internal.DefaultRegistry, &releasesapi.ChartSourceRef{
+	opts := []lib.ResolveOption{lib.WithMaxBundleDepth(depth)}
+	if valuesFile != "" {
+		vals, err := chartutil.ReadValuesFile(valuesFile)
+		if err != nil {
+			klog.Fatal(err)
+		}
+		opts = append(opts, lib.WithBundleValues(vals.AsMap()))
+	}
+
+	reg, err := internal.NewRegistry(archive)
+	if err != nil {
+		klog.Fatal(err)
+	}
+	bv, err := lib.CreateBundleViewForBundle(reg, &releasesapi.ChartSourceRef{
 		Name:    name,
 		Version: version,
 		SourceRef: kmapi.TypedObjectReference{
@@ -51,7 +72,7 @@ func main() {
 			Namespace: "",
 			Name:      url,
 		},
-	})
+	}, opts...)
 	if err != nil {
 		klog.Fatal(err)
 	}
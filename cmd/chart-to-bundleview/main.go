@@ -24,6 +24,7 @@ import (
 	"kubepack.dev/kubepack/pkg/lib"
 
 	flag "github.com/spf13/pflag"
+	"helm.sh/helm/v3/pkg/chartutil"
 	"k8s.io/klog/v2"
 	kmapi "kmodules.xyz/client-go/api/v1"
 	"sigs.k8s.io/yaml"
@@ -34,14 +35,26 @@ var (
 	url     = "https://charts.jetstack.io"
 	name    = "cert-manager"
 	version = "v0.13.1"
+
+	valuesFile string
 )
 
 func main() {
 	flag.StringVar(&url, "url", url, "Chart repo url")
 	flag.StringVar(&name, "name", name, "Name of bundle")
 	flag.StringVar(&version, "version", version, "Version of bundle")
+	flag.StringVar(&valuesFile, "values", valuesFile, "Path to values file used to render the bundle chart")
 	flag.Parse()
 
+	var opts []lib.ResolveOption
+	if valuesFile != "" {
+		vals, err := chartutil.ReadValuesFile(valuesFile)
+		if err != nil {
+			klog.Fatal(err)
+		}
+		opts = append(opts, lib.WithBundleValues(vals.AsMap()))
+	}
+
 	bv, err := lib.CreateBundleViewForChart(internal.DefaultRegistry, releasesapi.ChartSourceRef{
 		Name:    name,
 		Version: version,
@@ -51,7 +64,7 @@ func main() {
 			Namespace: "",
 			Name:      url,
 		},
-	})
+	}, opts...)
 	if err != nil {
 		klog.Fatal(err)
 	}
@@ -0,0 +1,108 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"kubepack.dev/kubepack/cmd/internal"
+	"kubepack.dev/kubepack/pkg/lib"
+
+	flag "github.com/spf13/pflag"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/yaml"
+	releasesapi "x-helm.dev/apimachinery/apis/releases/v1alpha1"
+)
+
+var (
+	file          = "artifacts/kubedb-community/order.yaml"
+	bundleView    string
+	output        string
+	repositoryURL string
+	kubeVersion   string
+	archive       string
+)
+
+func main() {
+	flag.StringVar(&file, "file", file, "Path to Order file")
+	flag.StringVar(&bundleView, "bundleview", bundleView, "Path to BundleView file. If set, the Order is created from the selections in the BundleView")
+	flag.StringVar(&output, "output", output, "Path to the archive file. Defaults to artifacts/<order name>/<order name>-offline.tgz")
+	flag.StringVar(&repositoryURL, "repository-url", repositoryURL, "Chart repository url used in the exported Order. Defaults to "+lib.ArchiveRepositoryURL)
+	flag.StringVar(&kubeVersion, "kube-version", kubeVersion, "Kubernetes version used to render the charts")
+	flag.StringVar(&archive, "archive", archive, "Path to an archive or directory of chart archives used instead of the chart repositories")
+	flag.Parse()
+
+	reg, err := internal.NewRegistry(archive)
+	if err != nil {
+		klog.Fatal(err)
+	}
+
+	var order releasesapi.Order
+	if bundleView != "" {
+		data, err := os.ReadFile(bundleView)
+		if err != nil {
+			klog.Fatal(err)
+		}
+		var bv releasesapi.BundleView
+		err = yaml.Unmarshal(data, &bv)
+		if err != nil {
+			klog.Fatal(err)
+		}
+		out, err := lib.CreateOrder(reg, bv)
+		if err != nil {
+			klog.Fatal(err)
+		}
+		order = *out
+	} else {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			klog.Fatal(err)
+		}
+		err = yaml.Unmarshal(data, &order)
+		if err != nil {
+			klog.Fatal(err)
+		}
+	}
+
+	if output == "" {
+		err := os.MkdirAll("artifacts/"+order.Name, 0o755)
+		if err != nil {
+			klog.Fatal(err)
+		}
+		output = "artifacts/" + order.Name + "/" + order.Name + "-offline.tgz"
+	}
+	f, err := os.Create(output)
+	if err != nil {
+		klog.Fatal(err)
+	}
+	defer f.Close()
+
+	f1 := &lib.OrderExporter{
+		Registry:      reg,
+		Order:         order,
+		RepositoryURL: repositoryURL,
+		KubeVersion:   kubeVersion,
+		W:             f,
+	}
+	err = f1.Do()
+	if err != nil {
+		klog.Fatal(err)
+	}
+	_, images := f1.Result()
+	fmt.Printf("wrote %s with %d images\n", output, len(images))
+}
@@ -0,0 +1,82 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+
+	"kubepack.dev/kubepack/cmd/internal"
+	"kubepack.dev/kubepack/pkg/lib"
+
+	flag "github.com/spf13/pflag"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/yaml"
+	releasesapi "x-helm.dev/apimachinery/apis/releases/v1alpha1"
+)
+
+var (
+	file          = "artifacts/kubedb-community/order.yaml"
+	archive       = ""
+	output        = "flux"
+	namespace     = lib.DefaultFluxNamespace
+	interval      = lib.DefaultFluxInterval
+	gitRepository = lib.DefaultFluxGitRepository
+	repoPath      = ""
+)
+
+func main() {
+	flag.StringVar(&file, "file", file, "Path to Order file")
+	flag.StringVar(&archive, "archive", archive, "Path to an archive or directory of chart archives used instead of the chart repositories")
+	flag.StringVar(&output, "output", output, "Directory where the Flux manifests are written")
+	flag.StringVar(&namespace, "namespace", namespace, "Namespace of the Flux objects")
+	flag.DurationVar(&interval, "interval", interval, "Reconciliation interval of the Flux objects")
+	flag.StringVar(&gitRepository, "git-repository", gitRepository, "Name of the Flux GitRepository the manifests are committed to")
+	flag.StringVar(&repoPath, "path", repoPath, "Path of the manifests in the git repository, defaults to ./<order name>")
+	flag.Parse()
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		klog.Fatal(err)
+	}
+	var order releasesapi.Order
+	err = yaml.Unmarshal(data, &order)
+	if err != nil {
+		klog.Fatal(err)
+	}
+
+	reg, err := internal.NewRegistry(archive)
+	if err != nil {
+		klog.Fatal(err)
+	}
+
+	g := lib.FluxGenerator{
+		Registry:      reg,
+		Order:         order,
+		Namespace:     namespace,
+		Interval:      interval,
+		GitRepository: gitRepository,
+		Path:          repoPath,
+	}
+	err = g.Do()
+	if err != nil {
+		klog.Fatal(err)
+	}
+	err = internal.WriteFiles(output, g.Result())
+	if err != nil {
+		klog.Fatal(err)
+	}
+}
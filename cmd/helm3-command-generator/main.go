@@ -32,15 +32,28 @@ import (
 	releasesapi "x-helm.dev/apimachinery/apis/releases/v1alpha1"
 )
 
-var file = "artifacts/kubedb-community/order.yaml"
+var (
+	file          = "artifacts/kubedb-community/order.yaml"
+	archive       = ""
+	selfContained = false
+)
 
 func main() {
 	flag.StringVar(&file, "file", file, "Path to Order file")
+	flag.StringVar(&archive, "archive", archive, "Path to an archive or directory of chart archives used instead of the chart repositories")
+	flag.BoolVar(&selfContained, "self-contained", selfContained, "Embed manifests in the script instead of uploading them")
 	flag.Parse()
 
-	bs, err := lib.NewTestBlobStore()
-	if err != nil {
-		klog.Fatal(err)
+	var bs *lib.BlobStore
+	var opts []lib.ScriptOption
+	if selfContained {
+		opts = append(opts, lib.SelfContainedScript)
+	} else {
+		var err error
+		bs, err = lib.NewTestBlobStore()
+		if err != nil {
+			klog.Fatal(err)
+		}
 	}
 
 	data, err := os.ReadFile(file)
@@ -54,7 +67,11 @@ func main() {
 	}
 	order.UID = types.UID(uuid.New().String())
 
-	scripts, err := lib.GenerateHelm3Script(bs, internal.DefaultRegistry, order)
+	reg, err := internal.NewRegistry(archive)
+	if err != nil {
+		klog.Fatal(err)
+	}
+	scripts, err := lib.GenerateHelm3Script(bs, reg, order, opts...)
 	if err != nil {
 		klog.Fatal(err)
 	}
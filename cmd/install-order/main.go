@@ -17,6 +17,8 @@ limitations under the License.
 package main
 
 import (
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
 
@@ -37,12 +39,22 @@ var (
 	masterURL      = ""
 	kubeconfigPath = filepath.Join(homedir.HomeDir(), ".kube", "config")
 	file           = "artifacts/kubedb-community/order.yaml"
+	atomic         = false
+	concurrency    = 1
+	dryRun         = false
+	lockFile       = ""
+	archive        = ""
 )
 
 func main() {
 	flag.StringVar(&masterURL, "master", masterURL, "The address of the Kubernetes API server (overrides any value in kubeconfig)")
 	flag.StringVar(&kubeconfigPath, "kubeconfig", kubeconfigPath, "Path to kubeconfig file with authorization information (the master location is set by the master flag).")
 	flag.StringVar(&file, "file", file, "Path to Order file")
+	flag.BoolVar(&atomic, "atomic", atomic, "If true, uninstall the already installed packages when a package fails to install")
+	flag.IntVar(&concurrency, "max-concurrency", concurrency, "Maximum number of independent packages installed in parallel")
+	flag.BoolVar(&dryRun, "dry-run", dryRun, "If true, check the order using server-side dry-run without changing the cluster")
+	flag.StringVar(&archive, "archive", archive, "Path to an archive or directory of chart archives used instead of the chart repositories")
+	flag.StringVar(&lockFile, "lock", lockFile, "Path to the lock file created with the Order")
 	flag.Parse()
 
 	data, err := os.ReadFile(file)
@@ -64,8 +76,48 @@ func main() {
 	}
 	getter := clientcmdutil.NewClientGetter(&kubeconfig)
 
-	err = lib.InstallOrder(getter, internal.DefaultRegistry, order)
+	opts := []lib.ScriptOption{
+		lib.WithMaxConcurrency(concurrency),
+	}
+	if atomic {
+		opts = append(opts, lib.AtomicInstall)
+	}
+	if lockFile != "" {
+		data, err := os.ReadFile(lockFile)
+		if err != nil {
+			klog.Fatal(err)
+		}
+		var lock lib.OrderLock
+		err = yaml.Unmarshal(data, &lock)
+		if err != nil {
+			klog.Fatal(err)
+		}
+		opts = append(opts, lib.WithLock(&lock))
+	}
+	var report *lib.DryRunReport
+	if dryRun {
+		opts = append(opts, lib.WithDryRun(func(r lib.DryRunReport) {
+			report = &r
+		}))
+	}
+	reg, err := internal.NewRegistry(archive)
 	if err != nil {
 		klog.Fatal(err)
 	}
+	err = lib.InstallOrder(getter, reg, order, opts...)
+	var dryRunErr *lib.DryRunError
+	if err != nil && !errors.As(err, &dryRunErr) {
+		klog.Fatal(err)
+	}
+
+	if report != nil {
+		data, err := yaml.Marshal(report)
+		if err != nil {
+			klog.Fatal(err)
+		}
+		fmt.Println(string(data))
+	}
+	if dryRunErr != nil {
+		os.Exit(1)
+	}
 }
@@ -16,6 +16,36 @@ limitations under the License.
 
 package internal
 
-import "kubepack.dev/lib-helm/pkg/repo"
+import (
+	"os"
+	"path/filepath"
+
+	"kubepack.dev/kubepack/pkg/lib"
+
+	"kubepack.dev/lib-helm/pkg/repo"
+)
 
 var DefaultRegistry = repo.NewDiskCacheRegistry()
+
+// NewRegistry returns DefaultRegistry, or a registry serving the charts of an
+// archive created by export-order or a directory of chart archives, if set.
+func NewRegistry(archive string) (repo.IRegistry, error) {
+	if archive == "" {
+		return DefaultRegistry, nil
+	}
+	return lib.NewArchiveRegistry(archive)
+}
+
+// WriteFiles writes files, keyed by their path relative to dir, into dir.
+func WriteFiles(dir string, files map[string][]byte) error {
+	for name, data := range files {
+		filename := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(filename), 0o755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(filename, data, 0o644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
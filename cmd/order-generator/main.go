@@ -23,15 +23,25 @@ import (
 	"kubepack.dev/kubepack/pkg/lib"
 
 	flag "github.com/spf13/pflag"
+	"helm.sh/helm/v3/pkg/chartutil"
 	"k8s.io/klog/v2"
 	"sigs.k8s.io/yaml"
 	releasesapi "x-helm.dev/apimachinery/apis/releases/v1alpha1"
 )
 
-var file = "artifacts/kubedb-community/bundleview.yaml"
+var (
+	file    = "artifacts/kubedb-community/bundleview.yaml"
+	selects []string
+
+	valuesFile string
+	archive    string
+)
 
 func main() {
 	flag.StringVar(&file, "file", file, "Path to BundleView file")
+	flag.StringVar(&archive, "archive", archive, "Path to an archive or directory of chart archives used instead of the chart repositories")
+	flag.StringVar(&valuesFile, "values", valuesFile, "Path to values file used to render the bundle chart, the same as used to create the BundleView")
+	flag.StringSliceVar(&selects, "select", selects, "Name of the bundle to choose in a OneOf")
 	flag.Parse()
 
 	data, err := os.ReadFile(file)
@@ -44,10 +54,37 @@ func main() {
 		klog.Fatal(err)
 	}
 
-	out, err := lib.CreateOrder(internal.DefaultRegistry, bv)
+	for _, name := range selects {
+		err = lib.SelectOneOf(&bv.BundleOptionView, name)
+		if err != nil {
+			klog.Fatal(err)
+		}
+	}
+
+	var opts []lib.ResolveOption
+	if valuesFile != "" {
+		vals, err := chartutil.ReadValuesFile(valuesFile)
+		if err != nil {
+			klog.Fatal(err)
+		}
+		opts = append(opts, lib.WithBundleValues(vals.AsMap()))
+	}
+
+	reg, err := internal.NewRegistry(archive)
+	if err != nil {
+		klog.Fatal(err)
+	}
+	out, lock, err := lib.CreateOrderWithLock(reg, bv, opts...)
+	if err != nil {
+		klog.Fatal(err)
+	}
+	unpinned, err := lib.UnpinnedCharts(*out)
 	if err != nil {
 		klog.Fatal(err)
 	}
+	for _, pkg := range unpinned {
+		klog.Warningf("chart of package %s can't be pinned to a digest", pkg)
+	}
 
 	data, err = yaml.Marshal(out)
 	if err != nil {
@@ -61,4 +98,13 @@ func main() {
 	if err != nil {
 		klog.Fatal(err)
 	}
+
+	data, err = yaml.Marshal(lock)
+	if err != nil {
+		klog.Fatal(err)
+	}
+	err = os.WriteFile("artifacts/"+bv.Name+"/order.lock.yaml", data, 0o644)
+	if err != nil {
+		klog.Fatal(err)
+	}
 }
@@ -36,12 +36,14 @@ var (
 	masterURL      = ""
 	kubeconfigPath = filepath.Join(homedir.HomeDir(), ".kube", "config")
 	file           = "artifacts/kubedb-community/order.yaml"
+	timeout        = lib.DefaultUninstallTimeout
 )
 
 func main() {
 	flag.StringVar(&masterURL, "master", masterURL, "The address of the Kubernetes API server (overrides any value in kubeconfig)")
 	flag.StringVar(&kubeconfigPath, "kubeconfig", kubeconfigPath, "Path to kubeconfig file with authorization information (the master location is set by the master flag).")
 	flag.StringVar(&file, "file", file, "Path to Order file")
+	flag.DurationVar(&timeout, "timeout", timeout, "Time to wait for the resources of each package to be deleted")
 	flag.Parse()
 
 	data, err := os.ReadFile(file)
@@ -63,7 +65,7 @@ func main() {
 	}
 	getter := clientcmdutil.NewClientGetter(&kubeconfig)
 
-	err = lib.UninstallOrder(getter, order)
+	err = lib.UninstallOrder(getter, order, lib.WithTimeout(timeout))
 	if err != nil {
 		klog.Fatal(err)
 	}
@@ -0,0 +1,98 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"kubepack.dev/kubepack/cmd/internal"
+	"kubepack.dev/kubepack/pkg/lib"
+
+	"github.com/google/uuid"
+	flag "github.com/spf13/pflag"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/yaml"
+	releasesapi "x-helm.dev/apimachinery/apis/releases/v1alpha1"
+)
+
+var (
+	file             = "artifacts/kubedb-community/order.yaml"
+	archive          = ""
+	flavor           = string(lib.FlavorYAML)
+	deleteCRDs       = false
+	deleteNamespaces []string
+	selfContained    = false
+)
+
+func main() {
+	flag.StringVar(&file, "file", file, "Path to Order file")
+	flag.StringVar(&archive, "archive", archive, "Path to an archive or directory of chart archives used instead of the chart repositories")
+	flag.StringVar(&flavor, "flavor", flavor, "Flavor of the script, one of yaml or helm3")
+	flag.BoolVar(&deleteCRDs, "delete-crds", deleteCRDs, "Delete the CRDs shipped by the charts of the order")
+	flag.StringSliceVar(&deleteNamespaces, "delete-namespaces", deleteNamespaces, "Namespaces of the packages of the order to delete, eg, ones created for the order only")
+	flag.BoolVar(&selfContained, "self-contained", selfContained, "Embed manifests in the script instead of uploading them")
+	flag.Parse()
+
+	var bs *lib.BlobStore
+	var opts []lib.ScriptOption
+	if selfContained {
+		opts = append(opts, lib.SelfContainedScript)
+	} else {
+		var err error
+		bs, err = lib.NewTestBlobStore()
+		if err != nil {
+			klog.Fatal(err)
+		}
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		klog.Fatal(err)
+	}
+	var order releasesapi.Order
+	err = yaml.Unmarshal(data, &order)
+	if err != nil {
+		klog.Fatal(err)
+	}
+	if order.UID == "" {
+		order.UID = types.UID(uuid.New().String())
+	}
+
+	reg, err := internal.NewRegistry(archive)
+	if err != nil {
+		klog.Fatal(err)
+	}
+
+	if deleteCRDs {
+		opts = append(opts, lib.DeleteCRDs)
+	}
+	if len(deleteNamespaces) > 0 {
+		opts = append(opts, lib.WithDeleteNamespaces(deleteNamespaces...))
+	}
+	scripts, err := lib.GenerateUninstallScript(bs, reg, order, lib.ScriptFlavor(flavor), opts...)
+	if err != nil {
+		klog.Fatal(err)
+	}
+	data, err = json.MarshalIndent(scripts, "", "  ")
+	if err != nil {
+		klog.Fatal(err)
+	}
+	fmt.Println(string(data))
+}
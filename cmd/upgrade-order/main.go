@@ -0,0 +1,83 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"kubepack.dev/kubepack/cmd/internal"
+	"kubepack.dev/kubepack/pkg/lib"
+
+	flag "github.com/spf13/pflag"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+	"k8s.io/client-go/util/homedir"
+	"k8s.io/klog/v2"
+	clientcmdutil "kmodules.xyz/client-go/tools/clientcmd"
+	"sigs.k8s.io/yaml"
+	releasesapi "x-helm.dev/apimachinery/apis/releases/v1alpha1"
+)
+
+var (
+	masterURL      = ""
+	kubeconfigPath = filepath.Join(homedir.HomeDir(), ".kube", "config")
+	oldFile        = "artifacts/kubedb-community/order.yaml"
+	newFile        = "artifacts/kubedb-community/order.yaml"
+)
+
+func readOrder(file string) releasesapi.Order {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		klog.Fatal(err)
+	}
+	var order releasesapi.Order
+	err = yaml.Unmarshal(data, &order)
+	if err != nil {
+		klog.Fatal(err)
+	}
+	return order
+}
+
+func main() {
+	flag.StringVar(&masterURL, "master", masterURL, "The address of the Kubernetes API server (overrides any value in kubeconfig)")
+	flag.StringVar(&kubeconfigPath, "kubeconfig", kubeconfigPath, "Path to kubeconfig file with authorization information (the master location is set by the master flag).")
+	flag.StringVar(&oldFile, "old", oldFile, "Path to the installed Order file")
+	flag.StringVar(&newFile, "new", newFile, "Path to the new Order file")
+	flag.Parse()
+
+	oldOrder := readOrder(oldFile)
+	newOrder := readOrder(newFile)
+
+	cc := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		&clientcmd.ClientConfigLoadingRules{ExplicitPath: kubeconfigPath},
+		&clientcmd.ConfigOverrides{ClusterInfo: clientcmdapi.Cluster{Server: masterURL}})
+	kubeconfig, err := cc.RawConfig()
+	if err != nil {
+		klog.Fatal(err)
+	}
+	getter := clientcmdutil.NewClientGetter(&kubeconfig)
+
+	actions, err := lib.UpgradeOrder(getter, internal.DefaultRegistry, oldOrder, newOrder)
+	if data, e2 := yaml.Marshal(actions); e2 == nil {
+		fmt.Println(string(data))
+	}
+	if err != nil {
+		klog.Fatal(err)
+	}
+}
@@ -6,6 +6,9 @@ require (
 	github.com/Masterminds/semver/v3 v3.4.0
 	github.com/evanphx/json-patch v5.9.11+incompatible
 	github.com/evanphx/json-patch/v5 v5.9.11
+	github.com/fluxcd/helm-controller/api v1.2.0
+	github.com/fluxcd/pkg/apis/meta v1.10.0
+	github.com/fluxcd/source-controller/api v1.5.0
 	github.com/gabriel-vasile/mimetype v1.4.11
 	github.com/gobuffalo/flect v1.0.3
 	github.com/gogo/protobuf v1.3.2
@@ -98,13 +101,10 @@ require (
 	github.com/fatih/color v1.16.0 // indirect
 	github.com/fatih/structs v1.1.0 // indirect
 	github.com/felixge/httpsnoop v1.0.4 // indirect
-	github.com/fluxcd/helm-controller/api v1.2.0 // indirect
 	github.com/fluxcd/pkg/apis/acl v0.6.0 // indirect
 	github.com/fluxcd/pkg/apis/kustomize v1.9.0 // indirect
-	github.com/fluxcd/pkg/apis/meta v1.10.0 // indirect
 	github.com/fluxcd/pkg/oci v0.45.0 // indirect
 	github.com/fluxcd/pkg/version v0.6.0 // indirect
-	github.com/fluxcd/source-controller/api v1.5.0 // indirect
 	github.com/fsnotify/fsnotify v1.9.0 // indirect
 	github.com/fxamacker/cbor/v2 v2.9.0 // indirect
 	github.com/ghodss/yaml v1.0.0 // indirect
@@ -0,0 +1,237 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"kubepack.dev/lib-helm/pkg/repo"
+
+	fluxsrc "github.com/fluxcd/source-controller/api/v1"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	releasesapi "x-helm.dev/apimachinery/apis/releases/v1alpha1"
+)
+
+// ArchiveRegistry is a repo.IRegistry that serves charts from a directory of
+// chart archives or from an archive written by OrderExporter, so that no
+// chart repository has to be reached. Charts are looked up by name and
+// version in the index. The source of the chart is ignored.
+type ArchiveRegistry struct {
+	// URL is returned as the url of the HelmRepository of every chart. It
+	// defaults to ArchiveRepositoryURL.
+	URL string
+
+	index *repo.IndexFile
+	// dir holds the chart archives, if the registry is backed by a directory.
+	dir string
+	// files holds the chart archives, if the registry is backed by a tarball.
+	files map[string][]byte
+
+	charts map[string]*chart.Chart
+	m      sync.Mutex
+}
+
+var _ repo.IRegistry = &ArchiveRegistry{}
+
+// NewArchiveRegistry creates a registry from a directory or a gzipped
+// tarball. The index is read from index.yaml or charts/index.yaml. A
+// directory without an index is indexed on the fly.
+func NewArchiveRegistry(name string) (*ArchiveRegistry, error) {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	r := &ArchiveRegistry{
+		charts: map[string]*chart.Chart{},
+	}
+	if fi.IsDir() {
+		err = r.loadDir(name)
+	} else {
+		err = r.loadTarball(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	r.index.SortEntries()
+	return r, nil
+}
+
+func (r *ArchiveRegistry) loadDir(dir string) error {
+	for _, p := range []string{"index.yaml", ArchiveIndexFile} {
+		data, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(p)))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		r.dir = filepath.Join(dir, filepath.FromSlash(path.Dir(p)))
+		r.index, err = repo.LoadIndexFile(bytes.NewReader(data))
+		return err
+	}
+
+	var err error
+	r.dir = dir
+	r.index, err = repo.IndexDirectory(dir, "")
+	return err
+}
+
+func (r *ArchiveRegistry) loadTarball(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	files := map[string][]byte{}
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return err
+		}
+		files[path.Clean(hdr.Name)] = data
+	}
+
+	for _, p := range []string{"index.yaml", ArchiveIndexFile} {
+		data, ok := files[p]
+		if !ok {
+			continue
+		}
+		r.files = map[string][]byte{}
+		prefix := path.Dir(p)
+		for k, v := range files {
+			if prefix == "." {
+				r.files[k] = v
+			} else if rel, ok := strings.CutPrefix(k, prefix+"/"); ok {
+				r.files[rel] = v
+			}
+		}
+		r.index, err = repo.LoadIndexFile(bytes.NewReader(data))
+		return err
+	}
+	return fmt.Errorf("%s does not contain index.yaml or %s", name, ArchiveIndexFile)
+}
+
+// archiveFile returns the name of a chart archive relative to the index.
+// Absolute urls are mapped to the file with the same name. Paths outside the
+// archive are rejected.
+func archiveFile(ref string) (string, error) {
+	name := path.Clean(ref)
+	if u, err := url.Parse(ref); err == nil && u.Scheme != "" {
+		name = path.Base(u.Path)
+	}
+	if !filepath.IsLocal(filepath.FromSlash(name)) {
+		return "", fmt.Errorf("chart archive %s is outside of the archive", ref)
+	}
+	return name, nil
+}
+
+func (r *ArchiveRegistry) readFile(ref string) ([]byte, error) {
+	name, err := archiveFile(ref)
+	if err != nil {
+		return nil, err
+	}
+	if r.files != nil {
+		data, ok := r.files[name]
+		if !ok {
+			return nil, fmt.Errorf("chart archive %s not found: %w", name, fs.ErrNotExist)
+		}
+		return data, nil
+	}
+	return os.ReadFile(filepath.Join(r.dir, filepath.FromSlash(name)))
+}
+
+func (r *ArchiveRegistry) GetChart(srcRef releasesapi.ChartSourceRef) (*repo.ChartExtended, error) {
+	cv, err := r.index.Get(srcRef.Name, srcRef.Version)
+	if err != nil {
+		return nil, err
+	}
+	if len(cv.URLs) == 0 {
+		return nil, fmt.Errorf("chart %s@%s has no url in the index", cv.Name, cv.Version)
+	}
+	name, err := archiveFile(cv.URLs[0])
+	if err != nil {
+		return nil, err
+	}
+
+	r.m.Lock()
+	chrt, ok := r.charts[name]
+	r.m.Unlock()
+	if !ok {
+		data, err := r.readFile(name)
+		if err != nil {
+			return nil, err
+		}
+		if cv.Digest != "" {
+			sum := sha256.Sum256(data)
+			if digest := hex.EncodeToString(sum[:]); digest != cv.Digest {
+				return nil, &ChartDigestError{Chart: srcRef, Expected: cv.Digest, Actual: digest}
+			}
+		}
+		chrt, err = loader.LoadArchive(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		r.m.Lock()
+		r.charts[name] = chrt
+		r.m.Unlock()
+	}
+
+	return &repo.ChartExtended{
+		Chart:   chrt,
+		URLs:    []string{name},
+		Created: cv.Created,
+		Removed: cv.Removed,
+		Digest:  cv.Digest,
+	}, nil
+}
+
+func (r *ArchiveRegistry) GetHelmRepository(srcRef releasesapi.ChartSourceRef) (*fluxsrc.HelmRepository, error) {
+	var out fluxsrc.HelmRepository
+	out.Name = srcRef.SourceRef.Name
+	out.Namespace = srcRef.SourceRef.Namespace
+	out.Spec.URL = XorY(r.URL, ArchiveRepositoryURL)
+	return &out, nil
+}
@@ -0,0 +1,179 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"kubepack.dev/lib-helm/pkg/repo"
+
+	"helm.sh/helm/v3/pkg/chart"
+	kmapi "kmodules.xyz/client-go/api/v1"
+	releasesapi "x-helm.dev/apimachinery/apis/releases/v1alpha1"
+)
+
+func archiveChartRef(name, version string) releasesapi.ChartSourceRef {
+	return releasesapi.ChartSourceRef{
+		Name:    name,
+		Version: version,
+		SourceRef: kmapi.TypedObjectReference{
+			Kind: releasesapi.SourceKindLegacy,
+			Name: ArchiveRepositoryURL,
+		},
+	}
+}
+
+func TestArchiveRegistry(t *testing.T) {
+	reg, err := NewArchiveRegistry("../../testdata/archives")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name        string
+		version     string
+		wantVersion string
+		wantDigest  string
+		wantErr     string
+	}{
+		{
+			name:        "stash",
+			version:     "v0.9.0-rc.6",
+			wantVersion: "v0.9.0-rc.6",
+			wantDigest:  "59060c795cb2ff4109ef9cbfb44cca9d3670be44a4089fe0047d1da9a4242355",
+		},
+		{
+			name:        "stash-community",
+			version:     "v0.9.0-rc.6",
+			wantVersion: "v0.9.0-rc.6",
+			wantDigest:  "8bc74e9e880b53489779daeb48e3b2bdf1793d0e3ad42834a835adbe2a60d7f0",
+		},
+		{
+			name:        "stash-mysql-community",
+			version:     ">= 0.1.0",
+			wantVersion: "v0.1.0",
+		},
+		{
+			name:    "stash",
+			version: "v0.8.0",
+			wantErr: "no chart version found",
+		},
+		{
+			name:    "unknown",
+			version: "v0.1.0",
+			wantErr: "no chart name found",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name+"@"+c.version, func(t *testing.T) {
+			chrt, err := reg.GetChart(archiveChartRef(c.name, c.version))
+			if c.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), c.wantErr) {
+					t.Fatalf("got error %v, want %q", err, c.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if chrt.Metadata.Name != c.name || chrt.Metadata.Version != c.wantVersion {
+				t.Errorf("got chart %s@%s, want %s@%s", chrt.Metadata.Name, chrt.Metadata.Version, c.name, c.wantVersion)
+			}
+			if c.wantDigest != "" && chrt.Digest != c.wantDigest {
+				t.Errorf("got digest %s, want %s", chrt.Digest, c.wantDigest)
+			}
+		})
+	}
+}
+
+func TestArchiveRegistryRejectsPathsOutsideArchive(t *testing.T) {
+	dir := t.TempDir()
+	data, err := os.ReadFile("../../testdata/archives/stash-v0.9.0-rc.6.tgz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a chart archive next to the archive directory
+	err = os.WriteFile(filepath.Join(dir, "stash-v0.9.0-rc.6.tgz"), data, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		url     string
+		wantErr bool
+	}{
+		{url: "stash-v0.9.0-rc.6.tgz"},
+		{url: "https://bundles.kubepack.com/stash-v0.9.0-rc.6.tgz"},
+		{url: "charts/../stash-v0.9.0-rc.6.tgz"},
+		{url: "../../stash-v0.9.0-rc.6.tgz", wantErr: true},
+		{url: "charts/../../../stash-v0.9.0-rc.6.tgz", wantErr: true},
+		{url: "/stash-v0.9.0-rc.6.tgz", wantErr: true},
+	}
+	for _, c := range cases {
+		t.Run(c.url, func(t *testing.T) {
+			root := dir
+			if c.wantErr {
+				// serve the archive from dir/sub/archives, so that the
+				// paths escaping it point to the chart archive in dir
+				root = filepath.Join(dir, "sub", "archives")
+				if err := os.MkdirAll(root, 0o755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			index := repo.NewIndexFile()
+			index.Add(&chart.Metadata{Name: "stash", Version: "v0.9.0-rc.6"}, c.url, "", "")
+			reg := &ArchiveRegistry{
+				index:  index,
+				dir:    root,
+				charts: map[string]*chart.Chart{},
+			}
+
+			_, err := reg.GetChart(archiveChartRef("stash", "v0.9.0-rc.6"))
+			if c.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "outside of the archive") {
+					t.Fatalf("got error %v, want a path outside of the archive", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestArchiveRegistryVerifiesDigest(t *testing.T) {
+	data, err := os.ReadFile("../../testdata/archives/stash-v0.9.0-rc.6.tgz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := repo.NewIndexFile()
+	index.Add(&chart.Metadata{Name: "stash", Version: "v0.9.0-rc.6"}, "stash-v0.9.0-rc.6.tgz", "", strings.Repeat("0", 64))
+	reg := &ArchiveRegistry{
+		index:  index,
+		files:  map[string][]byte{"stash-v0.9.0-rc.6.tgz": data},
+		charts: map[string]*chart.Chart{},
+	}
+
+	_, err = reg.GetChart(archiveChartRef("stash", "v0.9.0-rc.6"))
+	if _, ok := err.(*ChartDigestError); !ok {
+		t.Fatalf("got error %v, want a ChartDigestError", err)
+	}
+}
@@ -0,0 +1,226 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"kubepack.dev/lib-helm/pkg/repo"
+
+	"helm.sh/helm/v3/pkg/registry"
+	"sigs.k8s.io/yaml"
+	"x-helm.dev/apimachinery/apis"
+	releasesapi "x-helm.dev/apimachinery/apis/releases/v1alpha1"
+)
+
+// Defaults of ArgoCDGenerator.
+const (
+	DefaultArgoCDNamespace = "argocd"
+	DefaultArgoCDProject   = "default"
+	DefaultArgoCDServer    = "https://kubernetes.default.svc"
+)
+
+// Files of the tree generated by ArgoCDGenerator.
+const (
+	ArgoCDAppOfAppsFile = "app-of-apps.yaml"
+	argoCDAppsDir       = "applications"
+)
+
+const (
+	argoCDAPIVersion         = "argoproj.io/v1alpha1"
+	argoCDSyncWaveAnnotation = "argocd.argoproj.io/sync-wave"
+)
+
+// ArgoCDGenerator turns an Order into Argo CD Applications, one for every
+// package:
+//
+//	applications/<name>.yaml   Application of every package
+//	app-of-apps.yaml           Application of the applications directory, if AppOfApps is set
+//
+// The inline values of an Application are the ValuesFile and ValuesPatch of
+// its package, as changes to the chart defaults. The sync wave of an
+// Application is one more than the highest wave of the packages owning the
+// resources it requires, or 0 if it requires none, so that independent
+// packages share a wave. Sync waves only order Applications synced together,
+// eg, by the app-of-apps Application.
+type ArgoCDGenerator struct {
+	Registry repo.IRegistry
+	Order    releasesapi.Order
+	// Namespace of the Applications, defaults to DefaultArgoCDNamespace.
+	Namespace string
+	// Project of the Applications, defaults to DefaultArgoCDProject.
+	Project string
+	// Server is the destination cluster, defaults to DefaultArgoCDServer.
+	Server string
+
+	// AppOfApps generates an Application that syncs the Applications of the
+	// order from the git repository at RepoURL, where the tree is committed
+	// under Path at TargetRevision.
+	AppOfApps      bool
+	RepoURL        string
+	Path           string
+	TargetRevision string
+
+	files map[string][]byte
+}
+
+func (x *ArgoCDGenerator) Do() error {
+	name := dnsName(x.Order.Name)
+	if name == "" {
+		return fmt.Errorf("order name is required")
+	}
+	if x.AppOfApps && x.RepoURL == "" {
+		return fmt.Errorf("repository url is required for the app-of-apps Application")
+	}
+
+	packages := x.Order.Spec.Packages
+	order, deps, err := chartDependencies(packages)
+	if err != nil {
+		return err
+	}
+	appNames := uniqueReleaseNames(packages, order)
+
+	x.files = map[string][]byte{}
+	waves := make([]int, len(packages))
+	for _, i := range order {
+		chrt := packages[i].Chart
+		// deps come before i in order, so their waves are known
+		for _, j := range deps[i] {
+			waves[i] = max(waves[i], waves[j]+1)
+		}
+
+		src, err := x.source(chrt)
+		if err != nil {
+			return err
+		}
+		syncPolicy := map[string]any{
+			"automated": map[string]any{
+				"prune":    true,
+				"selfHeal": true,
+			},
+		}
+		if !apis.BuiltinNamespaces.Has(chrt.Namespace) {
+			syncPolicy["syncOptions"] = []string{"CreateNamespace=true"}
+		}
+
+		data, err := yaml.Marshal(map[string]any{
+			"apiVersion": argoCDAPIVersion,
+			"kind":       "Application",
+			"metadata": map[string]any{
+				"name":      appNames[i],
+				"namespace": XorY(x.Namespace, DefaultArgoCDNamespace),
+				"annotations": map[string]string{
+					argoCDSyncWaveAnnotation: strconv.Itoa(waves[i]),
+				},
+			},
+			"spec": map[string]any{
+				"project": XorY(x.Project, DefaultArgoCDProject),
+				"source":  src,
+				"destination": map[string]any{
+					"server":    XorY(x.Server, DefaultArgoCDServer),
+					"namespace": chrt.Namespace,
+				},
+				"syncPolicy": syncPolicy,
+			},
+		})
+		if err != nil {
+			return err
+		}
+		x.files[path.Join(argoCDAppsDir, appNames[i]+".yaml")] = data
+	}
+
+	if !x.AppOfApps {
+		return nil
+	}
+	data, err := yaml.Marshal(map[string]any{
+		"apiVersion": argoCDAPIVersion,
+		"kind":       "Application",
+		"metadata": map[string]any{
+			"name":      name,
+			"namespace": XorY(x.Namespace, DefaultArgoCDNamespace),
+		},
+		"spec": map[string]any{
+			"project": XorY(x.Project, DefaultArgoCDProject),
+			"source": map[string]any{
+				"repoURL":        x.RepoURL,
+				"path":           path.Join(XorY(x.Path, name), argoCDAppsDir),
+				"targetRevision": XorY(x.TargetRevision, "HEAD"),
+			},
+			"destination": map[string]any{
+				"server":    XorY(x.Server, DefaultArgoCDServer),
+				"namespace": XorY(x.Namespace, DefaultArgoCDNamespace),
+			},
+			"syncPolicy": map[string]any{
+				"automated": map[string]any{
+					"prune":    true,
+					"selfHeal": true,
+				},
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	x.files[ArgoCDAppOfAppsFile] = data
+	return nil
+}
+
+// Result returns the generated files, keyed by their path in the tree.
+func (x *ArgoCDGenerator) Result() map[string][]byte {
+	return x.files
+}
+
+// source returns the helm source of the Application of a package. Charts in
+// an OCI registry use the registry path, without the oci:// scheme, as the
+// repository url.
+func (x *ArgoCDGenerator) source(chrt *releasesapi.ChartSelection) (map[string]any, error) {
+	switch chrt.SourceRef.Kind {
+	case releasesapi.SourceKindLocal, releasesapi.SourceKindEmbed:
+		return nil, fmt.Errorf("chart %s uses a %s source which is not supported by Argo CD", chrt.Name, chrt.SourceRef.Kind)
+	}
+	repoURL, err := chartRepositoryURL(x.Registry, chrt.ChartRef, chrt.Version)
+	if err != nil {
+		return nil, err
+	}
+	if registry.IsOCI(repoURL) {
+		repoURL, err = ociChartURL(repoURL, "")
+		if err != nil {
+			return nil, err
+		}
+		repoURL = strings.TrimPrefix(repoURL, fmt.Sprintf("%s://", registry.OCIScheme))
+	}
+
+	helm := map[string]any{
+		"releaseName": chrt.ReleaseName,
+	}
+	vals, err := chartValuesOverride(x.Registry, chrt)
+	if err != nil {
+		return nil, err
+	}
+	if len(vals) > 0 {
+		helm["valuesObject"] = vals
+	}
+	return map[string]any{
+		"repoURL":        repoURL,
+		"chart":          chrt.Name,
+		"targetRevision": chrt.Version,
+		"helm":           helm,
+	}, nil
+}
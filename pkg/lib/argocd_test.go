@@ -0,0 +1,84 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"path"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+	releasesapi "x-helm.dev/apimachinery/apis/releases/v1alpha1"
+)
+
+func TestArgoCDSyncWaves(t *testing.T) {
+	reg, err := NewArchiveRegistry("../../testdata/archives")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// stash owns foos, stash-community requires foos and owns bars,
+	// stash-postgres-community requires bars, stash-mysql-community
+	// requires nothing
+	packages := []releasesapi.PackageSelection{
+		testPackage("stash-community", []string{"bars.example.com"}, []string{"foos.example.com"}),
+		testPackage("stash-mysql-community", nil, nil),
+		testPackage("stash", []string{"foos.example.com"}, nil),
+		testPackage("stash-postgres-community", nil, []string{"bars.example.com"}),
+	}
+	versions := map[string]string{
+		"stash-community":          "v0.9.0-rc.6",
+		"stash-mysql-community":    "v0.1.0",
+		"stash":                    "v0.9.0-rc.6",
+		"stash-postgres-community": "v0.1.0",
+	}
+	for _, pkg := range packages {
+		pkg.Chart.SourceRef = archiveChartRef(pkg.Chart.Name, "").SourceRef
+		pkg.Chart.Version = versions[pkg.Chart.Name]
+	}
+
+	x := &ArgoCDGenerator{
+		Registry: reg,
+		Order: releasesapi.Order{
+			ObjectMeta: metav1.ObjectMeta{Name: "stash"},
+			Spec:       releasesapi.OrderSpec{Packages: packages},
+		},
+	}
+	if err := x.Do(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"stash-community":          "1",
+		"stash-mysql-community":    "0",
+		"stash":                    "0",
+		"stash-postgres-community": "2",
+	}
+	for name, wave := range want {
+		data, ok := x.Result()[path.Join(argoCDAppsDir, name+".yaml")]
+		if !ok {
+			t.Fatalf("Application of %s not generated", name)
+		}
+		var app metav1.PartialObjectMetadata
+		if err := yaml.Unmarshal(data, &app); err != nil {
+			t.Fatal(err)
+		}
+		if got := app.Annotations[argoCDSyncWaveAnnotation]; got != wave {
+			t.Errorf("%s: got sync wave %s, want %s", name, got, wave)
+		}
+	}
+}
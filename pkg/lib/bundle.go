@@ -31,7 +31,17 @@ import (
 	releasesapi "x-helm.dev/apimachinery/apis/releases/v1alpha1"
 )
 
-func GetBundle(reg repo.IRegistry, in *releasesapi.BundleOption) (*chart.Chart, *releasesapi.Bundle, error) {
+// GetBundle renders the bundle chart referenced by in. The values set using
+// WithBundleValues are merged with the default values of the chart, so
+// templated bundles can choose their packages based on user input. Bundles
+// nested in the rendered bundle are not rendered here; when resolved, they
+// always use their default values.
+func GetBundle(reg repo.IRegistry, in *releasesapi.BundleOption, opts ...ResolveOption) (*chart.Chart, *releasesapi.Bundle, error) {
+	var ro ResolveOptions
+	for _, opt := range opts {
+		opt.Apply(&ro)
+	}
+
 	chrt, err := reg.GetChart(releasesapi.ChartSourceRef{
 		Name:      in.Name,
 		Version:   in.Version,
@@ -41,17 +51,20 @@ func GetBundle(reg repo.IRegistry, in *releasesapi.BundleOption) (*chart.Chart,
 		return nil, nil, err
 	}
 
-	return getBundle(chrt.Chart)
+	return getBundle(chrt.Chart, ro.Values)
 }
 
-func getBundle(chrt *chart.Chart) (*chart.Chart, *releasesapi.Bundle, error) {
+func getBundle(chrt *chart.Chart, vals map[string]any) (*chart.Chart, *releasesapi.Bundle, error) {
+	if vals == nil {
+		vals = chrt.Values
+	}
 	options := chartutil.ReleaseOptions{
 		Name:      chrt.Name(),
 		Namespace: "",
 		Revision:  1,
 		IsInstall: true,
 	}
-	values, err := chartutil.ToRenderValues(chrt, chrt.Values, options, chartutil.DefaultCapabilities)
+	values, err := chartutil.ToRenderValues(chrt, vals, options, chartutil.DefaultCapabilities)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -17,6 +17,8 @@ limitations under the License.
 package lib
 
 import (
+	"fmt"
+
 	"kubepack.dev/lib-helm/pkg/repo"
 
 	"github.com/gobuffalo/flect"
@@ -25,8 +27,13 @@ import (
 	releasesapi "x-helm.dev/apimachinery/apis/releases/v1alpha1"
 )
 
-func CreateBundleViewForBundle(reg repo.IRegistry, ref *releasesapi.ChartSourceRef) (*releasesapi.BundleView, error) {
-	view, err := toBundleOptionView(reg, &releasesapi.BundleOption{
+// CreateBundleViewForBundle creates the BundleView of a bundle chart. Version
+// ranges are resolved to the exact versions found in the repositories, but
+// no lock is returned. Use CreateOrderWithLock to lock the versions of the
+// packages selected in the BundleView. The values set using WithBundleValues
+// are not recorded in the BundleView and must be passed to CreateOrder too.
+func CreateBundleViewForBundle(reg repo.IRegistry, ref *releasesapi.ChartSourceRef, opts ...ResolveOption) (*releasesapi.BundleView, error) {
+	view, err := toBundleOptionView(newBundleResolver(reg, opts), &releasesapi.BundleOption{
 		BundleRef: releasesapi.BundleRef{
 			Name:      ref.Name,
 			SourceRef: ref.SourceRef,
@@ -46,11 +53,12 @@ func CreateBundleViewForBundle(reg repo.IRegistry, ref *releasesapi.ChartSourceR
 	return &bv, nil
 }
 
-func toBundleOptionView(reg repo.IRegistry, in *releasesapi.BundleOption, level int) (*releasesapi.BundleOptionView, error) {
-	chrt, bundle, err := GetBundle(reg, in)
+func toBundleOptionView(r *bundleResolver, in *releasesapi.BundleOption, level int) (*releasesapi.BundleOptionView, error) {
+	chrt, bundle, err := r.enter(in)
 	if err != nil {
 		return nil, err
 	}
+	defer r.leave()
 
 	bv := releasesapi.BundleOptionView{
 		PackageMeta: releasesapi.PackageMeta{
@@ -66,19 +74,32 @@ func toBundleOptionView(reg repo.IRegistry, in *releasesapi.BundleOption, level
 
 	for _, pkg := range bundle.Spec.Packages {
 		if pkg.Chart != nil {
-			var chartVersion string
-			for _, v := range pkg.Chart.Versions {
-				if v.Selected {
-					chartVersion = v.Version
-					break
+			// version ranges are resolved to the exact version found in the
+			// repository index, only the selected chart is loaded
+			versions := make([]releasesapi.VersionOption, 0, len(pkg.Chart.Versions))
+			selected := -1
+			for i, v := range pkg.Chart.Versions {
+				version, err := r.resolveVersion(releasesapi.ChartSourceRef{
+					Name:      pkg.Chart.Name,
+					Version:   v.Version,
+					SourceRef: pkg.Chart.SourceRef,
+				})
+				if err != nil {
+					return nil, err
+				}
+				opt := v.VersionOption
+				opt.Version = version
+				versions = append(versions, opt)
+				if v.Selected && selected < 0 {
+					selected = i
 				}
 			}
-			if chartVersion == "" {
-				chartVersion = pkg.Chart.Versions[0].Version
+			if len(versions) == 0 {
+				return nil, fmt.Errorf("no version found for chart %s in bundle %s", pkg.Chart.Name, bundle.Name)
 			}
-			pkgChart, err := reg.GetChart(releasesapi.ChartSourceRef{
+			pkgChart, err := r.reg.GetChart(releasesapi.ChartSourceRef{
 				Name:      pkg.Chart.Name,
-				Version:   chartVersion,
+				Version:   versions[max(selected, 0)].Version,
 				SourceRef: pkg.Chart.SourceRef,
 			})
 			if err != nil {
@@ -105,15 +126,13 @@ func toBundleOptionView(reg repo.IRegistry, in *releasesapi.BundleOption, level
 					Selected:          pkg.Chart.Required,
 				},
 			}
-			for _, v := range pkg.Chart.Versions {
-				card.Chart.Versions = append(card.Chart.Versions, v.VersionOption)
-			}
+			card.Chart.Versions = versions
 			if len(card.Chart.Versions) == 1 {
 				card.Chart.Versions[0].Selected = true
 			}
 			bv.Packages = append(bv.Packages, card)
 		} else if pkg.Bundle != nil {
-			view, err := toBundleOptionView(reg, pkg.Bundle, level+1)
+			view, err := toBundleOptionView(r, pkg.Bundle, level+1)
 			if err != nil {
 				return nil, err
 			}
@@ -123,7 +142,7 @@ func toBundleOptionView(reg repo.IRegistry, in *releasesapi.BundleOption, level
 		} else if pkg.OneOf != nil {
 			bovs := make([]*releasesapi.BundleOptionView, 0, len(pkg.OneOf.Bundles))
 			for _, bo := range pkg.OneOf.Bundles {
-				view, err := toBundleOptionView(reg, bo, level+1)
+				view, err := toBundleOptionView(r, bo, level+1)
 				if err != nil {
 					return nil, err
 				}
@@ -138,18 +157,26 @@ func toBundleOptionView(reg repo.IRegistry, in *releasesapi.BundleOption, level
 		}
 	}
 
+	bv.Features, err = viewFeatures(bundle, &bv)
+	if err != nil {
+		return nil, err
+	}
 	return &bv, nil
 }
 
-func CreateBundleViewForChart(reg repo.IRegistry, ref releasesapi.ChartSourceRef) (*releasesapi.BundleView, error) {
+func CreateBundleViewForChart(reg repo.IRegistry, ref releasesapi.ChartSourceRef, opts ...ResolveOption) (*releasesapi.BundleView, error) {
 	pkgChart, err := reg.GetChart(ref)
 	if err != nil {
 		return nil, err
 	}
 
-	_, _, err = getBundle(pkgChart.Chart)
+	var ro ResolveOptions
+	for _, opt := range opts {
+		opt.Apply(&ro)
+	}
+	_, _, err = getBundle(pkgChart.Chart, ro.Values)
 	if err == nil {
-		return CreateBundleViewForBundle(reg, &ref)
+		return CreateBundleViewForBundle(reg, &ref, opts...)
 	} else if !kerr.IsNotFound(err) {
 		return nil, err
 	}
@@ -0,0 +1,461 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"kubepack.dev/lib-helm/pkg/repo"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	releasesapi "x-helm.dev/apimachinery/apis/releases/v1alpha1"
+)
+
+type DiffType string
+
+const (
+	DiffAdded   DiffType = "Added"
+	DiffRemoved DiffType = "Removed"
+	DiffChanged DiffType = "Changed"
+)
+
+const (
+	PackageKindChart  = "Chart"
+	PackageKindBundle = "Bundle"
+	PackageKindOneOf  = "OneOf"
+)
+
+// FieldChange is a field whose value differs between two bundle versions.
+type FieldChange struct {
+	Field string `json:"field"`
+	Old   string `json:"old,omitempty"`
+	New   string `json:"new,omitempty"`
+}
+
+// VersionDiff describes how a version option of a chart changed.
+type VersionDiff struct {
+	Version string        `json:"version"`
+	Change  DiffType      `json:"change"`
+	Changes []FieldChange `json:"changes,omitempty"`
+}
+
+// PackageDiff describes how a package of a bundle changed. Name is the name
+// of the chart or bundle, or the description of a OneOf.
+type PackageDiff struct {
+	Kind    string        `json:"kind"`
+	Name    string        `json:"name"`
+	Change  DiffType      `json:"change"`
+	Changes []FieldChange `json:"changes,omitempty"`
+	// Versions holds the changes to the version options of a chart.
+	Versions []VersionDiff `json:"versions,omitempty"`
+	// Bundle holds the changes of a nested bundle whose version changed.
+	Bundle *BundleDiff `json:"bundle,omitempty"`
+	// Bundles holds the changes to the alternatives of a OneOf.
+	Bundles []PackageDiff `json:"bundles,omitempty"`
+}
+
+// BundleDiff lists the changes between two versions of a bundle.
+type BundleDiff struct {
+	Name       string        `json:"name"`
+	OldVersion string        `json:"oldVersion"`
+	NewVersion string        `json:"newVersion"`
+	Changes    []FieldChange `json:"changes,omitempty"`
+	Packages   []PackageDiff `json:"packages,omitempty"`
+}
+
+// Empty reports whether the bundles are the same.
+func (d *BundleDiff) Empty() bool {
+	return len(d.Changes) == 0 && len(d.Packages) == 0
+}
+
+// DiffBundles resolves two bundles and reports the packages added, removed
+// and changed between them, including the changes of nested bundles and
+// OneOfs. Nested bundles are compared by the version they resolve to, so a
+// version range that still resolves to the same version is not a change.
+// Bundle features are compared by trait.
+func DiffBundles(reg repo.IRegistry, oldBundle, newBundle *releasesapi.BundleOption, opts ...ResolveOption) (*BundleDiff, error) {
+	ro := newBundleResolver(reg, opts)
+	rn := newBundleResolver(reg, opts)
+	rn.opts.Cache = ro.opts.Cache
+	return diffBundles(ro, rn, oldBundle, newBundle)
+}
+
+func diffBundles(ro, rn *bundleResolver, a, b *releasesapi.BundleOption) (*BundleDiff, error) {
+	oldChart, oldBundle, err := ro.enter(a)
+	if err != nil {
+		return nil, err
+	}
+	defer ro.leave()
+	newChart, newBundle, err := rn.enter(b)
+	if err != nil {
+		return nil, err
+	}
+	defer rn.leave()
+
+	out := BundleDiff{
+		Name:       b.Name,
+		OldVersion: oldChart.Metadata.Version,
+		NewVersion: newChart.Metadata.Version,
+	}
+	// version ranges are compared by the version they resolve to
+	if out.OldVersion == out.NewVersion && a.SourceRef == b.SourceRef {
+		return &out, nil
+	}
+	out.Changes = diffFields(nil, "namespace", oldBundle.Spec.Namespace, newBundle.Spec.Namespace)
+	out.Changes = diffFeatures(out.Changes, oldBundle.Spec.Features, newBundle.Spec.Features)
+
+	oldPkgs := packagesByKey(oldBundle)
+	newPkgs := packagesByKey(newBundle)
+	for _, key := range mergeKeys(packageKeys(oldBundle), packageKeys(newBundle)) {
+		pa, inOld := oldPkgs[key]
+		pb, inNew := newPkgs[key]
+		kind, name, _ := strings.Cut(key, "/")
+
+		switch {
+		case !inNew:
+			out.Packages = append(out.Packages, PackageDiff{Kind: kind, Name: name, Change: DiffRemoved})
+		case !inOld:
+			out.Packages = append(out.Packages, PackageDiff{Kind: kind, Name: name, Change: DiffAdded})
+		case pb.Chart != nil:
+			if d := diffChartOption(pa.Chart, pb.Chart, oldBundle.Spec.Namespace, newBundle.Spec.Namespace); d != nil {
+				out.Packages = append(out.Packages, *d)
+			}
+		case pb.Bundle != nil:
+			d, err := diffBundleOption(ro, rn, pa.Bundle, pb.Bundle)
+			if err != nil {
+				return nil, err
+			}
+			if d != nil {
+				out.Packages = append(out.Packages, *d)
+			}
+		case pb.OneOf != nil:
+			d, err := diffOneOf(ro, rn, name, pa.OneOf, pb.OneOf)
+			if err != nil {
+				return nil, err
+			}
+			if d != nil {
+				out.Packages = append(out.Packages, *d)
+			}
+		}
+	}
+	return &out, nil
+}
+
+func diffBundleOption(ro, rn *bundleResolver, a, b *releasesapi.BundleOption) (*PackageDiff, error) {
+	sub, err := diffBundles(ro, rn, a, b)
+	if err != nil {
+		return nil, err
+	}
+	d := PackageDiff{
+		Kind:    PackageKindBundle,
+		Name:    b.Name,
+		Change:  DiffChanged,
+		Changes: diffFields(nil, "version", sub.OldVersion, sub.NewVersion),
+	}
+	d.Changes = diffFields(d.Changes, "sourceRef", jsonString(a.SourceRef), jsonString(b.SourceRef))
+	if !sub.Empty() {
+		d.Bundle = sub
+	}
+	if len(d.Changes) == 0 && d.Bundle == nil {
+		return nil, nil
+	}
+	return &d, nil
+}
+
+func diffOneOf(ro, rn *bundleResolver, name string, a, b *releasesapi.OneOfBundleOption) (*PackageDiff, error) {
+	d := PackageDiff{
+		Kind:   PackageKindOneOf,
+		Name:   name,
+		Change: DiffChanged,
+	}
+	d.Changes = diffFields(nil, "description", a.Description, b.Description)
+
+	oldAlts := map[string]*releasesapi.BundleOption{}
+	var oldNames, newNames []string
+	for _, bo := range a.Bundles {
+		oldAlts[bo.Name] = bo
+		oldNames = append(oldNames, bo.Name)
+	}
+	newAlts := map[string]*releasesapi.BundleOption{}
+	for _, bo := range b.Bundles {
+		newAlts[bo.Name] = bo
+		newNames = append(newNames, bo.Name)
+	}
+	for _, alt := range mergeKeys(oldNames, newNames) {
+		ba, inOld := oldAlts[alt]
+		bb, inNew := newAlts[alt]
+		switch {
+		case !inNew:
+			d.Bundles = append(d.Bundles, PackageDiff{Kind: PackageKindBundle, Name: alt, Change: DiffRemoved})
+		case !inOld:
+			d.Bundles = append(d.Bundles, PackageDiff{Kind: PackageKindBundle, Name: alt, Change: DiffAdded})
+		default:
+			bd, err := diffBundleOption(ro, rn, ba, bb)
+			if err != nil {
+				return nil, err
+			}
+			if bd != nil {
+				d.Bundles = append(d.Bundles, *bd)
+			}
+		}
+	}
+	if len(d.Changes) == 0 && len(d.Bundles) == 0 {
+		return nil, nil
+	}
+	return &d, nil
+}
+
+func diffChartOption(a, b *releasesapi.ChartOption, oldNamespace, newNamespace string) *PackageDiff {
+	d := PackageDiff{
+		Kind:   PackageKindChart,
+		Name:   b.Name,
+		Change: DiffChanged,
+	}
+	d.Changes = diffFields(d.Changes, "sourceRef", jsonString(a.SourceRef), jsonString(b.SourceRef))
+	d.Changes = diffFields(d.Changes, "namespace", XorY(a.Namespace, oldNamespace), XorY(b.Namespace, newNamespace))
+	d.Changes = diffFields(d.Changes, "required", strconv.FormatBool(a.Required), strconv.FormatBool(b.Required))
+	d.Changes = diffFields(d.Changes, "multiSelect", strconv.FormatBool(a.MultiSelect), strconv.FormatBool(b.MultiSelect))
+	d.Changes = diffFields(d.Changes, "features", strings.Join(a.Features, "; "), strings.Join(b.Features, "; "))
+
+	oldVersions := map[string]releasesapi.VersionDetail{}
+	var oldNames, newNames []string
+	for _, v := range a.Versions {
+		oldVersions[v.Version] = v
+		oldNames = append(oldNames, v.Version)
+	}
+	newVersions := map[string]releasesapi.VersionDetail{}
+	for _, v := range b.Versions {
+		newVersions[v.Version] = v
+		newNames = append(newNames, v.Version)
+	}
+	for _, ver := range mergeKeys(oldNames, newNames) {
+		va, inOld := oldVersions[ver]
+		vb, inNew := newVersions[ver]
+		switch {
+		case !inNew:
+			d.Versions = append(d.Versions, VersionDiff{Version: ver, Change: DiffRemoved})
+		case !inOld:
+			added := VersionDiff{Version: ver, Change: DiffAdded}
+			if vb.Selected {
+				added.Changes = diffFields(nil, "selected", "", "true")
+			}
+			d.Versions = append(d.Versions, added)
+		default:
+			if changes := diffVersionDetail(va, vb); len(changes) > 0 {
+				d.Versions = append(d.Versions, VersionDiff{Version: ver, Change: DiffChanged, Changes: changes})
+			}
+		}
+	}
+	if len(d.Changes) == 0 && len(d.Versions) == 0 {
+		return nil
+	}
+	return &d
+}
+
+func diffVersionDetail(a, b releasesapi.VersionDetail) []FieldChange {
+	var out []FieldChange
+	out = diffFields(out, "selected", strconv.FormatBool(a.Selected), strconv.FormatBool(b.Selected))
+	out = diffFields(out, "valuesFile", a.ValuesFile, b.ValuesFile)
+	out = diffFields(out, "valuesPatch", rawString(a.ValuesPatch), rawString(b.ValuesPatch))
+	out = diffFields(out, "resources", jsonString(a.Resources), jsonString(b.Resources))
+	out = diffFields(out, "waitFors", jsonString(a.WaitFors), jsonString(b.WaitFors))
+	out = diffFields(out, "licenseKeyPath", a.LicenseKeyPath, b.LicenseKeyPath)
+	return out
+}
+
+// diffFeatures compares the features of two bundles by trait.
+func diffFeatures(out []FieldChange, a, b []releasesapi.Feature) []FieldChange {
+	oldValues := map[string]string{}
+	var oldTraits, newTraits []string
+	for _, f := range a {
+		oldValues[f.Trait] = f.Value
+		oldTraits = append(oldTraits, f.Trait)
+	}
+	newValues := map[string]string{}
+	for _, f := range b {
+		newValues[f.Trait] = f.Value
+		newTraits = append(newTraits, f.Trait)
+	}
+	for _, trait := range mergeKeys(oldTraits, newTraits) {
+		out = diffFields(out, "features["+trait+"]", oldValues[trait], newValues[trait])
+	}
+	return out
+}
+
+func diffFields(out []FieldChange, field, a, b string) []FieldChange {
+	if a == b {
+		return out
+	}
+	return append(out, FieldChange{Field: field, Old: a, New: b})
+}
+
+func rawString(v *runtime.RawExtension) string {
+	if v == nil {
+		return ""
+	}
+	return string(v.Raw)
+}
+
+func jsonString(v any) string {
+	data, err := json.Marshal(v)
+	if err != nil || string(data) == "null" {
+		return ""
+	}
+	return string(data)
+}
+
+// packageKeys returns the keys of the packages of a bundle, in order. OneOfs
+// are identified by their description or else by their position among the
+// OneOfs of the bundle.
+func packageKeys(bundle *releasesapi.Bundle) []string {
+	keys := make([]string, 0, len(bundle.Spec.Packages))
+	oneOfs := 0
+	for _, pkg := range bundle.Spec.Packages {
+		switch {
+		case pkg.Chart != nil:
+			keys = append(keys, PackageKindChart+"/"+pkg.Chart.Name)
+		case pkg.Bundle != nil:
+			keys = append(keys, PackageKindBundle+"/"+pkg.Bundle.Name)
+		case pkg.OneOf != nil:
+			keys = append(keys, PackageKindOneOf+"/"+XorY(pkg.OneOf.Description, "#"+strconv.Itoa(oneOfs)))
+			oneOfs++
+		}
+	}
+	return keys
+}
+
+func packagesByKey(bundle *releasesapi.Bundle) map[string]releasesapi.PackageRef {
+	out := map[string]releasesapi.PackageRef{}
+	for i, key := range packageKeys(bundle) {
+		out[key] = bundle.Spec.Packages[i]
+	}
+	return out
+}
+
+// mergeKeys returns the keys of a followed by the keys only found in b.
+func mergeKeys(a, b []string) []string {
+	out := make([]string, 0, len(a)+len(b))
+	seen := map[string]bool{}
+	for _, list := range [][]string{a, b} {
+		for _, k := range list {
+			if !seen[k] {
+				seen[k] = true
+				out = append(out, k)
+			}
+		}
+	}
+	return out
+}
+
+// BundleDiffPrinter writes a BundleDiff in a human readable format. Added
+// entries are marked with +, removed entries with - and changed entries
+// with ~.
+type BundleDiffPrinter struct {
+	Diff *BundleDiff
+	W    io.Writer
+}
+
+func (x *BundleDiffPrinter) Do() error {
+	_, err := fmt.Fprintf(x.W, "bundle %s %s -> %s\n", x.Diff.Name, x.Diff.OldVersion, x.Diff.NewVersion)
+	if err != nil {
+		return err
+	}
+	if x.Diff.Empty() {
+		_, err = fmt.Fprintln(x.W, indent+"no changes")
+		return err
+	}
+	return x.printBundle(x.Diff, indent)
+}
+
+func (x *BundleDiffPrinter) printBundle(d *BundleDiff, prefix string) error {
+	err := x.printFields(d.Changes, prefix)
+	if err != nil {
+		return err
+	}
+	for _, pkg := range d.Packages {
+		err = x.printPackage(pkg, prefix)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (x *BundleDiffPrinter) printPackage(d PackageDiff, prefix string) error {
+	name := d.Name
+	if d.Kind == PackageKindOneOf {
+		name = strconv.Quote(d.Name)
+	}
+	_, err := fmt.Fprintf(x.W, "%s%s %s %s\n", prefix, diffMark(d.Change), strings.ToLower(d.Kind), name)
+	if err != nil {
+		return err
+	}
+
+	prefix += indent + indent
+	err = x.printFields(d.Changes, prefix)
+	if err != nil {
+		return err
+	}
+	for _, v := range d.Versions {
+		_, err = fmt.Fprintf(x.W, "%s%s version %s\n", prefix, diffMark(v.Change), v.Version)
+		if err != nil {
+			return err
+		}
+		err = x.printFields(v.Changes, prefix+indent+indent)
+		if err != nil {
+			return err
+		}
+	}
+	if d.Bundle != nil {
+		err = x.printBundle(d.Bundle, prefix)
+		if err != nil {
+			return err
+		}
+	}
+	for _, alt := range d.Bundles {
+		err = x.printPackage(alt, prefix)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (x *BundleDiffPrinter) printFields(changes []FieldChange, prefix string) error {
+	for _, c := range changes {
+		_, err := fmt.Fprintf(x.W, "%s%s: %s -> %s\n", prefix, c.Field, XorY(c.Old, `""`), XorY(c.New, `""`))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func diffMark(t DiffType) string {
+	switch t {
+	case DiffAdded:
+		return "+"
+	case DiffRemoved:
+		return "-"
+	default:
+		return "~"
+	}
+}
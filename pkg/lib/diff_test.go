@@ -0,0 +1,239 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"encoding/json"
+	"maps"
+	"reflect"
+	"slices"
+	"testing"
+
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chartutil"
+	kmapi "kmodules.xyz/client-go/api/v1"
+	releasesapi "x-helm.dev/apimachinery/apis/releases/v1alpha1"
+)
+
+// writeBundleChart saves a bundle chart whose template is the given bundle
+// spec to dir.
+func writeBundleChart(t *testing.T, dir, name, version, spec string) {
+	t.Helper()
+	writeAnnotatedBundleChart(t, dir, name, version, nil, spec)
+}
+
+// writeAnnotatedBundleChart is writeBundleChart for a Bundle with the given
+// annotations.
+func writeAnnotatedBundleChart(t *testing.T, dir, name, version string, annotations map[string]string, spec string) {
+	t.Helper()
+	meta := "  name: " + name + "\n"
+	if len(annotations) > 0 {
+		meta += "  annotations:\n"
+		for _, k := range slices.Sorted(maps.Keys(annotations)) {
+			// JSON strings are valid YAML scalars
+			v, err := json.Marshal(annotations[k])
+			if err != nil {
+				t.Fatal(err)
+			}
+			meta += "    " + k + ": " + string(v) + "\n"
+		}
+	}
+	data := "apiVersion: releases.x-helm.dev/v1alpha1\nkind: Bundle\nmetadata:\n" + meta + "spec:\n" + spec
+	_, err := chartutil.Save(&chart.Chart{
+		Metadata: &chart.Metadata{
+			APIVersion: chart.APIVersionV2,
+			Name:       name,
+			Version:    version,
+		},
+		Templates: []*chart.File{
+			{Name: "templates/bundle.yaml", Data: []byte(data)},
+		},
+	}, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDiffBundles(t *testing.T) {
+	dir := t.TempDir()
+	writeBundleChart(t, dir, "top", "0.1.0", `  features:
+  - {trait: Recommended for, value: testing}
+  - {trait: Support, value: community}
+  namespace: demo
+  packages:
+  - chart:
+      name: demo
+      sourceRef: {kind: Legacy, name: "https://x"}
+      versions:
+      - version: 0.1.0
+        selected: true
+  - chart:
+      name: stash
+      sourceRef: {kind: Legacy, name: "https://x"}
+      versions:
+      - version: v1.0.0
+  - bundle:
+      name: nested
+      sourceRef: {kind: Legacy, name: "https://x"}
+      version: 0.1.0
+  - oneOf:
+      description: backend
+      bundles:
+      - name: nested
+        sourceRef: {kind: Legacy, name: "https://x"}
+        version: 0.1.0
+`)
+	writeBundleChart(t, dir, "top", "0.2.0", `  features:
+  - {trait: Recommended for, value: production}
+  - {trait: Phone support, value: "yes"}
+  namespace: demo2
+  packages:
+  - chart:
+      name: demo
+      sourceRef: {kind: Legacy, name: "https://x"}
+      versions:
+      - version: 0.1.0
+      - version: 0.2.0
+        selected: true
+  - bundle:
+      name: nested
+      sourceRef: {kind: Legacy, name: "https://x"}
+      version: 0.2.0
+  - oneOf:
+      description: backend
+      bundles:
+      - name: nested
+        sourceRef: {kind: Legacy, name: "https://x"}
+        version: "~0.1"
+      - name: other
+        sourceRef: {kind: Legacy, name: "https://x"}
+        version: 0.1.0
+  - chart:
+      name: added
+      sourceRef: {kind: Legacy, name: "https://x"}
+      versions:
+      - version: 1.0.0
+`)
+	writeBundleChart(t, dir, "nested", "0.1.0", `  namespace: demo
+  packages:
+  - chart:
+      name: x
+      sourceRef: {kind: Legacy, name: "https://x"}
+      versions:
+      - version: 1.0.0
+`)
+	writeBundleChart(t, dir, "nested", "0.2.0", `  namespace: demo
+  packages:
+  - chart:
+      name: x
+      required: true
+      sourceRef: {kind: Legacy, name: "https://x"}
+      versions:
+      - version: 1.0.0
+`)
+
+	reg, err := NewArchiveRegistry(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundleOption := func(version string) *releasesapi.BundleOption {
+		return &releasesapi.BundleOption{
+			BundleRef: releasesapi.BundleRef{
+				Name: "top",
+				SourceRef: kmapi.TypedObjectReference{
+					Kind: releasesapi.SourceKindLegacy,
+					Name: ArchiveRepositoryURL,
+				},
+			},
+			Version: version,
+		}
+	}
+
+	t.Run("same version", func(t *testing.T) {
+		got, err := DiffBundles(reg, bundleOption("0.1.0"), bundleOption("0.1.0"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !got.Empty() {
+			t.Errorf("got changes %s", jsonString(got))
+		}
+	})
+
+	t.Run("new version", func(t *testing.T) {
+		got, err := DiffBundles(reg, bundleOption("0.1.0"), bundleOption("0.2.0"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := &BundleDiff{
+			Name:       "top",
+			OldVersion: "0.1.0",
+			NewVersion: "0.2.0",
+			Changes: []FieldChange{
+				{Field: "namespace", Old: "demo", New: "demo2"},
+				{Field: "features[Recommended for]", Old: "testing", New: "production"},
+				{Field: "features[Support]", Old: "community"},
+				{Field: "features[Phone support]", New: "yes"},
+			},
+			Packages: []PackageDiff{
+				{
+					Kind:    PackageKindChart,
+					Name:    "demo",
+					Change:  DiffChanged,
+					Changes: []FieldChange{{Field: "namespace", Old: "demo", New: "demo2"}},
+					Versions: []VersionDiff{
+						{Version: "0.1.0", Change: DiffChanged, Changes: []FieldChange{{Field: "selected", Old: "true", New: "false"}}},
+						{Version: "0.2.0", Change: DiffAdded, Changes: []FieldChange{{Field: "selected", New: "true"}}},
+					},
+				},
+				{Kind: PackageKindChart, Name: "stash", Change: DiffRemoved},
+				{
+					Kind:    PackageKindBundle,
+					Name:    "nested",
+					Change:  DiffChanged,
+					Changes: []FieldChange{{Field: "version", Old: "0.1.0", New: "0.2.0"}},
+					Bundle: &BundleDiff{
+						Name:       "nested",
+						OldVersion: "0.1.0",
+						NewVersion: "0.2.0",
+						Packages: []PackageDiff{
+							{
+								Kind:    PackageKindChart,
+								Name:    "x",
+								Change:  DiffChanged,
+								Changes: []FieldChange{{Field: "required", Old: "false", New: "true"}},
+							},
+						},
+					},
+				},
+				{
+					// the range of the nested alternative resolves to the
+					// same version
+					Kind:    PackageKindOneOf,
+					Name:    "backend",
+					Change:  DiffChanged,
+					Bundles: []PackageDiff{{Kind: PackageKindBundle, Name: "other", Change: DiffAdded}},
+				},
+				{Kind: PackageKindChart, Name: "added", Change: DiffAdded},
+			},
+		}
+		if !reflect.DeepEqual(got, want) {
+			gotJSON, _ := json.MarshalIndent(got, "", "  ")
+			wantJSON, _ := json.MarshalIndent(want, "", "  ")
+			t.Errorf("got\n%s\nwant\n%s", gotJSON, wantJSON)
+		}
+	})
+}
@@ -0,0 +1,365 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+
+	"kubepack.dev/lib-helm/pkg/getter"
+	"kubepack.dev/lib-helm/pkg/repo"
+
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/registry"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	releasesapi "x-helm.dev/apimachinery/apis/releases/v1alpha1"
+)
+
+// ChartDigestsAnnotation is set by CreateOrder on the Order. It holds a JSON
+// map from namespace/release to the sha256 digest of the chart archive of
+// that package, as listed in the repository index. Charts in an OCI registry
+// are pinned to the digest of their manifest instead, written as
+// sha256:<hex>.
+const ChartDigestsAnnotation = "kubepack.dev/chart-digests"
+
+// UnpinnedChartsAnnotation is set by CreateOrder on the Order. It holds a
+// JSON list of the namespace/release of the packages whose chart could not be
+// pinned, because their source has neither a repository index nor an OCI
+// registry, eg, local charts. The charts of these packages are installed as
+// found at install time.
+const UnpinnedChartsAnnotation = "kubepack.dev/unpinned-charts"
+
+// ChartDigests returns the chart digests pinned in an order.
+func ChartDigests(order releasesapi.Order) (map[string]string, error) {
+	data, ok := order.Annotations[ChartDigestsAnnotation]
+	if !ok || data == "" {
+		return nil, nil
+	}
+	var out map[string]string
+	err := json.Unmarshal([]byte(data), &out)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s annotation: %w", ChartDigestsAnnotation, err)
+	}
+	return out, nil
+}
+
+// UnpinnedCharts returns the packages of an order whose chart is not pinned.
+func UnpinnedCharts(order releasesapi.Order) ([]string, error) {
+	data, ok := order.Annotations[UnpinnedChartsAnnotation]
+	if !ok || data == "" {
+		return nil, nil
+	}
+	var out []string
+	err := json.Unmarshal([]byte(data), &out)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s annotation: %w", UnpinnedChartsAnnotation, err)
+	}
+	return out, nil
+}
+
+// setChartDigests sets the ChartDigestsAnnotation and the
+// UnpinnedChartsAnnotation of an order. Annotations left over from an
+// earlier call are removed if digests or unpinned are empty.
+func setChartDigests(order *releasesapi.Order, digests map[string]string, unpinned []string) error {
+	delete(order.Annotations, ChartDigestsAnnotation)
+	delete(order.Annotations, UnpinnedChartsAnnotation)
+	if len(digests) > 0 {
+		data, err := json.Marshal(digests)
+		if err != nil {
+			return err
+		}
+		if order.Annotations == nil {
+			order.Annotations = map[string]string{}
+		}
+		order.Annotations[ChartDigestsAnnotation] = string(data)
+	}
+	if len(unpinned) > 0 {
+		data, err := json.Marshal(unpinned)
+		if err != nil {
+			return err
+		}
+		if order.Annotations == nil {
+			order.Annotations = map[string]string{}
+		}
+		order.Annotations[UnpinnedChartsAnnotation] = string(data)
+	}
+	return nil
+}
+
+// ChartDigestError is returned when the chart archive found in the
+// repository does not match the digest pinned in the Order.
+type ChartDigestError struct {
+	Chart    releasesapi.ChartSourceRef
+	Expected string
+	Actual   string
+}
+
+func (e *ChartDigestError) Error() string {
+	return fmt.Sprintf("digest of chart %s@%s changed: expected %s, found %s", e.Chart.Name, e.Chart.Version, e.Expected, e.Actual)
+}
+
+// VerifyChartDigests downloads the chart archive of every package pinned in
+// the order and checks it against the pinned digest. It returns a registry
+// that serves these charts loaded from the verified archives, so that the
+// charts installed are the ones verified. Other charts are served by reg.
+func VerifyChartDigests(reg repo.IRegistry, order releasesapi.Order) (repo.IRegistry, error) {
+	digests, err := ChartDigests(order)
+	if err != nil || len(digests) == 0 {
+		return reg, err
+	}
+
+	out := &verifiedRegistry{
+		IRegistry: reg,
+		charts:    map[releasesapi.ChartSourceRef]*repo.ChartExtended{},
+	}
+	var errs []error
+	for _, pkg := range order.Spec.Packages {
+		if pkg.Chart == nil {
+			continue
+		}
+		digest, ok := digests[releaseKey(pkg.Chart).String()]
+		if !ok {
+			continue
+		}
+		ref := releasesapi.ChartSourceRef{
+			Name:      pkg.Chart.Name,
+			Version:   pkg.Chart.Version,
+			SourceRef: pkg.Chart.SourceRef,
+		}
+		ref.SetDefaults()
+		if _, ok := out.charts[ref]; ok {
+			continue
+		}
+
+		f1 := &ChartDigestVerifier{
+			Registry:       reg,
+			ChartSourceRef: ref,
+			Digest:         digest,
+		}
+		if err := f1.Do(); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		out.charts[ref] = f1.Result()
+	}
+	if len(errs) > 0 {
+		return nil, utilerrors.NewAggregate(errs)
+	}
+	return out, nil
+}
+
+// verifiedRegistry serves the charts checked by VerifyChartDigests.
+type verifiedRegistry struct {
+	repo.IRegistry
+	charts map[releasesapi.ChartSourceRef]*repo.ChartExtended
+}
+
+func (r *verifiedRegistry) GetChart(ref releasesapi.ChartSourceRef) (*repo.ChartExtended, error) {
+	ref.SetDefaults()
+	if chrt, ok := r.charts[ref]; ok {
+		return chrt, nil
+	}
+	return r.IRegistry.GetChart(ref)
+}
+
+// ChartDigestVerifier downloads the chart archive listed in the repository
+// index, checks that it has the expected sha256 digest and loads the chart
+// from it. Charts in an OCI registry are pulled and their manifest digest is
+// checked instead.
+type ChartDigestVerifier struct {
+	Registry repo.IRegistry
+	releasesapi.ChartSourceRef
+	Digest string
+
+	chrt *repo.ChartExtended
+}
+
+func (x *ChartDigestVerifier) Do() error {
+	pulled, ok, err := pullOCIChart(x.Registry, x.ChartSourceRef)
+	if err != nil {
+		return err
+	}
+	if ok {
+		if pulled.Manifest.Digest != x.Digest {
+			return &ChartDigestError{Chart: x.ChartSourceRef, Expected: x.Digest, Actual: pulled.Manifest.Digest}
+		}
+		chrt, err := loader.LoadArchive(bytes.NewReader(pulled.Chart.Data))
+		if err != nil {
+			return err
+		}
+		x.chrt = &repo.ChartExtended{
+			Chart:  chrt,
+			Digest: x.Digest,
+		}
+		return nil
+	}
+
+	cv, ok, err := findChartVersion(x.Registry, x.ChartSourceRef)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("can't verify digest of chart %s@%s: repository has no index", x.Name, x.Version)
+	}
+	if len(cv.URLs) == 0 {
+		return fmt.Errorf("can't verify digest of chart %s@%s: repository does not list an archive url", x.Name, x.Version)
+	}
+
+	r, err := downloadChart(x.Registry, x.ChartSourceRef, cv.URLs[0])
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	if digest := hex.EncodeToString(sum[:]); digest != x.Digest {
+		return &ChartDigestError{Chart: x.ChartSourceRef, Expected: x.Digest, Actual: digest}
+	}
+
+	chrt, err := loader.LoadArchive(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	x.chrt = &repo.ChartExtended{
+		Chart:   chrt,
+		URLs:    cv.URLs,
+		Created: cv.Created,
+		Removed: cv.Removed,
+		Digest:  x.Digest,
+	}
+	return nil
+}
+
+// Result returns the chart loaded from the verified archive.
+func (x *ChartDigestVerifier) Result() *repo.ChartExtended {
+	return x.chrt
+}
+
+// downloadChart downloads a chart archive. Archive urls relative to the
+// repository, as listed by some indexes, are resolved against the repository
+// url. Archives of Legacy sources are downloaded using the credentials
+// configured for the repository. Archives of an ArchiveRegistry are read
+// from the archive.
+func downloadChart(reg repo.IRegistry, ref releasesapi.ChartSourceRef, archiveURL string) (*bytes.Reader, error) {
+	if ar, ok := reg.(*ArchiveRegistry); ok {
+		data, err := ar.readFile(archiveURL)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.NewReader(data), nil
+	}
+
+	repoURL, err := chartRepositoryURL(reg, releasesapi.ChartRef{
+		Name:      ref.Name,
+		SourceRef: ref.SourceRef,
+	}, ref.Version)
+	if err != nil {
+		return nil, err
+	}
+	archiveURL, err = repo.ResolveReferenceURL(repoURL, archiveURL)
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(archiveURL)
+	if err != nil {
+		return nil, err
+	}
+	g, err := getter.All().ByScheme(u.Scheme)
+	if err != nil {
+		return nil, err
+	}
+
+	var opts []getter.Option
+	if r, ok := reg.(*repo.Registry); ok && ref.SourceRef.Kind == releasesapi.SourceKindLegacy {
+		rc, _, err := r.Get(ref.SourceRef.Name)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts,
+			getter.WithURL(rc.URL),
+			getter.WithTLSClientConfig(rc.CertFile, rc.KeyFile, rc.CAFile),
+			getter.WithBasicAuth(rc.Username, rc.Password),
+			getter.WithCache(rc.Cache),
+		)
+	}
+	return g.Get(u.String(), opts...)
+}
+
+// ociChartDigest returns the manifest digest of a chart in an OCI registry.
+// It reports false if the chart source is not an OCI registry.
+func ociChartDigest(reg repo.IRegistry, ref releasesapi.ChartSourceRef) (string, bool, error) {
+	pulled, ok, err := pullOCIChart(reg, ref)
+	if !ok || err != nil {
+		return "", ok, err
+	}
+	return pulled.Manifest.Digest, true, nil
+}
+
+// pullOCIChart pulls a chart from its OCI registry. It reports false if the
+// chart source is not an OCI registry. Credentials configured for the
+// repository are used, otherwise the ones saved by helm registry login.
+func pullOCIChart(reg repo.IRegistry, ref releasesapi.ChartSourceRef) (*registry.PullResult, bool, error) {
+	repoURL := ref.SourceRef.Name
+	var opts []registry.ClientOption
+	switch ref.SourceRef.Kind {
+	case releasesapi.SourceKindLegacy:
+	case releasesapi.SourceKindHelmRepository:
+		helmRepo, err := reg.GetHelmRepository(ref)
+		if err != nil {
+			return nil, false, err
+		}
+		repoURL = helmRepo.Spec.URL
+		if helmRepo.Spec.Insecure {
+			opts = append(opts, registry.ClientOptPlainHTTP())
+		}
+	default:
+		return nil, false, nil
+	}
+	if !registry.IsOCI(repoURL) {
+		return nil, false, nil
+	}
+
+	if r, ok := reg.(*repo.Registry); ok {
+		rc, _, err := r.Get(repoURL)
+		if err != nil {
+			return nil, false, err
+		}
+		if rc.Username != "" && rc.Password != "" {
+			opts = append(opts, registry.ClientOptBasicAuth(rc.Username, rc.Password))
+		}
+	}
+	rc, err := registry.NewClient(opts...)
+	if err != nil {
+		return nil, false, err
+	}
+	chartURL, err := ociChartURL(repoURL, ref.Name)
+	if err != nil {
+		return nil, false, err
+	}
+	pulled, err := rc.Pull(chartURL+":"+ref.Version, registry.PullOptWithChart(true))
+	if err != nil {
+		return nil, false, err
+	}
+	return pulled, true, nil
+}
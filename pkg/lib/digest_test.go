@@ -0,0 +1,494 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"kubepack.dev/lib-helm/pkg/repo"
+	"kubepack.dev/lib-helm/pkg/values"
+
+	fluxsrc "github.com/fluxcd/source-controller/api/v1"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/registry"
+	kmapi "kmodules.xyz/client-go/api/v1"
+	releasesapi "x-helm.dev/apimachinery/apis/releases/v1alpha1"
+)
+
+func TestVerifyChartDigests(t *testing.T) {
+	reg, err := NewArchiveRegistry("../../testdata/archives")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name    string
+		digest  string
+		wantErr bool
+	}{
+		{"match", "59060c795cb2ff4109ef9cbfb44cca9d3670be44a4089fe0047d1da9a4242355", false},
+		{"mismatch", "0000000000000000000000000000000000000000000000000000000000000000", true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			order := releasesapi.Order{
+				Spec: releasesapi.OrderSpec{
+					Packages: []releasesapi.PackageSelection{
+						{
+							Chart: &releasesapi.ChartSelection{
+								ChartRef: releasesapi.ChartRef{
+									Name: "stash",
+									SourceRef: kmapi.TypedObjectReference{
+										Kind: releasesapi.SourceKindLegacy,
+										Name: ArchiveRepositoryURL,
+									},
+								},
+								Version:     "v0.9.0-rc.6",
+								ReleaseName: "stash",
+								Namespace:   "kube-system",
+							},
+						},
+					},
+				},
+			}
+			err := setChartDigests(&order, map[string]string{"kube-system/stash": c.digest}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			vreg, err := VerifyChartDigests(reg, order)
+			if c.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "digest of chart stash@v0.9.0-rc.6 changed") {
+					t.Fatalf("got %v, want a digest mismatch", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			chrt, err := vreg.GetChart(releasesapi.ChartSourceRef{
+				Name:      "stash",
+				Version:   "v0.9.0-rc.6",
+				SourceRef: order.Spec.Packages[0].Chart.SourceRef,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if chrt.Digest != c.digest || chrt.Metadata.Name != "stash" {
+				t.Errorf("got chart %s with digest %s", chrt.Metadata.Name, chrt.Digest)
+			}
+		})
+	}
+}
+
+func TestHelm3CommandPrinterDigest(t *testing.T) {
+	reg, err := NewArchiveRegistry("../../testdata/archives")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const digest = "59060c795cb2ff4109ef9cbfb44cca9d3670be44a4089fe0047d1da9a4242355"
+
+	cases := []struct {
+		shell Shell
+		want  []string
+	}{
+		{ShellSh, []string{
+			"curl -fsSL -o 'stash-v0.9.0-rc.6.tgz' 'https://charts.example.com/stable/stash-v0.9.0-rc.6.tgz' || exit 1\n",
+			"if command -v sha256sum >/dev/null; then echo '" + digest + "  stash-v0.9.0-rc.6.tgz' | sha256sum -c -; " +
+				"else echo '" + digest + "  stash-v0.9.0-rc.6.tgz' | shasum -a 256 -c -; fi || exit 1\n",
+			"helm upgrade --install stash ./stash-v0.9.0-rc.6.tgz \\\n",
+		}},
+		{ShellPowerShell, []string{
+			"Invoke-WebRequest -Uri 'https://charts.example.com/stable/stash-v0.9.0-rc.6.tgz' -OutFile 'stash-v0.9.0-rc.6.tgz'\n",
+			"if ((Get-FileHash -Algorithm SHA256 'stash-v0.9.0-rc.6.tgz').Hash -ne '" + digest + "') { throw",
+			"helm upgrade --install stash ./stash-v0.9.0-rc.6.tgz `\n",
+		}},
+	}
+	for _, c := range cases {
+		t.Run(string(c.shell), func(t *testing.T) {
+			var buf bytes.Buffer
+			f := &Helm3CommandPrinter{
+				Registry: reg,
+				ChartRef: releasesapi.ChartRef{
+					Name: "stash",
+					SourceRef: kmapi.TypedObjectReference{
+						Kind: releasesapi.SourceKindLegacy,
+						Name: "https://charts.example.com/stable",
+					},
+				},
+				Version:     "v0.9.0-rc.6",
+				ReleaseName: "stash",
+				Namespace:   "kube-system",
+				Shell:       c.shell,
+				Digest:      digest,
+				W:           &buf,
+			}
+			if err := f.Do(); err != nil {
+				t.Fatal(err)
+			}
+			out := buf.String()
+			for _, s := range c.want {
+				if !strings.Contains(out, s) {
+					t.Errorf("script does not contain %q:\n%s", s, out)
+				}
+			}
+			if strings.Contains(out, "--repo") {
+				t.Errorf("script installs the chart from the repository:\n%s", out)
+			}
+		})
+	}
+}
+
+func TestGenerateHelm3ScriptArchive(t *testing.T) {
+	reg, err := NewArchiveRegistry("../../testdata/archives")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const digest = "59060c795cb2ff4109ef9cbfb44cca9d3670be44a4089fe0047d1da9a4242355"
+
+	cases := []struct {
+		name   string
+		digest string
+		sh     []string
+		ps     []string
+	}{
+		{
+			name:   "pinned",
+			digest: digest,
+			sh: []string{
+				"if command -v sha256sum >/dev/null; then echo '" + digest + "  charts/stash-v0.9.0-rc.6.tgz' | sha256sum -c -; " +
+					"else echo '" + digest + "  charts/stash-v0.9.0-rc.6.tgz' | shasum -a 256 -c -; fi || exit 1\n",
+				"helm upgrade --install stash ./charts/stash-v0.9.0-rc.6.tgz \\\n",
+			},
+			ps: []string{
+				"if ((Get-FileHash -Algorithm SHA256 'charts/stash-v0.9.0-rc.6.tgz').Hash -ne '" + digest + "') { throw",
+				"helm upgrade --install stash ./charts/stash-v0.9.0-rc.6.tgz `\n",
+			},
+		},
+		{
+			name: "unpinned",
+			sh:   []string{"helm upgrade --install stash ./charts/stash-v0.9.0-rc.6.tgz \\\n"},
+			ps:   []string{"helm upgrade --install stash ./charts/stash-v0.9.0-rc.6.tgz `\n"},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			order := stashOrder(t, digest)
+			order.Spec.Packages[0].Chart.SourceRef.Name = ArchiveRepositoryURL
+			if c.digest == "" {
+				err := setChartDigests(&order, nil, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			scripts, err := GenerateHelm3Script(nil, reg, order, SelfContainedScript)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, script := range scripts {
+				want := c.sh
+				if script.OS == Windows {
+					want = c.ps
+				}
+				for _, s := range want {
+					if !strings.Contains(script.Script, s) {
+						t.Errorf("%s script does not contain %q:\n%s", script.OS, s, script.Script)
+					}
+				}
+				for _, s := range []string{ArchiveRepositoryURL + "/", "--repo", "curl", "Invoke-WebRequest"} {
+					if strings.Contains(script.Script, s) {
+						t.Errorf("%s script contains %q:\n%s", script.OS, s, script.Script)
+					}
+				}
+				if c.digest == "" && strings.Contains(script.Script, "sha256") {
+					t.Errorf("%s script checks the digest of an unpinned chart:\n%s", script.OS, script.Script)
+				}
+			}
+		})
+	}
+}
+
+func TestVerifyChartDigestsRelativeURL(t *testing.T) {
+	dir := t.TempDir()
+	writeBundleChart(t, filepath.Join(dir, "charts"), "demo", "0.1.0", nestedBundleSpec())
+	index, err := repo.IndexDirectory(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cv, err := index.Get("demo", "0.1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cv.URLs[0] != "charts/demo-0.1.0.tgz" {
+		t.Fatalf("got archive url %s, want a relative url", cv.URLs[0])
+	}
+	err = index.WriteFile(filepath.Join(dir, "index.yaml"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.FileServer(http.Dir(dir)))
+	defer srv.Close()
+
+	order := releasesapi.Order{
+		Spec: releasesapi.OrderSpec{
+			Packages: []releasesapi.PackageSelection{
+				{
+					Chart: &releasesapi.ChartSelection{
+						ChartRef: releasesapi.ChartRef{
+							Name: "demo",
+							SourceRef: kmapi.TypedObjectReference{
+								Kind: releasesapi.SourceKindLegacy,
+								Name: srv.URL + "/",
+							},
+						},
+						Version:     "0.1.0",
+						ReleaseName: "demo",
+						Namespace:   "demo",
+					},
+				},
+			},
+		},
+	}
+	err = setChartDigests(&order, map[string]string{"demo/demo": cv.Digest}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reg := repo.NewMemoryCacheRegistry()
+	vreg, err := VerifyChartDigests(reg, order)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref := releasesapi.ChartSourceRef{
+		Name:      "demo",
+		Version:   "0.1.0",
+		SourceRef: order.Spec.Packages[0].Chart.SourceRef,
+	}
+	chrt, err := vreg.GetChart(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chrt.Digest != cv.Digest || chrt.Metadata.Name != "demo" {
+		t.Errorf("got chart %s with digest %s, want digest %s", chrt.Metadata.Name, chrt.Digest, cv.Digest)
+	}
+
+	// the url as listed in the index
+	r, err := downloadChart(reg, ref, cv.URLs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum := sha256.Sum256(data); hex.EncodeToString(sum[:]) != cv.Digest {
+		t.Errorf("got archive with digest %x, want %s", sum, cv.Digest)
+	}
+}
+
+// serveOCIChart serves a chart archive as name:version from a minimal OCI
+// registry at <server>/charts. It returns the manifest digest.
+func serveOCIChart(t *testing.T, name, version string, data []byte) (*httptest.Server, string) {
+	t.Helper()
+	chrt, err := loader.LoadArchive(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := json.Marshal(chrt.Metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digestOf := func(data []byte) string {
+		sum := sha256.Sum256(data)
+		return "sha256:" + hex.EncodeToString(sum[:])
+	}
+	manifest, err := json.Marshal(map[string]any{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.oci.image.manifest.v1+json",
+		"config": map[string]any{
+			"mediaType": registry.ConfigMediaType,
+			"digest":    digestOf(config),
+			"size":      len(config),
+		},
+		"layers": []map[string]any{
+			{
+				"mediaType": registry.ChartLayerMediaType,
+				"digest":    digestOf(data),
+				"size":      len(data),
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobs := map[string][]byte{
+		digestOf(config): config,
+		digestOf(data):   data,
+	}
+	manifestDigest := digestOf(manifest)
+
+	prefix := "/v2/charts/" + name
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body []byte
+		switch {
+		case r.URL.Path == "/v2/":
+		case r.URL.Path == prefix+"/manifests/"+version, r.URL.Path == prefix+"/manifests/"+manifestDigest:
+			body = manifest
+			w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+			w.Header().Set("Docker-Content-Digest", manifestDigest)
+		case strings.HasPrefix(r.URL.Path, prefix+"/blobs/"):
+			var ok bool
+			body, ok = blobs[strings.TrimPrefix(r.URL.Path, prefix+"/blobs/")]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Set("Content-Type", "application/octet-stream")
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		if r.Method != http.MethodHead {
+			_, _ = w.Write(body)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, manifestDigest
+}
+
+// helmRepositoryRegistry serves charts from an ArchiveRegistry and returns
+// the same HelmRepository for every chart.
+type helmRepositoryRegistry struct {
+	*ArchiveRegistry
+	helmRepo *fluxsrc.HelmRepository
+}
+
+func (r *helmRepositoryRegistry) GetHelmRepository(ref releasesapi.ChartSourceRef) (*fluxsrc.HelmRepository, error) {
+	return r.helmRepo, nil
+}
+
+func TestOCIChartDigest(t *testing.T) {
+	dir := t.TempDir()
+	writeBundleChart(t, dir, "demo", "0.1.0", nestedBundleSpec())
+	data, err := os.ReadFile(filepath.Join(dir, "demo-0.1.0.tgz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, manifestDigest := serveOCIChart(t, "demo", "0.1.0", data)
+
+	ar, err := NewArchiveRegistry(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repoURL := "oci://" + strings.TrimPrefix(srv.URL, "http://") + "/charts"
+	reg := &helmRepositoryRegistry{
+		ArchiveRegistry: ar,
+		helmRepo: &fluxsrc.HelmRepository{
+			Spec: fluxsrc.HelmRepositorySpec{
+				URL:      repoURL,
+				Type:     fluxsrc.HelmRepositoryTypeOCI,
+				Insecure: true,
+			},
+		},
+	}
+	ref := releasesapi.ChartSourceRef{
+		Name:    "demo",
+		Version: "0.1.0",
+		SourceRef: kmapi.TypedObjectReference{
+			APIGroup:  releasesapi.SourceGroupHelmRepository,
+			Kind:      releasesapi.SourceKindHelmRepository,
+			Namespace: "flux-system",
+			Name:      "charts",
+		},
+	}
+
+	digest, ok, err := ociChartDigest(reg, ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || digest != manifestDigest {
+		t.Fatalf("got digest %s, %v, want %s", digest, ok, manifestDigest)
+	}
+	_, ok, err = ociChartDigest(reg, archiveChartRef("demo", "0.1.0"))
+	if ok || err != nil {
+		t.Errorf("got OCI digest of a chart repository, error %v", err)
+	}
+
+	for _, c := range []struct {
+		digest  string
+		wantErr bool
+	}{
+		{manifestDigest, false},
+		{"sha256:" + strings.Repeat("0", 64), true},
+	} {
+		f1 := &ChartDigestVerifier{
+			Registry:       reg,
+			ChartSourceRef: ref,
+			Digest:         c.digest,
+		}
+		err = f1.Do()
+		if c.wantErr {
+			if _, ok := err.(*ChartDigestError); !ok {
+				t.Errorf("got error %v, want a digest mismatch", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if chrt := f1.Result(); chrt.Metadata.Name != "demo" || chrt.Digest != manifestDigest {
+			t.Errorf("got chart %s with digest %s", chrt.Metadata.Name, chrt.Digest)
+		}
+	}
+
+	var buf bytes.Buffer
+	f2 := &Helm3CommandPrinter{
+		Registry: reg,
+		ChartRef: releasesapi.ChartRef{
+			Name:      ref.Name,
+			SourceRef: ref.SourceRef,
+		},
+		Version:     ref.Version,
+		ReleaseName: "demo",
+		Namespace:   "demo",
+		Values:      values.Options{ReplaceValues: map[string]any{}},
+		Shell:       ShellSh,
+		Digest:      manifestDigest,
+		W:           &buf,
+	}
+	err = f2.Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "helm upgrade --install demo " + repoURL + "/demo@" + manifestDigest + " --version 0.1.0 \\\n"
+	if !strings.Contains(buf.String(), want) {
+		t.Errorf("script does not contain %q:\n%s", want, buf.String())
+	}
+}
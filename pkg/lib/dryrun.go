@@ -0,0 +1,388 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"kubepack.dev/lib-helm/pkg/repo"
+	"kubepack.dev/lib-helm/pkg/values"
+
+	kerr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
+	"k8s.io/client-go/dynamic"
+	"kmodules.xyz/client-go/tools/parser"
+	releasesapi "x-helm.dev/apimachinery/apis/releases/v1alpha1"
+)
+
+const dryRunFieldManager = "kubepack"
+
+type DryRunResult string
+
+const (
+	// DryRunCreated means the object would be created.
+	DryRunCreated DryRunResult = "Created"
+	// DryRunConfigured means the object already exists and would be updated.
+	DryRunConfigured DryRunResult = "Configured"
+	// DryRunInvalid means the object failed schema validation.
+	DryRunInvalid DryRunResult = "Invalid"
+	// DryRunRejected means the request was denied by an admission webhook
+	// or forbidden by the api server.
+	DryRunRejected DryRunResult = "Rejected"
+	// DryRunUnverified means the object can't be checked until an earlier
+	// step of the install, like creating a namespace or a CRD, has run.
+	DryRunUnverified DryRunResult = "Unverified"
+	// DryRunFailed means the apply failed for any other reason.
+	DryRunFailed DryRunResult = "Failed"
+)
+
+// DryRunObject is the result of the server-side dry-run apply of an object.
+type DryRunObject struct {
+	metav1.GroupVersionKind `json:",inline"`
+	Namespace               string       `json:"namespace,omitempty"`
+	Name                    string       `json:"name"`
+	Exists                  bool         `json:"exists"`
+	Result                  DryRunResult `json:"result"`
+	Message                 string       `json:"message,omitempty"`
+}
+
+// DryRunPackage holds the dry-run results of the objects of a package.
+type DryRunPackage struct {
+	Release types.NamespacedName `json:"release"`
+	Chart   string               `json:"chart"`
+	Version string               `json:"version"`
+	Objects []DryRunObject       `json:"objects,omitempty"`
+	// Error is set if the package could not be rendered.
+	Error string `json:"error,omitempty"`
+}
+
+// DryRunReport is passed to the DryRunHandler when InstallOrder runs in
+// dry-run mode.
+type DryRunReport struct {
+	Packages []DryRunPackage `json:"packages"`
+}
+
+// Failed reports whether any package failed to render or any object was
+// refused by the api server.
+func (r DryRunReport) Failed() bool {
+	for _, pkg := range r.Packages {
+		if pkg.Error != "" {
+			return true
+		}
+		for _, obj := range pkg.Objects {
+			switch obj.Result {
+			case DryRunInvalid, DryRunRejected, DryRunFailed:
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// DryRunError is returned by InstallOrder in dry-run mode when the report
+// has failed.
+type DryRunError struct {
+	Report DryRunReport
+}
+
+func (e *DryRunError) Error() string {
+	var failed []string
+	for _, pkg := range e.Report.Packages {
+		if pkg.Error != "" {
+			failed = append(failed, fmt.Sprintf("%s: %s", pkg.Release, pkg.Error))
+			continue
+		}
+		for _, obj := range pkg.Objects {
+			switch obj.Result {
+			case DryRunInvalid, DryRunRejected, DryRunFailed:
+				failed = append(failed, fmt.Sprintf("%s: %s %s/%s %s: %s", pkg.Release, obj.Kind, obj.Namespace, obj.Name, obj.Result, obj.Message))
+			}
+		}
+	}
+	return fmt.Sprintf("dry run failed: %s", strings.Join(failed, "; "))
+}
+
+// dryRunOrder checks every package of the order using server-side dry-run.
+// It returns a *DryRunError if any package or object failed.
+func (x *orderInstaller) dryRunOrder(order releasesapi.Order, ids []int) error {
+	var report DryRunReport
+
+	// CRDs rendered by the order don't exist in the cluster yet, so
+	// objects of their kinds can't be verified.
+	pending := sets.New[schema.GroupKind]()
+	for _, i := range ids {
+		chrt := order.Spec.Packages[i].Chart
+		if chrt == nil {
+			continue
+		}
+
+		result := DryRunPackage{
+			Release: releaseKey(chrt),
+			Chart:   chrt.Name,
+			Version: chrt.Version,
+		}
+		manifests, err := renderPackage(x.reg, chrt, x.kubeVersion)
+		if err != nil {
+			result.Error = err.Error()
+			report.Packages = append(report.Packages, result)
+			continue
+		}
+
+		f1 := &DryRunChecker{
+			Manifests:    manifests,
+			Namespace:    chrt.Namespace,
+			PendingKinds: pending,
+			ClientGetter: x.getter,
+			Client:       x.dc,
+			Mapper:       x.mapper,
+		}
+		err = f1.Do()
+		if err != nil {
+			result.Error = err.Error()
+		}
+		result.Objects = f1.Result()
+		report.Packages = append(report.Packages, result)
+	}
+
+	if x.opts.DryRunHandler != nil {
+		x.opts.DryRunHandler(report)
+	}
+	if report.Failed() {
+		return &DryRunError{Report: report}
+	}
+	return nil
+}
+
+// renderPackage renders the CRDs and the manifest of a package with the
+// same values the installer would use.
+func renderPackage(reg repo.IRegistry, chrt *releasesapi.ChartSelection, kubeVersion string) ([][]byte, error) {
+	src := releasesapi.ChartSourceRef{
+		Name:      chrt.Name,
+		Version:   chrt.Version,
+		SourceRef: chrt.SourceRef,
+	}
+	c, err := reg.GetChart(src)
+	if err != nil {
+		return nil, err
+	}
+	opts := values.Options{
+		ValuesFile:  chrt.ValuesFile,
+		ValuesPatch: chrt.ValuesPatch,
+	}
+	vals, err := opts.MergeValues(c.Chart)
+	if err != nil {
+		return nil, err
+	}
+
+	f1 := &ChartRenderer{
+		Registry:       reg,
+		ChartSourceRef: src,
+		ReleaseName:    chrt.ReleaseName,
+		Namespace:      chrt.Namespace,
+		KubeVersion:    kubeVersion,
+		Values:         vals,
+	}
+	err = f1.Do()
+	if err != nil {
+		return nil, err
+	}
+
+	crds, manifest := f1.Result()
+	out := make([][]byte, 0, len(crds)+1)
+	for _, crd := range crds {
+		out = append(out, crd.Data)
+	}
+	if manifest != nil {
+		out = append(out, manifest.Data)
+	}
+	return out, nil
+}
+
+// DryRunChecker applies the objects of a set of manifests using
+// server-side dry-run. The cluster is not modified. Client and Mapper are
+// created from ClientGetter, unless set.
+type DryRunChecker struct {
+	Manifests [][]byte
+	Namespace string
+	// PendingKinds are the kinds of CRDs that will be created by an earlier
+	// step. CRDs found in Manifests are added to it.
+	PendingKinds sets.Set[schema.GroupKind]
+
+	ClientGetter genericclioptions.RESTClientGetter
+	Client       dynamic.Interface
+	Mapper       meta.RESTMapper
+
+	objects []DryRunObject
+}
+
+func (x *DryRunChecker) Do() error {
+	mapper := x.Mapper
+	if mapper == nil {
+		var err error
+		mapper, err = x.ClientGetter.ToRESTMapper()
+		if err != nil {
+			return err
+		}
+	}
+	dc := x.Client
+	if dc == nil {
+		config, err := x.ClientGetter.ToRESTConfig()
+		if err != nil {
+			return err
+		}
+		dc, err = dynamic.NewForConfig(config)
+		if err != nil {
+			return err
+		}
+	}
+	if x.PendingKinds == nil {
+		x.PendingKinds = sets.New[schema.GroupKind]()
+	}
+
+	x.objects = nil
+	for _, data := range x.Manifests {
+		err := parser.ProcessResources(data, func(ri parser.ResourceInfo) error {
+			x.objects = append(x.objects, x.apply(dc, mapper, ri.Object))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (x *DryRunChecker) apply(dc dynamic.Interface, mapper meta.RESTMapper, u *unstructured.Unstructured) DryRunObject {
+	gvk := u.GroupVersionKind()
+	obj := DryRunObject{
+		GroupVersionKind: metav1.GroupVersionKind{
+			Group:   gvk.Group,
+			Version: gvk.Version,
+			Kind:    gvk.Kind,
+		},
+		Name: u.GetName(),
+	}
+	defer func() {
+		if gvk.GroupKind() == crdGroupKind {
+			if gk, ok := crdKind(u); ok {
+				x.PendingKinds.Insert(gk)
+			}
+		}
+	}()
+
+	mapping, err := mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if meta.IsNoMatchError(err) && x.PendingKinds.Has(gvk.GroupKind()) {
+		obj.Result = DryRunUnverified
+		obj.Message = "CRD is installed by the order"
+		return obj
+	} else if err != nil {
+		obj.Result = DryRunFailed
+		obj.Message = err.Error()
+		return obj
+	}
+
+	var ri dynamic.ResourceInterface = dc.Resource(mapping.Resource)
+	if mapping.Scope.Name() == meta.RESTScopeNameNamespace {
+		obj.Namespace = XorY(u.GetNamespace(), x.Namespace)
+		u.SetNamespace(obj.Namespace)
+		ri = dc.Resource(mapping.Resource).Namespace(obj.Namespace)
+	}
+
+	_, err = ri.Get(context.TODO(), obj.Name, metav1.GetOptions{})
+	if err == nil {
+		obj.Exists = true
+	} else if !kerr.IsNotFound(err) {
+		obj.Result = DryRunFailed
+		obj.Message = err.Error()
+		return obj
+	}
+
+	_, err = ri.Apply(context.TODO(), obj.Name, u, metav1.ApplyOptions{
+		DryRun:       []string{metav1.DryRunAll},
+		Force:        true,
+		FieldManager: dryRunFieldManager,
+	})
+	switch {
+	case err == nil && obj.Exists:
+		obj.Result = DryRunConfigured
+	case err == nil:
+		obj.Result = DryRunCreated
+	case isNamespaceNotFound(err, obj.Namespace):
+		obj.Result = DryRunUnverified
+		obj.Message = "namespace " + obj.Namespace + " is created by the order"
+	default:
+		obj.Result = dryRunResultForError(err)
+		obj.Message = err.Error()
+	}
+	return obj
+}
+
+// dryRunResultForError classifies a failed apply by the reason and the code
+// of the status returned by the api server.
+func dryRunResultForError(err error) DryRunResult {
+	var status kerr.APIStatus
+	if !errors.As(err, &status) {
+		return DryRunFailed
+	}
+	switch kerr.ReasonForError(err) {
+	case metav1.StatusReasonInvalid, metav1.StatusReasonBadRequest:
+		return DryRunInvalid
+	case metav1.StatusReasonForbidden:
+		return DryRunRejected
+	case metav1.StatusReasonUnknown:
+		// a validating webhook denies a request with the status it
+		// returns, which usually has a client error code but no reason
+		if code := status.Status().Code; code >= 400 && code < 500 {
+			return DryRunRejected
+		}
+	}
+	return DryRunFailed
+}
+
+// Result returns the dry-run result of every object in the manifests.
+func (x *DryRunChecker) Result() []DryRunObject {
+	return x.objects
+}
+
+var crdGroupKind = schema.GroupKind{Group: "apiextensions.k8s.io", Kind: "CustomResourceDefinition"}
+
+func crdKind(u *unstructured.Unstructured) (schema.GroupKind, bool) {
+	group, _, _ := unstructured.NestedString(u.Object, "spec", "group")
+	kind, _, _ := unstructured.NestedString(u.Object, "spec", "names", "kind")
+	return schema.GroupKind{Group: group, Kind: kind}, kind != ""
+}
+
+func isNamespaceNotFound(err error, ns string) bool {
+	if ns == "" || !kerr.IsNotFound(err) {
+		return false
+	}
+	var status kerr.APIStatus
+	if !errors.As(err, &status) || status.Status().Details == nil {
+		return false
+	}
+	d := status.Status().Details
+	return d.Kind == "namespaces" && d.Name == ns
+}
@@ -0,0 +1,457 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chartutil"
+	kerr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	clienttesting "k8s.io/client-go/testing"
+	releasesapi "x-helm.dev/apimachinery/apis/releases/v1alpha1"
+)
+
+// webhookDenied is the error the api server returns when a validating
+// webhook denies a request without setting a reason.
+func webhookDenied(code int32) error {
+	return &kerr.StatusError{ErrStatus: metav1.Status{
+		Status:  metav1.StatusFailure,
+		Code:    code,
+		Message: `admission webhook "validate.example.com" denied the request: replicas must be odd`,
+	}}
+}
+
+func TestDryRunResultForError(t *testing.T) {
+	configMaps := schema.GroupResource{Resource: "configmaps"}
+	cases := []struct {
+		name string
+		err  error
+		want DryRunResult
+	}{
+		{
+			name: "invalid",
+			err: kerr.NewInvalid(schema.GroupKind{Kind: "ConfigMap"}, "demo", field.ErrorList{
+				field.Invalid(field.NewPath("data"), "x", "must be a map"),
+			}),
+			want: DryRunInvalid,
+		},
+		{name: "bad request", err: kerr.NewBadRequest("unknown field"), want: DryRunInvalid},
+		{name: "webhook denied", err: webhookDenied(http.StatusBadRequest), want: DryRunRejected},
+		{name: "webhook denied with code 403", err: webhookDenied(http.StatusForbidden), want: DryRunRejected},
+		{
+			name: "webhook denied with reason",
+			err:  kerr.NewForbidden(configMaps, "demo", errors.New("denied by policy")),
+			want: DryRunRejected,
+		},
+		{
+			name: "wrapped",
+			err:  fmt.Errorf("apply: %w", webhookDenied(http.StatusBadRequest)),
+			want: DryRunRejected,
+		},
+		{
+			// a webhook that can't be called is a failure of the cluster,
+			// not a rejection of the object
+			name: "webhook call failed",
+			err:  kerr.NewInternalError(errors.New(`failed calling webhook "validate.example.com": connection refused`)),
+			want: DryRunFailed,
+		},
+		{name: "conflict", err: kerr.NewConflict(configMaps, "demo", errors.New("modified")), want: DryRunFailed},
+		{name: "timeout", err: kerr.NewTimeoutError("timeout", 1), want: DryRunFailed},
+		{name: "not a status", err: errors.New("admission webhook denied the request"), want: DryRunFailed},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := dryRunResultForError(c.err); got != c.want {
+				t.Errorf("got %s, want %s", got, c.want)
+			}
+		})
+	}
+}
+
+func TestIsNamespaceNotFound(t *testing.T) {
+	namespaces := schema.GroupResource{Resource: "namespaces"}
+	cases := []struct {
+		name string
+		err  error
+		ns   string
+		want bool
+	}{
+		{name: "namespace", err: kerr.NewNotFound(namespaces, "demo"), ns: "demo", want: true},
+		{name: "other namespace", err: kerr.NewNotFound(namespaces, "other"), ns: "demo"},
+		{name: "cluster scoped", err: kerr.NewNotFound(namespaces, "demo")},
+		{name: "object", err: kerr.NewNotFound(schema.GroupResource{Resource: "configmaps"}, "demo"), ns: "demo"},
+		{name: "not found without details", err: &kerr.StatusError{ErrStatus: metav1.Status{Reason: metav1.StatusReasonNotFound}}, ns: "demo"},
+		{name: "other reason", err: kerr.NewForbidden(namespaces, "demo", errors.New("denied")), ns: "demo"},
+		{name: "not a status", err: errors.New(`namespaces "demo" not found`), ns: "demo"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := isNamespaceNotFound(c.err, c.ns); got != c.want {
+				t.Errorf("got %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestDryRunReport(t *testing.T) {
+	release := types.NamespacedName{Namespace: "demo", Name: "app"}
+	object := func(result DryRunResult, message string) DryRunObject {
+		return DryRunObject{
+			GroupVersionKind: metav1.GroupVersionKind{Version: "v1", Kind: "ConfigMap"},
+			Namespace:        "demo",
+			Name:             "app",
+			Result:           result,
+			Message:          message,
+		}
+	}
+	cases := []struct {
+		name     string
+		packages []DryRunPackage
+		want     string
+	}{
+		{
+			name: "passed",
+			packages: []DryRunPackage{{Release: release, Objects: []DryRunObject{
+				object(DryRunCreated, ""),
+				object(DryRunConfigured, ""),
+				object(DryRunUnverified, "CRD is installed by the order"),
+			}}},
+		},
+		{
+			name:     "render error",
+			packages: []DryRunPackage{{Release: release, Error: "template failed"}},
+			want:     "dry run failed: demo/app: template failed",
+		},
+		{
+			name: "refused objects",
+			packages: []DryRunPackage{{Release: release, Objects: []DryRunObject{
+				object(DryRunCreated, ""),
+				object(DryRunInvalid, "bad data"),
+				object(DryRunRejected, "denied"),
+				object(DryRunFailed, "timeout"),
+			}}},
+			want: "dry run failed: demo/app: ConfigMap demo/app Invalid: bad data; " +
+				"demo/app: ConfigMap demo/app Rejected: denied; " +
+				"demo/app: ConfigMap demo/app Failed: timeout",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			report := DryRunReport{Packages: c.packages}
+			if got := report.Failed(); got != (c.want != "") {
+				t.Fatalf("got failed %v, want %v", got, c.want != "")
+			}
+			if c.want == "" {
+				return
+			}
+			err := &DryRunError{Report: report}
+			if err.Error() != c.want {
+				t.Errorf("got %q, want %q", err.Error(), c.want)
+			}
+		})
+	}
+}
+
+const dryRunCRD = `apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: foos.example.com
+spec:
+  group: example.com
+  names:
+    kind: Foo
+    plural: foos
+  scope: Namespaced
+`
+
+func dryRunMapper() meta.RESTMapper {
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}, meta.RESTScopeNamespace)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "Secret"}, meta.RESTScopeNamespace)
+	mapper.Add(schema.GroupVersionKind{Group: "apiextensions.k8s.io", Version: "v1", Kind: "CustomResourceDefinition"}, meta.RESTScopeRoot)
+	return mapper
+}
+
+// dryRunClient returns a fake dynamic client that holds the configmap
+// demo/existing and fails the apply of the objects named in errs.
+func dryRunClient(errs map[string]error) *dynamicfake.FakeDynamicClient {
+	dc := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(),
+		uninstallObject("v1", "ConfigMap", "demo", "existing"),
+	)
+	dc.PrependReactor("patch", "*", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		patch := action.(clienttesting.PatchAction)
+		if patch.GetPatchType() != types.ApplyPatchType {
+			return false, nil, nil
+		}
+		if patch.GetNamespace() == "missing" {
+			return true, nil, kerr.NewNotFound(schema.GroupResource{Resource: "namespaces"}, "missing")
+		}
+		if err, ok := errs[patch.GetName()]; ok {
+			return true, nil, err
+		}
+		return true, uninstallObject("v1", "ConfigMap", patch.GetNamespace(), patch.GetName()), nil
+	})
+	return dc
+}
+
+func TestDryRunChecker(t *testing.T) {
+	app := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: existing
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: created
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: elsewhere
+  namespace: missing
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: rejected
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: invalid
+---
+apiVersion: example.com/v1
+kind: Foo
+metadata:
+  name: foo
+---
+apiVersion: example.com/v1
+kind: Bar
+metadata:
+  name: bar
+`
+	x := &DryRunChecker{
+		Manifests: [][]byte{[]byte(dryRunCRD), []byte(app)},
+		Namespace: "demo",
+		Client: dryRunClient(map[string]error{
+			"rejected": webhookDenied(http.StatusBadRequest),
+			"invalid":  kerr.NewBadRequest("unknown field"),
+		}),
+		Mapper: dryRunMapper(),
+	}
+	err := x.Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type result struct {
+		Kind      string
+		Namespace string
+		Name      string
+		Exists    bool
+		Result    DryRunResult
+	}
+	var got []result
+	for _, obj := range x.Result() {
+		got = append(got, result{obj.Kind, obj.Namespace, obj.Name, obj.Exists, obj.Result})
+	}
+	want := []result{
+		{"CustomResourceDefinition", "", "foos.example.com", false, DryRunCreated},
+		{"ConfigMap", "demo", "existing", true, DryRunConfigured},
+		{"ConfigMap", "demo", "created", false, DryRunCreated},
+		{"ConfigMap", "missing", "elsewhere", false, DryRunUnverified},
+		{"Secret", "demo", "rejected", false, DryRunRejected},
+		{"ConfigMap", "demo", "invalid", false, DryRunInvalid},
+		// the CRD of Foo is installed by the same manifests
+		{"Foo", "", "foo", false, DryRunUnverified},
+		{"Bar", "", "bar", false, DryRunFailed},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got results\n%v\nwant\n%v", got, want)
+	}
+	if !x.PendingKinds.Has(schema.GroupKind{Group: "example.com", Kind: "Foo"}) {
+		t.Errorf("got pending kinds %v, want example.com/Foo", x.PendingKinds.UnsortedList())
+	}
+}
+
+// writeManifestChart saves a chart that renders the given CRD and
+// templates into dir.
+func writeManifestChart(t *testing.T, dir, name, crd, manifest string) {
+	t.Helper()
+	c := &chart.Chart{
+		Metadata: &chart.Metadata{
+			APIVersion: chart.APIVersionV2,
+			Name:       name,
+			Version:    "0.1.0",
+		},
+		Raw: []*chart.File{
+			{Name: chartutil.ValuesfileName, Data: []byte("{}\n")},
+		},
+		Templates: []*chart.File{
+			{Name: "templates/manifest.yaml", Data: []byte(manifest)},
+		},
+	}
+	if crd != "" {
+		c.Files = []*chart.File{{Name: "crds/crd.yaml", Data: []byte(crd)}}
+	}
+	_, err := chartutil.Save(c, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDryRunOrder(t *testing.T) {
+	dir := t.TempDir()
+	writeManifestChart(t, dir, "crds", dryRunCRD, `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: crds
+`)
+	writeManifestChart(t, dir, "app", "", `apiVersion: example.com/v1
+kind: Foo
+metadata:
+  name: foo
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app
+`)
+	reg, err := NewArchiveRegistry(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pkg := func(name string) releasesapi.PackageSelection {
+		ref := archiveChartRef(name, "0.1.0")
+		return releasesapi.PackageSelection{
+			Chart: &releasesapi.ChartSelection{
+				ChartRef:    releasesapi.ChartRef{Name: ref.Name, SourceRef: ref.SourceRef},
+				Version:     ref.Version,
+				ReleaseName: name,
+				Namespace:   "demo",
+			},
+		}
+	}
+	order := releasesapi.Order{
+		Spec: releasesapi.OrderSpec{
+			Packages: []releasesapi.PackageSelection{
+				pkg("crds"),
+				{},
+				pkg("app"),
+				pkg("missing"),
+			},
+		},
+	}
+
+	// helm renders the ConfigMap of a package before the Foo
+	cases := []struct {
+		name    string
+		ids     []int
+		errs    map[string]error
+		want    map[string][]DryRunResult
+		wantErr bool
+	}{
+		{
+			// Foo is verified only once its CRD exists, which the crds
+			// package installs first
+			name: "crd installed by the order",
+			ids:  []int{0, 1, 2},
+			want: map[string][]DryRunResult{
+				"crds": {DryRunCreated, DryRunCreated},
+				"app":  {DryRunCreated, DryRunUnverified},
+			},
+		},
+		{
+			name: "crd not installed by the order",
+			ids:  []int{2},
+			want: map[string][]DryRunResult{
+				"app": {DryRunCreated, DryRunFailed},
+			},
+			wantErr: true,
+		},
+		{
+			name: "rejected",
+			ids:  []int{0, 2},
+			errs: map[string]error{"app": webhookDenied(http.StatusBadRequest)},
+			want: map[string][]DryRunResult{
+				"crds": {DryRunCreated, DryRunCreated},
+				"app":  {DryRunRejected, DryRunUnverified},
+			},
+			wantErr: true,
+		},
+		{
+			name: "render error",
+			ids:  []int{3},
+			want: map[string][]DryRunResult{
+				"missing": nil,
+			},
+			wantErr: true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var report DryRunReport
+			x := &orderInstaller{
+				reg:    reg,
+				opts:   ScriptOptions{DryRunHandler: func(r DryRunReport) { report = r }},
+				dc:     dryRunClient(c.errs),
+				mapper: dryRunMapper(),
+			}
+			err := x.dryRunOrder(order, c.ids)
+			var derr *DryRunError
+			if c.wantErr {
+				if !errors.As(err, &derr) {
+					t.Fatalf("got error %v, want a DryRunError", err)
+				}
+				if !reflect.DeepEqual(derr.Report, report) {
+					t.Errorf("got error report %+v, want the reported %+v", derr.Report, report)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			got := map[string][]DryRunResult{}
+			for _, pkg := range report.Packages {
+				if (pkg.Error != "") != (pkg.Release.Name == "missing") {
+					t.Errorf("package %s: got error %q", pkg.Release, pkg.Error)
+				}
+				var results []DryRunResult
+				for _, obj := range pkg.Objects {
+					results = append(results, obj.Result)
+				}
+				got[pkg.Release.Name] = results
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("got results %v, want %v", got, c.want)
+			}
+		})
+	}
+}
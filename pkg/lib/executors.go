@@ -80,6 +80,7 @@ type WaitForPrinter struct {
 	Name      string
 	Namespace string
 	WaitFors  []releasesapi.WaitFlags
+	Shell     Shell
 	W         io.Writer
 }
 
@@ -114,7 +115,11 @@ func (x *WaitForPrinter) Do() error {
 			if err != nil {
 				return err
 			}
-			parts = append(parts, selector.String())
+			if x.Shell == ShellPowerShell {
+				parts = append(parts, psQuote(selector.String()))
+			} else {
+				parts = append(parts, selector.String())
+			}
 		}
 
 		if w.All {
@@ -123,7 +128,11 @@ func (x *WaitForPrinter) Do() error {
 
 		if w.ForCondition != "" {
 			parts = append(parts, "--for")
-			parts = append(parts, w.ForCondition)
+			if x.Shell == ShellPowerShell {
+				parts = append(parts, psQuote(w.ForCondition))
+			} else {
+				parts = append(parts, w.ForCondition)
+			}
 		}
 
 		if w.Timeout.Duration > 0 {
@@ -230,8 +239,9 @@ func (b *ResourceFindBuilderWrapper) Do() resource.Visitor {
 }
 
 type CRDReadinessPrinter struct {
-	CRDs []metav1.GroupVersionResource
-	W    io.Writer
+	CRDs  []metav1.GroupVersionResource
+	Shell Shell
+	W     io.Writer
 }
 
 func (x *CRDReadinessPrinter) Do() error {
@@ -242,7 +252,11 @@ func (x *CRDReadinessPrinter) Do() error {
 
 	for _, crd := range x.CRDs {
 		// Work around for bug: https://github.com/kubernetes/kubernetes/issues/83242
-		_, err := fmt.Fprintf(x.W, "until kubectl get crds %s.%s -o=jsonpath='{.items[0].metadata.name}' &> /dev/null; do sleep 1; done\n", crd.Resource, crd.Group)
+		if x.Shell == ShellPowerShell {
+			_, err = fmt.Fprintf(x.W, "while ($true) { kubectl get crds %s.%s -o=jsonpath='{.items[0].metadata.name}' *> $null; if ($LASTEXITCODE -eq 0) { break }; Start-Sleep -Seconds 1 }\n", crd.Resource, crd.Group)
+		} else {
+			_, err = fmt.Fprintf(x.W, "until kubectl get crds %s.%s -o=jsonpath='{.items[0].metadata.name}' &> /dev/null; do sleep 1; done\n", crd.Resource, crd.Group)
+		}
 		if err != nil {
 			return err
 		}
@@ -294,6 +308,15 @@ type Helm3CommandPrinter struct {
 	Namespace     string
 	Values        values.Options
 	UseValuesFile bool
+	Shell         Shell
+	// Digest is the sha256 digest the chart archive is pinned to. If set,
+	// the printed commands download the archive, check its digest and
+	// install the checked archive. Charts in an OCI registry are pinned to
+	// their manifest digest and installed by digest. Charts in a file://
+	// repository, eg, ArchiveRepositoryURL, are installed from the local
+	// archive relative to the directory the script runs in, after checking
+	// its digest.
+	Digest string
 
 	W          io.Writer
 	valuesFile []byte
@@ -311,18 +334,9 @@ func (x *Helm3CommandPrinter) Do() error {
 		return err
 	}
 
-	repoURL := x.ChartRef.SourceRef.Name
-	switch x.ChartRef.SourceRef.Kind {
-	case releasesapi.SourceKindHelmRepository:
-		helmRepo, err := x.Registry.GetHelmRepository(releasesapi.ChartSourceRef{
-			Name:      x.ChartRef.Name,
-			Version:   x.Version,
-			SourceRef: x.ChartRef.SourceRef,
-		})
-		if err != nil {
-			return err
-		}
-		repoURL = helmRepo.Spec.URL
+	repoURL, err := chartRepositoryURL(x.Registry, x.ChartRef, x.Version)
+	if err != nil {
+		return err
 	}
 
 	/*
@@ -331,45 +345,88 @@ func (x *Helm3CommandPrinter) Do() error {
 		$ helm search repo appscode/voyager --version v12.0.0-rc.1
 	*/
 
+	cont := x.Shell.lineContinuation()
 	var buf bytes.Buffer
-	if !registry.IsOCI(repoURL) {
-		/*
-			$ helm upgrade --install voyager-operator appscode/voyager --version v12.0.0-rc.1 \
-			  --namespace kube-system \
-			  --set cloudProvider=$provider
-		*/
-		_, err = fmt.Fprintf(&buf, "helm upgrade --install %s %s \\\n", x.ReleaseName, x.ChartRef.Name)
+	if registry.IsOCI(repoURL) {
+		repoURL, err = ociChartURL(repoURL, x.ChartRef.Name)
 		if err != nil {
 			return err
 		}
+		if x.Digest != "" {
+			// helm checks that the version is tagged with the digest
+			repoURL += "@" + x.Digest
+		}
 
 		if x.Version != "" {
-			_, err = fmt.Fprintf(&buf, "%s--repo %s --version %s \\\n", indent, repoURL, x.Version)
+			_, err = fmt.Fprintf(&buf, "helm upgrade --install %s %s --version %s%s", x.ReleaseName, repoURL, x.Version, cont)
 			if err != nil {
 				return err
 			}
 		} else {
-			_, err = fmt.Fprintf(&buf, "%s--repo %s \\\n", indent, repoURL)
+			_, err = fmt.Fprintf(&buf, "helm upgrade --install %s %s%s", x.ReleaseName, repoURL, cont)
+			if err != nil {
+				return err
+			}
+		}
+	} else if strings.HasPrefix(repoURL, "file://") {
+		// a local repository, eg, the charts directory of an exported
+		// archive, can't be reached by helm, so the archive is installed
+		// from the directory the script runs in
+		if len(chrt.URLs) == 0 {
+			return fmt.Errorf("can't find archive of chart %s@%s: repository does not list an archive url", x.ChartRef.Name, x.Version)
+		}
+		name, err := archiveFile(chrt.URLs[0])
+		if err != nil {
+			return err
+		}
+		file := path.Join(strings.TrimPrefix(repoURL, "file://"), name)
+		if x.Digest != "" {
+			err = x.Shell.printChartCheck(&buf, file, x.Digest)
 			if err != nil {
 				return err
 			}
 		}
+
+		_, err = fmt.Fprintf(&buf, "helm upgrade --install %s ./%s%s", x.ReleaseName, file, cont)
+		if err != nil {
+			return err
+		}
+	} else if x.Digest != "" {
+		if len(chrt.URLs) == 0 {
+			return fmt.Errorf("can't verify digest of chart %s@%s: repository does not list an archive url", x.ChartRef.Name, x.Version)
+		}
+		archiveURL, err := repo.ResolveReferenceURL(repoURL, chrt.URLs[0])
+		if err != nil {
+			return err
+		}
+		file := fmt.Sprintf("%s-%s.tgz", x.ChartRef.Name, x.Version)
+		err = x.Shell.printChartDownload(&buf, archiveURL, file, x.Digest)
+		if err != nil {
+			return err
+		}
+
+		_, err = fmt.Fprintf(&buf, "helm upgrade --install %s ./%s%s", x.ReleaseName, file, cont)
+		if err != nil {
+			return err
+		}
 	} else {
-		u, err := url.Parse(repoURL)
+		/*
+			$ helm upgrade --install voyager-operator appscode/voyager --version v12.0.0-rc.1 \
+			  --namespace kube-system \
+			  --set cloudProvider=$provider
+		*/
+		_, err = fmt.Fprintf(&buf, "helm upgrade --install %s %s%s", x.ReleaseName, x.ChartRef.Name, cont)
 		if err != nil {
 			return err
 		}
-		u.Path = path.Join(u.Path, x.ChartRef.Name)
-		u.User = nil
-		repoURL = u.String()
 
 		if x.Version != "" {
-			_, err = fmt.Fprintf(&buf, "helm upgrade --install %s %s --version %s \\\n", x.ReleaseName, repoURL, x.Version)
+			_, err = fmt.Fprintf(&buf, "%s--repo %s --version %s%s", indent, repoURL, x.Version, cont)
 			if err != nil {
 				return err
 			}
 		} else {
-			_, err = fmt.Fprintf(&buf, "helm upgrade --install %s %s \\\n", x.ReleaseName, repoURL)
+			_, err = fmt.Fprintf(&buf, "%s--repo %s%s", indent, repoURL, cont)
 			if err != nil {
 				return err
 			}
@@ -377,13 +434,13 @@ func (x *Helm3CommandPrinter) Do() error {
 	}
 
 	if x.Namespace != "" {
-		_, err = fmt.Fprintf(&buf, "%s--namespace %s --create-namespace \\\n", indent, x.Namespace)
+		_, err = fmt.Fprintf(&buf, "%s--namespace %s --create-namespace%s", indent, x.Namespace, cont)
 		if err != nil {
 			return err
 		}
 	}
 
-	_, err = fmt.Fprintf(&buf, "%s--wait --debug --burst-limit=1000 \\\n", indent)
+	_, err = fmt.Fprintf(&buf, "%s--wait --debug --burst-limit=1000%s", indent, cont)
 	if err != nil {
 		return err
 	}
@@ -412,12 +469,15 @@ func (x *Helm3CommandPrinter) Do() error {
 				idx := strings.IndexRune(v, '=')
 				return fmt.Errorf(`found \n is values for %s`, v[:idx])
 			}
-			_, err = fmt.Fprintf(&buf, "%s--set %s \\\n", indent, v)
+			if x.Shell == ShellPowerShell {
+				v = psQuote(shUnquote(v))
+			}
+			_, err = fmt.Fprintf(&buf, "%s--set %s%s", indent, v, cont)
 			if err != nil {
 				return err
 			}
 		}
-		buf.Truncate(buf.Len() - 3)
+		buf.Truncate(buf.Len() - len(cont))
 	}
 
 	_, err = buf.WriteRune('\n')
@@ -433,6 +493,38 @@ func (x *Helm3CommandPrinter) ValuesFile() []byte {
 	return x.valuesFile
 }
 
+// chartRepositoryURL returns the url of the repository of a chart.
+func chartRepositoryURL(reg repo.IRegistry, ref releasesapi.ChartRef, version string) (string, error) {
+	if ref.SourceRef.Kind != releasesapi.SourceKindHelmRepository {
+		return ref.SourceRef.Name, nil
+	}
+	helmRepo, err := reg.GetHelmRepository(releasesapi.ChartSourceRef{
+		Name:      ref.Name,
+		Version:   version,
+		SourceRef: ref.SourceRef,
+	})
+	if err != nil {
+		return "", err
+	}
+	return helmRepo.Spec.URL, nil
+}
+
+// ociChartURL returns the url of a chart in an OCI repository, without
+// credentials.
+func ociChartURL(repoURL, name string) (string, error) {
+	u, err := url.Parse(repoURL)
+	if err != nil {
+		return "", err
+	}
+	u.Path = path.Join(u.Path, name)
+	u.User = nil
+	return u.String(), nil
+}
+
+// YAMLPrinter uploads the rendered manifests of a chart and prints the
+// kubectl commands that apply them. The commands run as is in sh and
+// PowerShell. If Inline is set, the manifests are embedded in the commands
+// instead, written for Shell.
 type YAMLPrinter struct {
 	Registry    repo.IRegistry
 	ChartRef    releasesapi.ChartRef
@@ -447,23 +539,28 @@ type YAMLPrinter struct {
 	UID       string
 	PublicURL string
 	Prefix    string
+	Inline    bool
+	Shell     Shell
 	W         io.Writer
 }
 
 func (x *YAMLPrinter) Do() error {
 	ctx := context.Background()
-	bucket, err := blob.OpenBucket(ctx, x.BucketURL)
-	if err != nil {
-		return err
-	}
+	var dirManifest, dirCRD *blob.Bucket
+	if !x.Inline {
+		bucket, err := blob.OpenBucket(ctx, x.BucketURL)
+		if err != nil {
+			return err
+		}
 
-	if x.Prefix != "" {
-		bucket = blob.PrefixedBucket(bucket, strings.TrimSuffix(x.Prefix, "/")+"/")
+		if x.Prefix != "" {
+			bucket = blob.PrefixedBucket(bucket, strings.TrimSuffix(x.Prefix, "/")+"/")
+		}
+		dirManifest = blob.PrefixedBucket(bucket, x.UID+"/manifests/")
+		defer dirManifest.Close() // nolint:errcheck
+		dirCRD = blob.PrefixedBucket(bucket, x.UID+"/crds/")
+		defer dirCRD.Close() // nolint:errcheck
 	}
-	dirManifest := blob.PrefixedBucket(bucket, x.UID+"/manifests/")
-	defer dirManifest.Close() // nolint:errcheck
-	dirCRD := blob.PrefixedBucket(bucket, x.UID+"/crds/")
-	defer dirCRD.Close() // nolint:errcheck
 
 	var buf bytes.Buffer
 
@@ -554,6 +651,14 @@ func (x *YAMLPrinter) Do() error {
 		}
 
 		for _, crd := range crds {
+			if x.Inline {
+				err = x.Shell.printInline(&buf, "kubectl apply -f -", crd.File.Data)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+
 			// Open the key "${releaseName}.yaml" for writing with the default options.
 			w, err := dirCRD.NewWriter(ctx, crd.Name, nil)
 			if err != nil {
@@ -649,7 +754,12 @@ metadata:
 		}
 	}
 
-	{
+	if x.Inline {
+		err = x.Shell.printInline(&buf, "kubectl apply -f -", manifestDoc.Bytes())
+		if err != nil {
+			return err
+		}
+	} else {
 		// Open the key "${releaseName}.yaml" for writing with the default options.
 		w, err := dirManifest.NewWriter(ctx, x.ReleaseName+".yaml", nil)
 		if err != nil {
@@ -893,16 +1003,32 @@ func (x *PermissionChecker) Result() (map[authorization.ResourceAttributes]*Reso
 	return x.attrs, true
 }
 
+// AppReleaseCRDRegPrinter prints the commands that register the AppRelease
+// CRD. If Inline is set, the CRD is embedded in the commands, written for
+// Shell, instead of being downloaded.
 type AppReleaseCRDRegPrinter struct {
-	W io.Writer
+	Inline bool
+	Shell  Shell
+	W      io.Writer
 }
 
 func (x *AppReleaseCRDRegPrinter) Do() error {
-	_, err := fmt.Fprintln(x.W, "kubectl apply -f https://github.com/x-helm/apimachinery/raw/master/crds/drivers.x-helm.dev_appreleases.yaml")
-	if err != nil {
-		return err
+	if x.Inline {
+		data, err := yamllib.Marshal(driversapi.AppRelease{}.CustomResourceDefinition().V1)
+		if err != nil {
+			return err
+		}
+		err = x.Shell.printInline(x.W, "kubectl apply -f -", data)
+		if err != nil {
+			return err
+		}
+	} else {
+		_, err := fmt.Fprintln(x.W, "kubectl apply -f https://github.com/x-helm/apimachinery/raw/master/crds/drivers.x-helm.dev_appreleases.yaml")
+		if err != nil {
+			return err
+		}
 	}
-	_, err = fmt.Fprintln(x.W, "kubectl wait --for=condition=Established crds/appreleases.drivers.x-helm.dev --timeout=5m")
+	_, err := fmt.Fprintln(x.W, "kubectl wait --for=condition=Established crds/appreleases.drivers.x-helm.dev --timeout=5m")
 	if err != nil {
 		return err
 	}
@@ -923,16 +1049,30 @@ func (x *AppReleaseCRDRegistrar) Do() error {
 	})
 }
 
+// ApplicationUploader uploads an AppRelease and prints the kubectl command
+// that applies it. The command runs as is in sh and PowerShell. If Inline is
+// set, the AppRelease is embedded in the command instead, written for Shell.
 type ApplicationUploader struct {
 	App       *driversapi.AppRelease
 	UID       string
 	BucketURL string
 	PublicURL string
 	Prefix    string
+	Inline    bool
+	Shell     Shell
 	W         io.Writer
 }
 
 func (x *ApplicationUploader) Do() error {
+	data, err := yamllib.Marshal(x.App)
+	if err != nil {
+		return err
+	}
+
+	if x.Inline {
+		return x.Shell.printInline(x.W, "kubectl apply -f -", data)
+	}
+
 	ctx := context.Background()
 	bucket, err := blob.OpenBucket(ctx, x.BucketURL)
 	if err != nil {
@@ -945,11 +1085,6 @@ func (x *ApplicationUploader) Do() error {
 	bucket = blob.PrefixedBucket(bucket, x.UID+"/apps/"+x.App.Namespace+"/")
 	defer bucket.Close() // nolint:errcheck
 
-	data, err := yamllib.Marshal(x.App)
-	if err != nil {
-		return err
-	}
-
 	w, err := bucket.NewWriter(ctx, x.App.Name+".yaml", nil)
 	if err != nil {
 		return err
@@ -0,0 +1,293 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"kubepack.dev/lib-helm/pkg/repo"
+
+	"helm.sh/helm/v3/pkg/chartutil"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/sets"
+	kmapi "kmodules.xyz/client-go/api/v1"
+	"kmodules.xyz/client-go/tools/parser"
+	"sigs.k8s.io/yaml"
+	"x-helm.dev/apimachinery/apis"
+	driversapi "x-helm.dev/apimachinery/apis/drivers/v1alpha1"
+	releasesapi "x-helm.dev/apimachinery/apis/releases/v1alpha1"
+)
+
+// ArchiveRepositoryURL is the Legacy chart repository that the Order in an
+// exported archive points to. It stands for the charts/ directory of the
+// archive.
+const ArchiveRepositoryURL = "file://charts"
+
+// Files and directories of an exported archive.
+const (
+	ArchiveOrderFile     = "order.yaml"
+	ArchiveChartsDir     = "charts"
+	ArchiveIndexFile     = ArchiveChartsDir + "/index.yaml"
+	ArchiveCRDsDir       = "crds"
+	ArchiveImagesFile    = "images.txt"
+	archiveAppReleaseCRD = ArchiveCRDsDir + "/drivers.x-helm.dev_appreleases.yaml"
+)
+
+// OrderExporter writes everything needed to install an Order without
+// internet access into a gzipped tarball. The archive holds:
+//
+//	order.yaml                                 the Order, with every chart pointing to ArchiveRepositoryURL
+//	charts/index.yaml                          chart repository index of the archived charts
+//	charts/<name>-<version>.tgz                chart archive of every package of the Order
+//	crds/drivers.x-helm.dev_appreleases.yaml   the AppRelease CRD
+//	images.txt                                 container images used by the rendered charts, one per line
+//
+// The charts directory can be served as a chart repository as is, since the
+// index uses relative urls. Pinned charts are checked against their digest
+// while exported and every package of the exported Order is pinned to its
+// archived chart, so the exported Order has no unpinned charts.
+type OrderExporter struct {
+	Registry repo.IRegistry
+	Order    releasesapi.Order
+	// RepositoryURL overrides ArchiveRepositoryURL in the exported Order,
+	// eg, to point to the chart repository the charts will be uploaded to.
+	RepositoryURL string
+	KubeVersion   string
+	W             io.Writer
+
+	order  releasesapi.Order
+	images []string
+}
+
+func (x *OrderExporter) Do() error {
+	order := x.Order.DeepCopy()
+	index := repo.NewIndexFile()
+	charts := map[string][]byte{}
+	images := sets.New[string]()
+	digests, err := ChartDigests(*order)
+	if err != nil {
+		return err
+	}
+	if digests == nil {
+		digests = map[string]string{}
+	}
+
+	for _, pkg := range order.Spec.Packages {
+		if pkg.Chart == nil {
+			continue
+		}
+		ref := releasesapi.ChartSourceRef{
+			Name:      pkg.Chart.Name,
+			Version:   pkg.Chart.Version,
+			SourceRef: pkg.Chart.SourceRef,
+		}
+		chrt, err := x.Registry.GetChart(ref)
+		if err != nil {
+			return err
+		}
+
+		key := releaseKey(pkg.Chart).String()
+		filename := fmt.Sprintf("%s-%s.tgz", chrt.Name(), chrt.Metadata.Version)
+		if _, ok := charts[filename]; !ok {
+			data, err := x.chartArchive(ref, chrt, digests[key])
+			if err != nil {
+				return err
+			}
+			charts[filename] = data
+			index.Add(chrt.Metadata, filename, "", archiveDigest(data))
+		}
+		// every chart is pinned to its archive, including charts pinned to
+		// an OCI manifest and charts that were not pinned
+		digests[key] = archiveDigest(charts[filename])
+
+		manifests, err := renderPackage(x.Registry, pkg.Chart, XorY(x.KubeVersion, apis.DefaultKubernetesVersion))
+		if err != nil {
+			return err
+		}
+		for _, data := range manifests {
+			err = parser.ProcessResources(data, func(ri parser.ResourceInfo) error {
+				images.Insert(containerImages(ri.Object.Object)...)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		pkg.Chart.SourceRef = kmapi.TypedObjectReference{
+			APIGroup: releasesapi.SourceGroupLegacy,
+			Kind:     releasesapi.SourceKindLegacy,
+			Name:     XorY(x.RepositoryURL, ArchiveRepositoryURL),
+		}
+	}
+	index.SortEntries()
+	err = setChartDigests(order, digests, nil)
+	if err != nil {
+		return err
+	}
+
+	indexData, err := yaml.Marshal(index)
+	if err != nil {
+		return err
+	}
+	orderData, err := yaml.Marshal(order)
+	if err != nil {
+		return err
+	}
+	crd := driversapi.AppRelease{}.CustomResourceDefinition().V1
+	crdData, err := yaml.Marshal(crd)
+	if err != nil {
+		return err
+	}
+	x.images = sets.List(images)
+	imagesData := []byte(strings.Join(x.images, "\n") + "\n")
+
+	gw := gzip.NewWriter(x.W)
+	tw := tar.NewWriter(gw)
+	now := time.Now()
+	files := []struct {
+		name string
+		data []byte
+	}{
+		{ArchiveOrderFile, orderData},
+		{ArchiveIndexFile, indexData},
+		{archiveAppReleaseCRD, crdData},
+		{ArchiveImagesFile, imagesData},
+	}
+	for _, filename := range sets.List(sets.KeySet(charts)) {
+		files = append(files, struct {
+			name string
+			data []byte
+		}{ArchiveChartsDir + "/" + filename, charts[filename]})
+	}
+	for _, f := range files {
+		err = tw.WriteHeader(&tar.Header{
+			Name:     f.name,
+			Mode:     0o644,
+			Size:     int64(len(f.data)),
+			ModTime:  now,
+			Typeflag: tar.TypeReg,
+		})
+		if err != nil {
+			return err
+		}
+		_, err = tw.Write(f.data)
+		if err != nil {
+			return err
+		}
+	}
+	if err = tw.Close(); err != nil {
+		return err
+	}
+	if err = gw.Close(); err != nil {
+		return err
+	}
+
+	x.order = *order
+	return nil
+}
+
+// chartArchive returns the chart archive as served by the repository and
+// checks it against the digest it is pinned to, if any. Charts from sources
+// that neither list an archive url nor are OCI registries are packaged again.
+func (x *OrderExporter) chartArchive(ref releasesapi.ChartSourceRef, chrt *repo.ChartExtended, digest string) ([]byte, error) {
+	pulled, ok, err := pullOCIChart(x.Registry, ref)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		if digest != "" && pulled.Manifest.Digest != digest {
+			return nil, &ChartDigestError{Chart: ref, Expected: digest, Actual: pulled.Manifest.Digest}
+		}
+		return pulled.Chart.Data, nil
+	}
+
+	if len(chrt.URLs) > 0 {
+		r, err := downloadChart(x.Registry, ref, chrt.URLs[0])
+		if err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		if actual := archiveDigest(data); digest != "" && actual != digest {
+			return nil, &ChartDigestError{Chart: ref, Expected: digest, Actual: actual}
+		}
+		return data, nil
+	}
+
+	dir, err := os.MkdirTemp("", "kubepack-export-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	filename, err := chartutil.Save(chrt.Chart, dir)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(filepath.Clean(filename))
+}
+
+func archiveDigest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Result returns the exported Order and the container images used by its
+// charts.
+func (x *OrderExporter) Result() (releasesapi.Order, []string) {
+	return x.order, x.images
+}
+
+// containerImages returns the images of every container, init container and
+// ephemeral container found in an object, including the pod templates of
+// workloads and custom resources.
+func containerImages(obj map[string]any) []string {
+	var out []string
+	for k, v := range obj {
+		switch val := v.(type) {
+		case map[string]any:
+			out = append(out, containerImages(val)...)
+		case []any:
+			isContainers := k == "containers" || k == "initContainers" || k == "ephemeralContainers"
+			for _, e := range val {
+				m, ok := e.(map[string]any)
+				if !ok {
+					continue
+				}
+				if isContainers {
+					if image, ok, _ := unstructured.NestedString(m, "image"); ok && image != "" {
+						out = append(out, image)
+					}
+				}
+				out = append(out, containerImages(m)...)
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,324 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	kmapi "kmodules.xyz/client-go/api/v1"
+	"sigs.k8s.io/yaml"
+	releasesapi "x-helm.dev/apimachinery/apis/releases/v1alpha1"
+)
+
+func TestContainerImages(t *testing.T) {
+	cases := []struct {
+		name string
+		obj  string
+		want []string
+	}{
+		{
+			name: "deployment",
+			obj: `apiVersion: apps/v1
+kind: Deployment
+spec:
+  template:
+    spec:
+      initContainers:
+      - name: init
+        image: busybox:1.36
+      containers:
+      - name: operator
+        image: appscode/stash:v0.9.0-rc.6
+      - name: pushgateway
+        image: prom/pushgateway:v0.5.2
+`,
+			want: []string{"appscode/stash:v0.9.0-rc.6", "busybox:1.36", "prom/pushgateway:v0.5.2"},
+		},
+		{
+			name: "cronjob",
+			obj: `apiVersion: batch/v1
+kind: CronJob
+spec:
+  jobTemplate:
+    spec:
+      template:
+        spec:
+          containers:
+          - name: backup
+            image: appscode/kubectl:v1.12
+`,
+			want: []string{"appscode/kubectl:v1.12"},
+		},
+		{
+			name: "ephemeral containers",
+			obj: `apiVersion: v1
+kind: Pod
+spec:
+  containers:
+  - name: app
+    image: nginx:1.25
+  ephemeralContainers:
+  - name: debugger
+    image: busybox:1.36
+    targetContainerName: app
+`,
+			want: []string{"busybox:1.36", "nginx:1.25"},
+		},
+		{
+			name: "custom resource pod templates",
+			obj: `apiVersion: kubedb.com/v1alpha1
+kind: Postgres
+spec:
+  podTemplate:
+    spec:
+      containers:
+      - name: postgres
+        image: kubedb/postgres:11.2
+  monitor:
+    prometheus:
+      exporter:
+        containers:
+        - name: exporter
+          image: kubedb/postgres_exporter:v0.4.7
+  init:
+    scripts:
+    - name: without-image
+`,
+			want: []string{"kubedb/postgres:11.2", "kubedb/postgres_exporter:v0.4.7"},
+		},
+		{
+			name: "containers without image",
+			obj: `apiVersion: v1
+kind: ConfigMap
+data:
+  containers: "[]"
+spec:
+  containers:
+  - name: app
+  - name: sidecar
+    image: ""
+`,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var obj map[string]any
+			err := yaml.Unmarshal([]byte(c.obj), &obj)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := containerImages(obj)
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("got images %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+// readArchive returns the files of a gzipped tarball by name.
+func readArchive(t *testing.T, data []byte) map[string][]byte {
+	t.Helper()
+	gr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{}
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		files[hdr.Name], err = io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return files
+}
+
+func stashOrder(t *testing.T, digest string) releasesapi.Order {
+	t.Helper()
+	order := releasesapi.Order{
+		Spec: releasesapi.OrderSpec{
+			Packages: []releasesapi.PackageSelection{
+				{
+					Chart: &releasesapi.ChartSelection{
+						ChartRef: releasesapi.ChartRef{
+							Name: "stash",
+							SourceRef: kmapi.TypedObjectReference{
+								Kind: releasesapi.SourceKindLegacy,
+								Name: "https://charts.example.com/stable/",
+							},
+						},
+						Version:     "v0.9.0-rc.6",
+						ReleaseName: "stash",
+						Namespace:   "kube-system",
+					},
+				},
+			},
+		},
+	}
+	err := setChartDigests(&order, map[string]string{"kube-system/stash": digest}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return order
+}
+
+func TestOrderExporter(t *testing.T) {
+	reg, err := NewArchiveRegistry("../../testdata/archives")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const digest = "59060c795cb2ff4109ef9cbfb44cca9d3670be44a4089fe0047d1da9a4242355"
+
+	var buf bytes.Buffer
+	x := &OrderExporter{
+		Registry: reg,
+		Order:    stashOrder(t, digest),
+		W:        &buf,
+	}
+	err = x.Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+	order, images := x.Result()
+
+	want := []string{"appscode/stash:v0.9.0-rc.6", "prom/pushgateway:v0.5.2"}
+	if !reflect.DeepEqual(images, want) {
+		t.Errorf("got images %v, want %v", images, want)
+	}
+	if ref := order.Spec.Packages[0].Chart.SourceRef; ref.Kind != releasesapi.SourceKindLegacy || ref.Name != ArchiveRepositoryURL {
+		t.Errorf("got source %+v, want %s", ref, ArchiveRepositoryURL)
+	}
+	if got := order.Annotations[ChartDigestsAnnotation]; got != `{"kube-system/stash":"`+digest+`"}` {
+		t.Errorf("got chart digests %s, want the digest of the archived chart", got)
+	}
+
+	files := readArchive(t, buf.Bytes())
+	var saved releasesapi.Order
+	err = yaml.Unmarshal(files[ArchiveOrderFile], &saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(saved, order) {
+		t.Errorf("got archived order %+v, want %+v", saved, order)
+	}
+	if got := string(files[ArchiveImagesFile]); got != strings.Join(want, "\n")+"\n" {
+		t.Errorf("got archived images %q", got)
+	}
+	if _, ok := files[archiveAppReleaseCRD]; !ok {
+		t.Errorf("archive does not hold %s", archiveAppReleaseCRD)
+	}
+
+	// the archive can be installed from, pinned to the archived charts
+	filename := filepath.Join(t.TempDir(), "order.tar.gz")
+	err = os.WriteFile(filename, buf.Bytes(), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ar, err := NewArchiveRegistry(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vreg, err := VerifyChartDigests(ar, saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkg := saved.Spec.Packages[0].Chart
+	chrt, err := vreg.GetChart(releasesapi.ChartSourceRef{
+		Name:      pkg.Name,
+		Version:   pkg.Version,
+		SourceRef: pkg.SourceRef,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chrt.Digest != digest {
+		t.Errorf("got archived chart digest %s, want %s", chrt.Digest, digest)
+	}
+}
+
+func TestOrderExporterVerifiesDigest(t *testing.T) {
+	reg, err := NewArchiveRegistry("../../testdata/archives")
+	if err != nil {
+		t.Fatal(err)
+	}
+	x := &OrderExporter{
+		Registry: reg,
+		Order:    stashOrder(t, strings.Repeat("0", 64)),
+		W:        &bytes.Buffer{},
+	}
+	err = x.Do()
+	if _, ok := err.(*ChartDigestError); !ok {
+		t.Fatalf("got error %v, want a ChartDigestError", err)
+	}
+}
+
+func TestOrderExporterPinsUnpinnedCharts(t *testing.T) {
+	reg, err := NewArchiveRegistry("../../testdata/archives")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const digest = "59060c795cb2ff4109ef9cbfb44cca9d3670be44a4089fe0047d1da9a4242355"
+
+	order := stashOrder(t, digest)
+	// the chart of the order was not pinned when it was created
+	err = setChartDigests(&order, nil, []string{"kube-system/stash"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	x := &OrderExporter{
+		Registry: reg,
+		Order:    order,
+		W:        &bytes.Buffer{},
+	}
+	err = x.Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exported, _ := x.Result()
+
+	if _, ok := exported.Annotations[UnpinnedChartsAnnotation]; ok {
+		t.Errorf("got unpinned charts %s, want the annotation removed", exported.Annotations[UnpinnedChartsAnnotation])
+	}
+	digests, err := ChartDigests(exported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"kube-system/stash": digest}; !reflect.DeepEqual(digests, want) {
+		t.Errorf("got chart digests %v, want %v", digests, want)
+	}
+	if _, ok := order.Annotations[UnpinnedChartsAnnotation]; !ok {
+		t.Error("the exported order must not modify the order of the exporter")
+	}
+}
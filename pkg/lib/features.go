@@ -0,0 +1,156 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"slices"
+
+	"kubepack.dev/lib-helm/pkg/repo"
+
+	releasesapi "x-helm.dev/apimachinery/apis/releases/v1alpha1"
+)
+
+// The features of a bundle are its own features plus the features inherited
+// from its nested bundles and from the chosen bundle of each of its OneOfs,
+// as returned by chosenOneOfIndex. OneOfs without a chosen bundle, like the
+// OneOfs of bundle definitions, use the bundle declared as their default, see
+// DefaultOneOfAnnotation, the same as CreateOrder. OneOfs with neither add
+// no features, since what they install is not known yet.
+// When more than one bundle sets the same trait, the value set by the bundle
+// itself wins over nested bundles, nested bundles win over OneOf bundles and
+// earlier packages win over later ones.
+
+// mergeFeatures returns own followed by the inherited features whose trait
+// is not set yet.
+func mergeFeatures(own []releasesapi.Feature, inherited ...[]releasesapi.Feature) []releasesapi.Feature {
+	out := make([]releasesapi.Feature, 0, len(own))
+	seen := map[string]bool{}
+	for _, list := range append([][]releasesapi.Feature{own}, inherited...) {
+		for _, f := range list {
+			if !seen[f.Trait] {
+				seen[f.Trait] = true
+				out = append(out, f)
+			}
+		}
+	}
+	return out
+}
+
+// viewFeatures returns the features of a view of the given bundle, based on
+// the features of its nested bundle views and the currently chosen or
+// default OneOf bundles.
+func viewFeatures(bundle *releasesapi.Bundle, bv *releasesapi.BundleOptionView) ([]releasesapi.Feature, error) {
+	var nested, oneOfs [][]releasesapi.Feature
+	for _, pkg := range bv.Packages {
+		if pkg.Bundle != nil {
+			nested = append(nested, pkg.Bundle.Features)
+		} else if pkg.OneOf != nil && len(pkg.OneOf.Bundles) > 0 {
+			idx, err := chosenOneOfIndex(pkg.OneOf)
+			if err != nil {
+				return nil, err
+			}
+			if idx < 0 {
+				idx, err = viewOneOfDefault(bundle, pkg.OneOf)
+				if err != nil {
+					return nil, err
+				}
+			}
+			if idx >= 0 {
+				oneOfs = append(oneOfs, pkg.OneOf.Bundles[idx].Features)
+			}
+		}
+	}
+	return mergeFeatures(bundle.Spec.Features, append(nested, oneOfs...)...), nil
+}
+
+// RefreshFeatures recomputes the features of a bundle view and its nested
+// bundle views, eg, after another OneOf bundle was chosen using SelectOneOf.
+func RefreshFeatures(reg repo.IRegistry, bv *releasesapi.BundleOptionView, opts ...ResolveOption) error {
+	return refreshFeatures(newBundleResolver(reg, opts), bv)
+}
+
+func refreshFeatures(r *bundleResolver, bv *releasesapi.BundleOptionView) error {
+	_, bundle, err := r.enter(&releasesapi.BundleOption{
+		BundleRef: releasesapi.BundleRef{
+			Name:      bv.Name,
+			SourceRef: bv.SourceRef,
+		},
+		Version: bv.Version,
+	})
+	if err != nil {
+		return err
+	}
+	defer r.leave()
+
+	for _, pkg := range bv.Packages {
+		if pkg.Bundle != nil {
+			err = refreshFeatures(r, pkg.Bundle)
+			if err != nil {
+				return err
+			}
+		} else if pkg.OneOf != nil {
+			for _, alt := range pkg.OneOf.Bundles {
+				err = refreshFeatures(r, alt)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	bv.Features, err = viewFeatures(bundle, bv)
+	return err
+}
+
+// bundleFeatures returns the features of a bundle definition, using the
+// declared default bundle of every OneOf.
+func bundleFeatures(r *bundleResolver, in *releasesapi.BundleOption) ([]releasesapi.Feature, error) {
+	_, bundle, err := r.enter(in)
+	if err != nil {
+		return nil, err
+	}
+	defer r.leave()
+
+	var nested, oneOfs [][]releasesapi.Feature
+	for _, pkg := range bundle.Spec.Packages {
+		if pkg.Bundle != nil {
+			features, err := bundleFeatures(r, pkg.Bundle)
+			if err != nil {
+				return nil, err
+			}
+			nested = append(nested, features)
+		} else if pkg.OneOf != nil && len(pkg.OneOf.Bundles) > 0 {
+			names := make([]string, 0, len(pkg.OneOf.Bundles))
+			for _, bo := range pkg.OneOf.Bundles {
+				names = append(names, bo.Name)
+			}
+			name, err := defaultOneOf(bundle, pkg.OneOf.Description, names)
+			if err != nil {
+				return nil, err
+			}
+			if name == "" {
+				continue
+			}
+			features, err := bundleFeatures(r, pkg.OneOf.Bundles[slices.Index(names, name)])
+			if err != nil {
+				return nil, err
+			}
+			oneOfs = append(oneOfs, features)
+		}
+	}
+	return mergeFeatures(bundle.Spec.Features, append(nested, oneOfs...)...), nil
+}
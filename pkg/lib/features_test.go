@@ -0,0 +1,299 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"reflect"
+	"testing"
+
+	"kubepack.dev/lib-helm/pkg/repo"
+
+	kmapi "kmodules.xyz/client-go/api/v1"
+	productsapi "x-helm.dev/apimachinery/apis/products/v1alpha1"
+	releasesapi "x-helm.dev/apimachinery/apis/releases/v1alpha1"
+)
+
+func TestPlanFeaturesMatchBundleView(t *testing.T) {
+	cases := []struct {
+		name        string
+		annotations map[string]string
+		want        []releasesapi.Feature
+	}{
+		{
+			name:        "declared default",
+			annotations: map[string]string{DefaultOneOfAnnotation: `{"database":"pg"}`},
+			want: []releasesapi.Feature{
+				{Trait: "tier", Value: "basic"},
+				{Trait: "db", Value: "postgres"},
+			},
+		},
+		{
+			name:        "other declared default",
+			annotations: map[string]string{DefaultOneOfAnnotation: `{"database":"my"}`},
+			want: []releasesapi.Feature{
+				{Trait: "tier", Value: "basic"},
+				{Trait: "db", Value: "mysql"},
+			},
+		},
+		{
+			// what the OneOf installs is not known until a bundle is chosen
+			name: "no default",
+			want: []releasesapi.Feature{{Trait: "tier", Value: "basic"}},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeAnnotatedBundleChart(t, dir, "plan", "0.1.0", c.annotations, `  namespace: demo
+  features:
+  - trait: tier
+    value: basic
+  packages:
+  - oneOf:
+      description: database
+      bundles:
+      - name: pg
+        sourceRef: {kind: Legacy, name: "https://x"}
+        version: 0.1.0
+      - name: my
+        sourceRef: {kind: Legacy, name: "https://x"}
+        version: 0.1.0
+`)
+			writeBundleChart(t, dir, "pg", "0.1.0", `  namespace: demo
+  features:
+  - trait: tier
+    value: postgres
+  - trait: db
+    value: postgres
+  packages: []
+`)
+			writeBundleChart(t, dir, "my", "0.1.0", `  namespace: demo
+  features:
+  - trait: db
+    value: mysql
+  packages: []
+`)
+
+			reg, err := NewArchiveRegistry(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			srcRef := kmapi.TypedObjectReference{
+				Kind: releasesapi.SourceKindLegacy,
+				Name: ArchiveRepositoryURL,
+			}
+
+			bv, err := CreateBundleViewForBundle(reg, &releasesapi.ChartSourceRef{
+				Name:      "plan",
+				Version:   "0.1.0",
+				SourceRef: srcRef,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(bv.Features, c.want) {
+				t.Errorf("got BundleView features %v, want %v", bv.Features, c.want)
+			}
+
+			table, err := ComparePlans(reg, srcRef, []string{"plan"}, "0.1.0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []releasesapi.Feature
+			for _, row := range table.Rows {
+				got = append(got, releasesapi.Feature{Trait: row.Trait, Value: row.Values[0]})
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("got plan features %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestComparePlans(t *testing.T) {
+	dir := t.TempDir()
+	writeBundleChart(t, dir, "starter", "0.1.0", `  namespace: demo
+  features:
+  - trait: tier
+    value: starter
+  - trait: support
+    value: community
+  packages: []
+`)
+	writeAnnotatedBundleChart(t, dir, "pro", "0.1.0", map[string]string{DefaultOneOfAnnotation: `{"database":"pg"}`}, `  namespace: demo
+  features:
+  - trait: tier
+    value: pro
+  packages:
+  - bundle:
+      name: monitoring
+      sourceRef: {kind: Legacy, name: "https://x"}
+      version: 0.1.0
+  - oneOf:
+      description: database
+      bundles:
+      - name: pg
+        sourceRef: {kind: Legacy, name: "https://x"}
+        version: 0.1.0
+      - name: my
+        sourceRef: {kind: Legacy, name: "https://x"}
+        version: 0.1.0
+`)
+	writeBundleChart(t, dir, "monitoring", "0.1.0", `  namespace: demo
+  features:
+  - trait: tier
+    value: monitoring
+  - trait: metrics
+    value: prometheus
+  packages: []
+`)
+	writeBundleChart(t, dir, "pg", "0.1.0", `  namespace: demo
+  features:
+  - trait: db
+    value: postgres
+  packages: []
+`)
+	writeBundleChart(t, dir, "my", "0.1.0", `  namespace: demo
+  features:
+  - trait: db
+    value: mysql
+  packages: []
+`)
+
+	reg, err := NewArchiveRegistry(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srcRef := kmapi.TypedObjectReference{
+		Kind: releasesapi.SourceKindLegacy,
+		Name: ArchiveRepositoryURL,
+	}
+	table, err := ComparePlans(reg, srcRef, []string{"starter", "pro"}, "0.1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// pro declares the tier itself, inherits metrics from its nested bundle
+	// and db from the default bundle of its OneOf
+	want := []productsapi.Row{
+		{Trait: "tier", Values: []string{"starter", "pro"}},
+		{Trait: "support", Values: []string{"community", ""}},
+		{Trait: "metrics", Values: []string{"", "prometheus"}},
+		{Trait: "db", Values: []string{"", "postgres"}},
+	}
+	var got []productsapi.Row
+	for _, row := range table.Rows {
+		got = append(got, *row)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got rows %v, want %v", got, want)
+	}
+}
+
+func TestCreateBundleViewEmptyOneOf(t *testing.T) {
+	dir := t.TempDir()
+	writeBundleChart(t, dir, "plan", "0.1.0", `  namespace: demo
+  features:
+  - trait: tier
+    value: basic
+  packages:
+  - oneOf:
+      description: database
+      bundles: []
+`)
+
+	reg, err := NewArchiveRegistry(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bv, err := CreateBundleViewForBundle(reg, &releasesapi.ChartSourceRef{
+		Name:    "plan",
+		Version: "0.1.0",
+		SourceRef: kmapi.TypedObjectReference{
+			Kind: releasesapi.SourceKindLegacy,
+			Name: ArchiveRepositoryURL,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []releasesapi.Feature{{Trait: "tier", Value: "basic"}}
+	if !reflect.DeepEqual(bv.Features, want) {
+		t.Errorf("got BundleView features %v, want %v", bv.Features, want)
+	}
+}
+
+// countingRegistry counts the charts fetched from a registry.
+type countingRegistry struct {
+	repo.IRegistry
+	fetched map[string]int
+}
+
+func (r *countingRegistry) GetChart(ref releasesapi.ChartSourceRef) (*repo.ChartExtended, error) {
+	r.fetched[ref.Name]++
+	return r.IRegistry.GetChart(ref)
+}
+
+func TestComparePlansFetchesSharedBundlesOnce(t *testing.T) {
+	dir := t.TempDir()
+	for _, plan := range []string{"gold", "silver"} {
+		writeBundleChart(t, dir, plan, "0.1.0", `  namespace: demo
+  features:
+  - trait: tier
+    value: `+plan+`
+  packages:
+  - bundle:
+      name: db
+      sourceRef: {kind: Legacy, name: "https://x"}
+      version: 0.1.0
+`)
+	}
+	writeBundleChart(t, dir, "db", "0.1.0", `  namespace: demo
+  features:
+  - trait: db
+    value: postgres
+  packages: []
+`)
+
+	ar, err := NewArchiveRegistry(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := &countingRegistry{IRegistry: ar, fetched: map[string]int{}}
+	srcRef := kmapi.TypedObjectReference{
+		Kind: releasesapi.SourceKindLegacy,
+		Name: ArchiveRepositoryURL,
+	}
+	table, err := ComparePlans(reg, srcRef, []string{"gold", "silver"}, "0.1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := map[string][]string{}
+	for _, row := range table.Rows {
+		got[row.Trait] = row.Values
+	}
+	want := map[string][]string{
+		"tier": {"gold", "silver"},
+		"db":   {"postgres", "postgres"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got features %v, want %v", got, want)
+	}
+	if !reflect.DeepEqual(reg.fetched, map[string]int{"gold": 1, "silver": 1, "db": 1}) {
+		t.Errorf("got fetched charts %v, want every bundle fetched once", reg.fetched)
+	}
+}
@@ -0,0 +1,491 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"kubepack.dev/lib-helm/pkg/repo"
+	"kubepack.dev/lib-helm/pkg/values"
+
+	helmv2 "github.com/fluxcd/helm-controller/api/v2"
+	"github.com/fluxcd/pkg/apis/meta"
+	fluxsrc "github.com/fluxcd/source-controller/api/v1"
+	fluxsrcv1beta2 "github.com/fluxcd/source-controller/api/v1beta2"
+	"helm.sh/helm/v3/pkg/registry"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"kmodules.xyz/client-go/tools/parser"
+	"sigs.k8s.io/yaml"
+	"x-helm.dev/apimachinery/apis"
+	releasesapi "x-helm.dev/apimachinery/apis/releases/v1alpha1"
+)
+
+// Defaults of FluxGenerator.
+const (
+	DefaultFluxNamespace     = "flux-system"
+	DefaultFluxInterval      = 10 * time.Minute
+	DefaultFluxGitRepository = "flux-system"
+)
+
+// Files of the tree generated by FluxGenerator.
+const (
+	FluxKustomizationFile = "kustomization.yaml"
+	FluxSyncFile          = "flux-kustomization.yaml"
+	fluxSourcesDir        = "sources"
+	fluxReleasesDir       = "releases"
+)
+
+// helmChartLayerMediaType is the media type of the layer that holds a chart
+// pushed to an OCI registry.
+const helmChartLayerMediaType = "application/vnd.cncf.helm.chart.content.v1.tar+gzip"
+
+// FluxGenerator turns an Order into the manifests Flux uses to install it.
+// The generated tree is meant to be committed to a git repository:
+//
+//	kustomization.yaml        kustomize config listing the manifests below
+//	sources/<name>.yaml       HelmRepository or OCIRepository of every chart
+//	releases/<name>.yaml      HelmRelease of every package
+//	flux-kustomization.yaml   Flux Kustomization that applies the tree
+//
+// The values of a HelmRelease are the ValuesFile and ValuesPatch of its
+// package, as changes to the chart defaults. The dependsOn of a HelmRelease
+// are the edges of the package graph, ie, the packages owning the resources
+// it requires. Unlike the generated scripts, which install one package after
+// the other in the order of SortPackages, the position of a package in the
+// Order adds no dependency, so that Flux reconciles independent packages in
+// parallel. A package that has to wait for another one must require a
+// resource the other one owns. WaitFors are turned into health checks of the
+// Flux Kustomization. Their conditions are dropped, since Flux checks
+// objects using their status.
+type FluxGenerator struct {
+	Registry repo.IRegistry
+	Order    releasesapi.Order
+	// Namespace of the Flux objects, defaults to DefaultFluxNamespace.
+	Namespace string
+	// Interval of the Flux objects, defaults to DefaultFluxInterval.
+	Interval time.Duration
+	// GitRepository is the name of the GitRepository the tree is committed
+	// to, defaults to DefaultFluxGitRepository.
+	GitRepository string
+	// Path of the tree in the GitRepository, defaults to ./<order name>.
+	Path        string
+	KubeVersion string
+
+	files map[string][]byte
+}
+
+func (x *FluxGenerator) Do() error {
+	name := dnsName(x.Order.Name)
+	if name == "" {
+		return fmt.Errorf("order name is required")
+	}
+	namespace := XorY(x.Namespace, DefaultFluxNamespace)
+	interval := metav1.Duration{Duration: DefaultFluxInterval}
+	if x.Interval > 0 {
+		interval.Duration = x.Interval
+	}
+
+	packages := x.Order.Spec.Packages
+	order, deps, err := chartDependencies(packages)
+	if err != nil {
+		return err
+	}
+	releaseNames := uniqueReleaseNames(packages, order)
+
+	x.files = map[string][]byte{}
+	var sources, releases []string
+	var healthChecks []map[string]any
+	var timeout time.Duration
+	for _, i := range order {
+		chrt := packages[i].Chart
+
+		srcRef, srcFile, src, err := x.source(chrt, namespace, interval)
+		if err != nil {
+			return err
+		}
+		if _, ok := x.files[srcFile]; !ok {
+			data, err := fluxManifest(src)
+			if err != nil {
+				return err
+			}
+			x.files[srcFile] = data
+			sources = append(sources, srcFile)
+		}
+
+		vals, err := chartValuesOverride(x.Registry, chrt)
+		if err != nil {
+			return err
+		}
+
+		hr := helmv2.HelmRelease{
+			TypeMeta: metav1.TypeMeta{
+				APIVersion: helmv2.GroupVersion.String(),
+				Kind:       helmv2.HelmReleaseKind,
+			},
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      releaseNames[i],
+				Namespace: namespace,
+			},
+			Spec: helmv2.HelmReleaseSpec{
+				Interval:         interval,
+				ReleaseName:      chrt.ReleaseName,
+				TargetNamespace:  chrt.Namespace,
+				StorageNamespace: chrt.Namespace,
+				Install: &helmv2.Install{
+					CRDs:            helmv2.CreateReplace,
+					CreateNamespace: !apis.BuiltinNamespaces.Has(chrt.Namespace),
+				},
+				Upgrade: &helmv2.Upgrade{
+					CRDs: helmv2.CreateReplace,
+				},
+			},
+		}
+		if srcRef.Kind == fluxsrcv1beta2.OCIRepositoryKind {
+			hr.Spec.ChartRef = &helmv2.CrossNamespaceSourceReference{
+				Kind:      srcRef.Kind,
+				Name:      srcRef.Name,
+				Namespace: srcRef.Namespace,
+			}
+		} else {
+			hr.Spec.Chart = &helmv2.HelmChartTemplate{
+				Spec: helmv2.HelmChartTemplateSpec{
+					Chart:     chrt.Name,
+					Version:   chrt.Version,
+					SourceRef: srcRef,
+				},
+			}
+		}
+		for _, j := range deps[i] {
+			hr.Spec.DependsOn = append(hr.Spec.DependsOn, meta.NamespacedObjectReference{
+				Name: releaseNames[j],
+			})
+		}
+		if len(vals) > 0 {
+			data, err := json.Marshal(vals)
+			if err != nil {
+				return err
+			}
+			hr.Spec.Values = &apiextensionsv1.JSON{Raw: data}
+		}
+
+		data, err := fluxManifest(&hr)
+		if err != nil {
+			return err
+		}
+		releaseFile := path.Join(fluxReleasesDir, hr.Name+".yaml")
+		x.files[releaseFile] = data
+		releases = append(releases, releaseFile)
+
+		healthChecks = append(healthChecks, map[string]any{
+			"apiVersion": helmv2.GroupVersion.String(),
+			"kind":       helmv2.HelmReleaseKind,
+			"name":       hr.Name,
+			"namespace":  hr.Namespace,
+		})
+		checks, err := x.healthChecks(chrt)
+		if err != nil {
+			return err
+		}
+		healthChecks = append(healthChecks, checks...)
+		for _, w := range chrt.WaitFors {
+			timeout = max(timeout, w.Timeout.Duration)
+		}
+	}
+
+	data, err := yaml.Marshal(map[string]any{
+		"apiVersion": "kustomize.config.k8s.io/v1beta1",
+		"kind":       "Kustomization",
+		"resources":  append(sources, releases...),
+	})
+	if err != nil {
+		return err
+	}
+	x.files[FluxKustomizationFile] = data
+
+	spec := map[string]any{
+		"interval": interval.Duration.String(),
+		"path":     XorY(x.Path, "./"+name),
+		"prune":    true,
+		"sourceRef": map[string]any{
+			"kind": fluxsrc.GitRepositoryKind,
+			"name": XorY(x.GitRepository, DefaultFluxGitRepository),
+		},
+	}
+	if len(healthChecks) > 0 {
+		spec["healthChecks"] = healthChecks
+	}
+	if timeout > 0 {
+		spec["timeout"] = timeout.String()
+	}
+	data, err = yaml.Marshal(map[string]any{
+		"apiVersion": "kustomize.toolkit.fluxcd.io/v1",
+		"kind":       "Kustomization",
+		"metadata": map[string]any{
+			"name":      name,
+			"namespace": namespace,
+		},
+		"spec": spec,
+	})
+	if err != nil {
+		return err
+	}
+	x.files[FluxSyncFile] = data
+	return nil
+}
+
+// Result returns the generated files, keyed by their path in the tree.
+func (x *FluxGenerator) Result() map[string][]byte {
+	return x.files
+}
+
+// source returns the source of a chart along with the file it is written
+// to. Charts of the same chart repository share a HelmRepository. Charts in
+// an OCI registry get an OCIRepository each, pinned to their version.
+func (x *FluxGenerator) source(chrt *releasesapi.ChartSelection, namespace string, interval metav1.Duration) (helmv2.CrossNamespaceObjectReference, string, runtime.Object, error) {
+	var ref helmv2.CrossNamespaceObjectReference
+	switch chrt.SourceRef.Kind {
+	case releasesapi.SourceKindLocal, releasesapi.SourceKindEmbed:
+		return ref, "", nil, fmt.Errorf("chart %s uses a %s source which is not supported by Flux", chrt.Name, chrt.SourceRef.Kind)
+	}
+	repoURL, err := chartRepositoryURL(x.Registry, chrt.ChartRef, chrt.Version)
+	if err != nil {
+		return ref, "", nil, err
+	}
+
+	if registry.IsOCI(repoURL) {
+		chartURL, err := ociChartURL(repoURL, chrt.Name)
+		if err != nil {
+			return ref, "", nil, err
+		}
+		src := &fluxsrcv1beta2.OCIRepository{
+			TypeMeta: metav1.TypeMeta{
+				APIVersion: fluxsrcv1beta2.GroupVersion.String(),
+				Kind:       fluxsrcv1beta2.OCIRepositoryKind,
+			},
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      dnsName(chrt.Name + "-" + chrt.Version),
+				Namespace: namespace,
+			},
+			Spec: fluxsrcv1beta2.OCIRepositorySpec{
+				URL:      chartURL,
+				Interval: interval,
+				LayerSelector: &fluxsrcv1beta2.OCILayerSelector{
+					MediaType: helmChartLayerMediaType,
+					Operation: fluxsrcv1beta2.OCILayerCopy,
+				},
+			},
+		}
+		if chrt.Version != "" {
+			src.Spec.Reference = &fluxsrcv1beta2.OCIRepositoryRef{Tag: chrt.Version}
+		}
+		ref = helmv2.CrossNamespaceObjectReference{
+			Kind:      src.Kind,
+			Name:      src.Name,
+			Namespace: src.Namespace,
+		}
+		return ref, path.Join(fluxSourcesDir, "oci-"+src.Name+".yaml"), src, nil
+	}
+
+	srcName := chrt.SourceRef.Name
+	if chrt.SourceRef.Kind != releasesapi.SourceKindHelmRepository {
+		srcName = dnsName(strings.TrimPrefix(strings.TrimPrefix(repoURL, "https://"), "http://"))
+	}
+	src := &fluxsrc.HelmRepository{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: fluxsrc.GroupVersion.String(),
+			Kind:       fluxsrc.HelmRepositoryKind,
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      srcName,
+			Namespace: namespace,
+		},
+		Spec: fluxsrc.HelmRepositorySpec{
+			URL:      repoURL,
+			Interval: interval,
+		},
+	}
+	ref = helmv2.CrossNamespaceObjectReference{
+		Kind:      src.Kind,
+		Name:      src.Name,
+		Namespace: src.Namespace,
+	}
+	return ref, path.Join(fluxSourcesDir, src.Name+".yaml"), src, nil
+}
+
+// healthChecks returns the health checks of the objects selected by the
+// WaitFors of a package.
+func (x *FluxGenerator) healthChecks(chrt *releasesapi.ChartSelection) ([]map[string]any, error) {
+	if len(chrt.WaitFors) == 0 {
+		return nil, nil
+	}
+	objects, err := renderedObjects(x.Registry, chrt, XorY(x.KubeVersion, apis.DefaultKubernetesVersion))
+	if err != nil {
+		return nil, err
+	}
+
+	var out []map[string]any
+	seen := map[string]bool{}
+	for _, w := range chrt.WaitFors {
+		matches, err := waitForObjects(w, objects)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range matches {
+			check := map[string]any{
+				"apiVersion": obj.GetAPIVersion(),
+				"kind":       obj.GetKind(),
+				"name":       obj.GetName(),
+				"namespace":  XorY(obj.GetNamespace(), chrt.Namespace),
+			}
+			key := fmt.Sprint(check)
+			if !seen[key] {
+				seen[key] = true
+				out = append(out, check)
+			}
+		}
+	}
+	return out, nil
+}
+
+// renderedObjects returns the objects rendered by the chart of a package.
+func renderedObjects(reg repo.IRegistry, chrt *releasesapi.ChartSelection, kubeVersion string) ([]*unstructured.Unstructured, error) {
+	manifests, err := renderPackage(reg, chrt, kubeVersion)
+	if err != nil {
+		return nil, err
+	}
+	var out []*unstructured.Unstructured
+	for _, data := range manifests {
+		err = parser.ProcessResources(data, func(ri parser.ResourceInfo) error {
+			out = append(out, ri.Object)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// uniqueReleaseNames returns the names of the objects, eg, HelmReleases,
+// that install the chart packages from a single namespace. Releases sharing
+// a name across namespaces are prefixed with their namespace.
+func uniqueReleaseNames(packages []releasesapi.PackageSelection, order []int) []string {
+	count := map[string]int{}
+	for _, i := range order {
+		count[packages[i].Chart.ReleaseName]++
+	}
+	out := make([]string, len(packages))
+	for _, i := range order {
+		chrt := packages[i].Chart
+		out[i] = chrt.ReleaseName
+		if count[chrt.ReleaseName] > 1 {
+			out[i] = dnsName(chrt.Namespace + "-" + chrt.ReleaseName)
+		}
+	}
+	return out
+}
+
+// chartValuesOverride returns the values of a package as changes to the
+// defaults of its chart.
+func chartValuesOverride(reg repo.IRegistry, chrt *releasesapi.ChartSelection) (map[string]any, error) {
+	c, err := reg.GetChart(releasesapi.ChartSourceRef{
+		Name:      chrt.Name,
+		Version:   chrt.Version,
+		SourceRef: chrt.SourceRef,
+	})
+	if err != nil {
+		return nil, err
+	}
+	opts := values.Options{
+		ValuesFile:  chrt.ValuesFile,
+		ValuesPatch: chrt.ValuesPatch,
+	}
+	vals, err := opts.MergeValues(c.Chart)
+	if err != nil {
+		return nil, err
+	}
+
+	defaults, err := toJson(c.Values)
+	if err != nil {
+		return nil, err
+	}
+	vals, err = toJson(vals)
+	if err != nil {
+		return nil, err
+	}
+	return valuesOverride(defaults, vals), nil
+}
+
+// valuesOverride returns the values that turn defaults into vals. Keys
+// missing from vals are set to null, which makes Helm drop them.
+func valuesOverride(defaults, vals map[string]any) map[string]any {
+	out := map[string]any{}
+	for k, v := range vals {
+		d, ok := defaults[k]
+		if !ok {
+			out[k] = v
+			continue
+		}
+		dm, dok := d.(map[string]any)
+		vm, vok := v.(map[string]any)
+		if dok && vok {
+			if diff := valuesOverride(dm, vm); len(diff) > 0 {
+				out[k] = diff
+			}
+		} else if !reflect.DeepEqual(d, v) {
+			out[k] = v
+		}
+	}
+	for k := range defaults {
+		if _, ok := vals[k]; !ok {
+			out[k] = nil
+		}
+	}
+	return out
+}
+
+// fluxManifest returns the YAML of an object, without the empty status and
+// creation timestamp of a generated object.
+func fluxManifest(obj any) ([]byte, error) {
+	u, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	if err != nil {
+		return nil, err
+	}
+	delete(u, "status")
+	unstructured.RemoveNestedField(u, "metadata", "creationTimestamp")
+	return yaml.Marshal(u)
+}
+
+var invalidNameChars = regexp.MustCompile(`[^a-z0-9.-]+`)
+
+// dnsName turns s into a valid object name.
+func dnsName(s string) string {
+	s = invalidNameChars.ReplaceAllString(strings.ToLower(s), "-")
+	if len(s) > 63 {
+		s = s[:63]
+	}
+	return strings.Trim(s, ".-")
+}
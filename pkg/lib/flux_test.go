@@ -0,0 +1,254 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"maps"
+	"reflect"
+	"slices"
+	"testing"
+
+	helmv2 "github.com/fluxcd/helm-controller/api/v2"
+	fluxsrc "github.com/fluxcd/source-controller/api/v1"
+	fluxsrcv1beta2 "github.com/fluxcd/source-controller/api/v1beta2"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/yaml"
+	releasesapi "x-helm.dev/apimachinery/apis/releases/v1alpha1"
+)
+
+func TestValuesOverride(t *testing.T) {
+	defaults := map[string]any{
+		"replicas": float64(1),
+		"image": map[string]any{
+			"repository": "nginx",
+			"tag":        "1.25",
+		},
+		"labels": map[string]any{
+			"app": "web",
+		},
+		"args":  []any{"--a"},
+		"debug": false,
+	}
+
+	cases := []struct {
+		name string
+		vals map[string]any
+		want map[string]any
+	}{
+		{
+			name: "unchanged",
+			vals: defaults,
+			want: map[string]any{},
+		},
+		{
+			name: "changed and added keys",
+			vals: map[string]any{
+				"replicas": float64(3),
+				"image": map[string]any{
+					"repository": "nginx",
+					"tag":        "1.27",
+				},
+				"labels": map[string]any{
+					"app": "web",
+				},
+				"args":  []any{"--a"},
+				"debug": false,
+				"extra": "x",
+			},
+			want: map[string]any{
+				"replicas": float64(3),
+				"image": map[string]any{
+					"tag": "1.27",
+				},
+				"extra": "x",
+			},
+		},
+		{
+			name: "removed keys are set to null",
+			vals: map[string]any{
+				"replicas": float64(1),
+				"image": map[string]any{
+					"repository": "nginx",
+				},
+				"args":  []any{"--a"},
+				"debug": false,
+			},
+			want: map[string]any{
+				"image": map[string]any{
+					"tag": nil,
+				},
+				"labels": nil,
+			},
+		},
+		{
+			name: "lists and types are replaced",
+			vals: map[string]any{
+				"replicas": float64(1),
+				"image":    "nginx:1.27",
+				"labels": map[string]any{
+					"app": "web",
+				},
+				"args":  []any{"--a", "--b"},
+				"debug": false,
+			},
+			want: map[string]any{
+				"image": "nginx:1.27",
+				"args":  []any{"--a", "--b"},
+			},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := valuesOverride(defaults, c.vals); !reflect.DeepEqual(got, c.want) {
+				t.Errorf("got %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestFluxGenerator(t *testing.T) {
+	reg, err := NewArchiveRegistry("../../testdata/archives")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// stash owns foos, stash-community requires foos and owns bars,
+	// stash-postgres-community requires bars, stash-mysql-community
+	// requires nothing and is pulled from an OCI registry
+	packages := []releasesapi.PackageSelection{
+		testPackage("stash-community", []string{"bars.example.com"}, []string{"foos.example.com"}),
+		testPackage("stash-mysql-community", nil, nil),
+		testPackage("stash", []string{"foos.example.com"}, nil),
+		testPackage("stash-postgres-community", nil, []string{"bars.example.com"}),
+	}
+	versions := map[string]string{
+		"stash-community":          "v0.9.0-rc.6",
+		"stash-mysql-community":    "v0.1.0",
+		"stash":                    "v0.9.0-rc.6",
+		"stash-postgres-community": "v0.1.0",
+	}
+	// the archive serves the charts of both repositories
+	for _, pkg := range packages {
+		pkg.Chart.SourceRef = archiveChartRef(pkg.Chart.Name, "").SourceRef
+		pkg.Chart.SourceRef.Name = "https://charts.example.com/stable/"
+		pkg.Chart.Version = versions[pkg.Chart.Name]
+	}
+	mysql := packages[1].Chart
+	mysql.SourceRef.Name = "oci://registry.example.com/charts"
+	mysql.ValuesPatch = &runtime.RawExtension{Raw: []byte(`[{"op":"add","path":"/extra","value":"x"}]`)}
+
+	x := &FluxGenerator{
+		Registry: reg,
+		Order: releasesapi.Order{
+			ObjectMeta: metav1.ObjectMeta{Name: "stash"},
+			Spec:       releasesapi.OrderSpec{Packages: packages},
+		},
+	}
+	if err := x.Do(); err != nil {
+		t.Fatal(err)
+	}
+	files := x.Result()
+
+	const (
+		helmRepoFile = "sources/charts.example.com-stable.yaml"
+		ociRepoFile  = "sources/oci-stash-mysql-community-v0.1.0.yaml"
+	)
+	var kustomization struct {
+		Resources []string `json:"resources"`
+	}
+	if err := yaml.Unmarshal(files[FluxKustomizationFile], &kustomization); err != nil {
+		t.Fatal(err)
+	}
+	// releases are listed in install order
+	wantResources := []string{
+		ociRepoFile,
+		helmRepoFile,
+		"releases/stash-mysql-community.yaml",
+		"releases/stash.yaml",
+		"releases/stash-community.yaml",
+		"releases/stash-postgres-community.yaml",
+	}
+	if !reflect.DeepEqual(kustomization.Resources, wantResources) {
+		t.Errorf("got resources %v, want %v", kustomization.Resources, wantResources)
+	}
+	for _, name := range append(wantResources, FluxKustomizationFile, FluxSyncFile) {
+		if _, ok := files[name]; !ok {
+			t.Errorf("%s not generated", name)
+		}
+	}
+	if len(files) != len(wantResources)+2 {
+		t.Errorf("got files %v, want %v", slices.Sorted(maps.Keys(files)), wantResources)
+	}
+
+	var helmRepo fluxsrc.HelmRepository
+	if err := yaml.Unmarshal(files[helmRepoFile], &helmRepo); err != nil {
+		t.Fatal(err)
+	}
+	if helmRepo.Kind != fluxsrc.HelmRepositoryKind || helmRepo.Spec.URL != "https://charts.example.com/stable/" {
+		t.Errorf("got %s with url %s, want a HelmRepository", helmRepo.Kind, helmRepo.Spec.URL)
+	}
+	var ociRepo fluxsrcv1beta2.OCIRepository
+	if err := yaml.Unmarshal(files[ociRepoFile], &ociRepo); err != nil {
+		t.Fatal(err)
+	}
+	if ociRepo.Spec.URL != "oci://registry.example.com/charts/stash-mysql-community" ||
+		ociRepo.Spec.Reference == nil || ociRepo.Spec.Reference.Tag != "v0.1.0" {
+		t.Errorf("got OCIRepository of %s at %v", ociRepo.Spec.URL, ociRepo.Spec.Reference)
+	}
+
+	// dependsOn follows resource ownership only, so stash-mysql-community
+	// and stash are reconciled in parallel
+	wantDeps := map[string][]string{
+		"stash-mysql-community":    nil,
+		"stash":                    nil,
+		"stash-community":          {"stash"},
+		"stash-postgres-community": {"stash-community"},
+	}
+	for name, deps := range wantDeps {
+		var hr helmv2.HelmRelease
+		if err := yaml.Unmarshal(files["releases/"+name+".yaml"], &hr); err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, dep := range hr.Spec.DependsOn {
+			got = append(got, dep.Name)
+		}
+		if !reflect.DeepEqual(got, deps) {
+			t.Errorf("%s: got dependsOn %v, want %v", name, got, deps)
+		}
+
+		if name == "stash-mysql-community" {
+			want := &helmv2.CrossNamespaceSourceReference{
+				Kind:      fluxsrcv1beta2.OCIRepositoryKind,
+				Name:      ociRepo.Name,
+				Namespace: DefaultFluxNamespace,
+			}
+			if hr.Spec.Chart != nil || !reflect.DeepEqual(hr.Spec.ChartRef, want) {
+				t.Errorf("%s: got chart %v and chartRef %v, want chartRef %v", name, hr.Spec.Chart, hr.Spec.ChartRef, want)
+			}
+			if hr.Spec.Values == nil || string(hr.Spec.Values.Raw) != `{"extra":"x"}` {
+				t.Errorf("%s: got values %v, want the values patch", name, hr.Spec.Values)
+			}
+			continue
+		}
+		if hr.Spec.ChartRef != nil || hr.Spec.Chart == nil ||
+			hr.Spec.Chart.Spec.SourceRef.Name != helmRepo.Name || hr.Spec.Chart.Spec.Version != versions[name] {
+			t.Errorf("%s: got chart %v and chartRef %v, want chart of HelmRepository %s", name, hr.Spec.Chart, hr.Spec.ChartRef, helmRepo.Name)
+		}
+	}
+}
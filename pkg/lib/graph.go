@@ -0,0 +1,335 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	releasesapi "x-helm.dev/apimachinery/apis/releases/v1alpha1"
+)
+
+// packageGraph is the dependency graph of the packages in an Order.
+// A package depends on every package that owns a resource it requires.
+type packageGraph struct {
+	packages []releasesapi.PackageSelection
+	// deps[i] holds the indices of the packages that package i depends on
+	deps [][]int
+	// dependents[i] holds the indices of the packages that depend on package i
+	dependents [][]int
+}
+
+func packageName(pkg releasesapi.PackageSelection) string {
+	if pkg.Chart == nil {
+		return ""
+	}
+	return pkg.Chart.Namespace + "/" + pkg.Chart.ReleaseName
+}
+
+func newPackageGraph(packages []releasesapi.PackageSelection) (*packageGraph, error) {
+	g := &packageGraph{
+		packages:   packages,
+		deps:       make([][]int, len(packages)),
+		dependents: make([][]int, len(packages)),
+	}
+
+	owners := map[schema.GroupResource][]int{}
+	for i, pkg := range packages {
+		if pkg.Chart == nil || pkg.Chart.Resources == nil {
+			continue
+		}
+		for _, gvr := range pkg.Chart.Resources.Owned {
+			gr := schema.GroupResource{Group: gvr.Group, Resource: gvr.Resource}
+			owners[gr] = append(owners[gr], i)
+		}
+	}
+
+	var errs []error
+	for i, pkg := range packages {
+		if pkg.Chart == nil || pkg.Chart.Resources == nil {
+			continue
+		}
+		seen := map[int]bool{}
+		for _, gvr := range pkg.Chart.Resources.Required {
+			gr := schema.GroupResource{Group: gvr.Group, Resource: gvr.Resource}
+			ids, ok := owners[gr]
+			if !ok {
+				errs = append(errs, fmt.Errorf("package %s requires %s which is not owned by any package in the order", packageName(pkg), gr))
+				continue
+			}
+			for _, j := range ids {
+				if j == i || seen[j] {
+					continue
+				}
+				seen[j] = true
+				g.deps[i] = append(g.deps[i], j)
+				g.dependents[j] = append(g.dependents[j], i)
+			}
+		}
+		sort.Ints(g.deps[i])
+	}
+	for j := range g.dependents {
+		sort.Ints(g.dependents[j])
+	}
+	if len(errs) > 0 {
+		return nil, utilerrors.NewAggregate(errs)
+	}
+	return g, nil
+}
+
+// sorted returns the package indices in topological order. Packages that do
+// not depend on each other keep the order in which they appear in the Order.
+func (g *packageGraph) sorted() ([]int, error) {
+	indegree := make([]int, len(g.packages))
+	for i := range g.packages {
+		indegree[i] = len(g.deps[i])
+	}
+
+	var ready []int
+	for i, d := range indegree {
+		if d == 0 {
+			ready = append(ready, i)
+		}
+	}
+
+	out := make([]int, 0, len(g.packages))
+	for len(ready) > 0 {
+		sort.Ints(ready)
+		i := ready[0]
+		ready = ready[1:]
+		out = append(out, i)
+		for _, j := range g.dependents[i] {
+			indegree[j]--
+			if indegree[j] == 0 {
+				ready = append(ready, j)
+			}
+		}
+	}
+
+	if len(out) < len(g.packages) {
+		return nil, fmt.Errorf("dependency cycle found among packages: %s", strings.Join(g.findCycle(indegree), " -> "))
+	}
+	return out, nil
+}
+
+// findCycle returns the names of the packages that form a cycle. Only
+// packages left with a non-zero indegree after sorting are considered.
+func (g *packageGraph) findCycle(indegree []int) []string {
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	state := make([]int, len(g.packages))
+	var stack []int
+
+	var visit func(i int) []int
+	visit = func(i int) []int {
+		state[i] = visiting
+		stack = append(stack, i)
+		for _, j := range g.deps[i] {
+			if indegree[j] == 0 {
+				continue
+			}
+			switch state[j] {
+			case visiting:
+				for k := len(stack) - 1; k >= 0; k-- {
+					if stack[k] == j {
+						return append(append([]int{}, stack[k:]...), j)
+					}
+				}
+			case unvisited:
+				if c := visit(j); c != nil {
+					return c
+				}
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[i] = done
+		return nil
+	}
+
+	for i := range g.packages {
+		if indegree[i] == 0 || state[i] != unvisited {
+			continue
+		}
+		if c := visit(i); c != nil {
+			names := make([]string, 0, len(c))
+			// deps point from dependent to dependency, so reverse to show install order
+			for k := len(c) - 1; k >= 0; k-- {
+				names = append(names, packageName(g.packages[c[k]]))
+			}
+			return names
+		}
+	}
+	return nil
+}
+
+// run calls fn for every package once all of its dependencies succeeded,
+// using up to workers goroutines. Dependents of a failed package are skipped.
+// If failFast is set, no new package is started after the first failure.
+// skipped, if set, is called for every package that is not run, with the
+// reason. The graph must be acyclic.
+func (g *packageGraph) run(workers int, failFast bool, fn func(i int) error, skipped func(i int, err error)) error {
+	if workers < 1 {
+		workers = 1
+	}
+
+	type result struct {
+		i   int
+		err error
+	}
+
+	pending := make([]int, len(g.packages))
+	var ready []int
+	for i := range g.packages {
+		pending[i] = len(g.deps[i])
+		if pending[i] == 0 {
+			ready = append(ready, i)
+		}
+	}
+
+	errs := make([]error, len(g.packages))
+	started := make([]bool, len(g.packages))
+	results := make(chan result)
+	running := 0
+	stopped := false
+
+	var skip func(i int, cause string)
+	skip = func(i int, cause string) {
+		for _, j := range g.dependents[i] {
+			if errs[j] == nil {
+				errs[j] = fmt.Errorf("skipped since dependency %s failed", cause)
+				skip(j, cause)
+			}
+		}
+	}
+
+	for {
+		for !stopped && running < workers && len(ready) > 0 {
+			sort.Ints(ready)
+			i := ready[0]
+			ready = ready[1:]
+			started[i] = true
+			running++
+			go func(i int) {
+				results <- result{i: i, err: fn(i)}
+			}(i)
+		}
+		if running == 0 {
+			break
+		}
+
+		r := <-results
+		running--
+		if r.err != nil {
+			errs[r.i] = r.err
+			skip(r.i, packageName(g.packages[r.i]))
+			stopped = stopped || failFast
+			continue
+		}
+		for _, j := range g.dependents[r.i] {
+			pending[j]--
+			if pending[j] == 0 && errs[j] == nil {
+				ready = append(ready, j)
+			}
+		}
+	}
+
+	if skipped != nil {
+		for i := range g.packages {
+			switch {
+			case started[i]:
+			case errs[i] != nil:
+				skipped(i, errs[i])
+			case stopped:
+				skipped(i, errors.New("skipped since the install stopped after a failure"))
+			}
+		}
+	}
+
+	var out []error
+	for i, err := range errs {
+		if err != nil {
+			out = append(out, fmt.Errorf("package %s: %w", packageName(g.packages[i]), err))
+		}
+	}
+	return utilerrors.NewAggregate(out)
+}
+
+// SortPackages orders packages so that a package requiring a resource is
+// installed after the package that owns it.
+func SortPackages(packages []releasesapi.PackageSelection) ([]releasesapi.PackageSelection, error) {
+	g, err := newPackageGraph(packages)
+	if err != nil {
+		return nil, err
+	}
+	ids, err := g.sorted()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]releasesapi.PackageSelection, 0, len(ids))
+	for _, i := range ids {
+		out = append(out, packages[i])
+	}
+	return out, nil
+}
+
+// chartDependencies returns the indices of the chart packages in install
+// order and, for each of them, the packages owning the resources it
+// requires, in install order. Packages that don't depend on each other can
+// be installed in parallel.
+func chartDependencies(packages []releasesapi.PackageSelection) ([]int, [][]int, error) {
+	g, err := newPackageGraph(packages)
+	if err != nil {
+		return nil, nil, err
+	}
+	ids, err := g.sorted()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var order []int
+	for _, i := range ids {
+		if packages[i].Chart != nil {
+			order = append(order, i)
+		}
+	}
+	pos := make(map[int]int, len(order))
+	for k, i := range order {
+		pos[i] = k
+	}
+
+	deps := make([][]int, len(packages))
+	for _, i := range order {
+		seen := map[int]bool{}
+		for _, j := range g.deps[i] {
+			if _, ok := pos[j]; ok && !seen[j] {
+				seen[j] = true
+				deps[i] = append(deps[i], j)
+			}
+		}
+		sort.Slice(deps[i], func(a, b int) bool {
+			return pos[deps[i][a]] < pos[deps[i][b]]
+		})
+	}
+	return order, deps, nil
+}
@@ -0,0 +1,255 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	releasesapi "x-helm.dev/apimachinery/apis/releases/v1alpha1"
+)
+
+// testPackage returns a package named ns/name that owns and requires the
+// given group resources, eg, foos.example.com.
+func testPackage(name string, owned, required []string) releasesapi.PackageSelection {
+	toGVRs := func(grs []string) []metav1.GroupVersionResource {
+		out := make([]metav1.GroupVersionResource, 0, len(grs))
+		for _, s := range grs {
+			gr := schema.ParseGroupResource(s)
+			out = append(out, metav1.GroupVersionResource{Group: gr.Group, Version: "v1", Resource: gr.Resource})
+		}
+		return out
+	}
+	return releasesapi.PackageSelection{
+		Chart: &releasesapi.ChartSelection{
+			ChartRef:    releasesapi.ChartRef{Name: name},
+			ReleaseName: name,
+			Namespace:   "ns",
+			Resources: &releasesapi.ResourceDefinitions{
+				Owned:    toGVRs(owned),
+				Required: toGVRs(required),
+			},
+		},
+	}
+}
+
+func TestPackageGraphSorted(t *testing.T) {
+	cases := []struct {
+		name     string
+		packages []releasesapi.PackageSelection
+		want     []int
+		wantErr  string
+	}{
+		{
+			name: "independent packages keep their order",
+			packages: []releasesapi.PackageSelection{
+				testPackage("a", nil, nil),
+				testPackage("b", nil, nil),
+				testPackage("c", nil, nil),
+			},
+			want: []int{0, 1, 2},
+		},
+		{
+			name: "owner before dependent",
+			packages: []releasesapi.PackageSelection{
+				testPackage("a", nil, []string{"foos.example.com"}),
+				testPackage("b", nil, nil),
+				testPackage("c", []string{"foos.example.com"}, nil),
+			},
+			want: []int{1, 2, 0},
+		},
+		{
+			name: "chain",
+			packages: []releasesapi.PackageSelection{
+				testPackage("a", nil, []string{"bars.example.com"}),
+				testPackage("b", []string{"bars.example.com"}, []string{"foos.example.com"}),
+				testPackage("c", []string{"foos.example.com"}, nil),
+			},
+			want: []int{2, 1, 0},
+		},
+		{
+			name: "package without chart",
+			packages: []releasesapi.PackageSelection{
+				{},
+				testPackage("a", nil, nil),
+			},
+			want: []int{0, 1},
+		},
+		{
+			name: "missing owner",
+			packages: []releasesapi.PackageSelection{
+				testPackage("a", nil, []string{"foos.example.com"}),
+			},
+			wantErr: "package ns/a requires foos.example.com which is not owned by any package in the order",
+		},
+		{
+			name: "cycle",
+			packages: []releasesapi.PackageSelection{
+				testPackage("a", []string{"foos.example.com"}, []string{"bars.example.com"}),
+				testPackage("b", []string{"bars.example.com"}, []string{"foos.example.com"}),
+				testPackage("c", nil, nil),
+			},
+			wantErr: "dependency cycle found among packages: ns/a -> ns/b -> ns/a",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			g, err := newPackageGraph(c.packages)
+			var got []int
+			if err == nil {
+				got, err = g.sorted()
+			}
+			if c.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), c.wantErr) {
+					t.Fatalf("got error %v, want %q", err, c.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, c.want) {
+				t.Errorf("got %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestPackageGraphRun(t *testing.T) {
+	// d requires bars owned by b, which requires foos owned by a
+	packages := []releasesapi.PackageSelection{
+		testPackage("a", []string{"foos.example.com"}, nil),
+		testPackage("b", []string{"bars.example.com"}, []string{"foos.example.com"}),
+		testPackage("c", nil, nil),
+		testPackage("d", nil, []string{"bars.example.com"}),
+	}
+
+	cases := []struct {
+		name     string
+		workers  int
+		failFast bool
+		fail     string
+		wantRun  []string
+		wantErrs []string
+	}{
+		{
+			name:    "serial",
+			workers: 1,
+			wantRun: []string{"a", "b", "c", "d"},
+		},
+		{
+			name:    "concurrent",
+			workers: 4,
+			wantRun: []string{"a", "b", "c", "d"},
+		},
+		{
+			name:    "failure skips dependents",
+			workers: 1,
+			fail:    "a",
+			wantRun: []string{"a", "c"},
+			wantErrs: []string{
+				"package ns/a: a failed",
+				"package ns/b: skipped since dependency ns/a failed",
+				"package ns/d: skipped since dependency ns/a failed",
+			},
+		},
+		{
+			name:     "fail fast",
+			workers:  1,
+			failFast: true,
+			fail:     "a",
+			wantRun:  []string{"a"},
+			wantErrs: []string{"package ns/a: a failed"},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			g, err := newPackageGraph(packages)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var m sync.Mutex
+			done := map[string]bool{}
+			var run []string
+			err = g.run(c.workers, c.failFast, func(i int) error {
+				name := packages[i].Chart.ReleaseName
+				m.Lock()
+				defer m.Unlock()
+				for _, j := range g.deps[i] {
+					if !done[packages[j].Chart.ReleaseName] {
+						return fmt.Errorf("%s started before its dependency %s", name, packages[j].Chart.ReleaseName)
+					}
+				}
+				run = append(run, name)
+				if name == c.fail {
+					return fmt.Errorf("%s failed", name)
+				}
+				done[name] = true
+				return nil
+			}, nil)
+
+			slices.Sort(run)
+			if !slices.Equal(run, c.wantRun) {
+				t.Errorf("got run %v, want %v", run, c.wantRun)
+			}
+			if len(c.wantErrs) == 0 {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("got no error, want %v", c.wantErrs)
+			}
+			for _, want := range c.wantErrs {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("got error %v, want it to contain %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestChartDependencies(t *testing.T) {
+	packages := []releasesapi.PackageSelection{
+		testPackage("a", nil, []string{"foos.example.com"}),
+		testPackage("b", nil, nil),
+		{},
+		testPackage("c", []string{"foos.example.com", "bars.example.com"}, nil),
+		testPackage("d", nil, []string{"bars.example.com", "foos.example.com"}),
+	}
+
+	order, deps, err := chartDependencies(packages)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{1, 3, 0, 4}; !slices.Equal(order, want) {
+		t.Errorf("got order %v, want %v", order, want)
+	}
+	want := [][]int{{3}, nil, nil, nil, {3}}
+	for i := range packages {
+		if !slices.Equal(deps[i], want[i]) {
+			t.Errorf("package %d: got deps %v, want %v", i, deps[i], want[i])
+		}
+	}
+}
@@ -18,10 +18,7 @@ package lib
 
 import (
 	"bytes"
-	"context"
 	"fmt"
-	"path"
-	"strings"
 
 	"kubepack.dev/lib-helm/pkg/repo"
 	"kubepack.dev/lib-helm/pkg/values"
@@ -32,14 +29,37 @@ import (
 )
 
 func GenerateHelm3Script(bs *BlobStore, reg repo.IRegistry, order releasesapi.Order, opts ...ScriptOption) ([]ScriptRef, error) {
-	var buf bytes.Buffer
-	var err error
+	var buf, psBuf bytes.Buffer
 
 	var scriptOptions ScriptOptions
 	for _, opt := range opts {
 		opt.Apply(&scriptOptions)
 	}
 
+	bs, err := scriptBlobStore(bs, scriptOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	order, err = applyLock(reg, order, scriptOptions)
+	if err != nil {
+		return nil, err
+	}
+	reg, err = VerifyChartDigests(reg, order)
+	if err != nil {
+		return nil, err
+	}
+
+	digests, err := ChartDigests(order)
+	if err != nil {
+		return nil, err
+	}
+
+	packages, err := SortPackages(order.Spec.Packages)
+	if err != nil {
+		return nil, err
+	}
+
 	if !scriptOptions.OsIndependentScript {
 		_, err = buf.WriteString("#!/usr/bin/env sh\n")
 		if err != nil {
@@ -47,62 +67,97 @@ func GenerateHelm3Script(bs *BlobStore, reg repo.IRegistry, order releasesapi.Or
 		}
 	}
 
-	if !scriptOptions.DisableAppReleaseCRD {
-		f1 := &AppReleaseCRDRegPrinter{
-			W: &buf,
+	scripts := scriptWriters(&buf, &psBuf, scriptOptions)
+	all := allScripts(scripts)
+
+	constraints, err := KubeVersionConstraints(reg, order)
+	if err != nil {
+		return nil, err
+	}
+	if len(constraints) > 0 {
+		for _, sw := range scripts {
+			f0 := &KubeVersionPrinter{
+				Constraints: constraints,
+				Shell:       sw.Shell,
+				W:           sw.W,
+			}
+			err = f0.Do()
+			if err != nil {
+				return nil, err
+			}
 		}
-		err = f1.Do()
+		_, err = fmt.Fprintln(all)
 		if err != nil {
 			return nil, err
 		}
-		_, err = buf.WriteRune('\n')
+	}
+
+	if !scriptOptions.DisableAppReleaseCRD {
+		for _, sw := range manifestWriters(scripts, scriptOptions) {
+			f1 := &AppReleaseCRDRegPrinter{
+				Inline: scriptOptions.SelfContained,
+				Shell:  sw.Shell,
+				W:      sw.W,
+			}
+			err = f1.Do()
+			if err != nil {
+				return nil, err
+			}
+		}
+		_, err = fmt.Fprintln(all)
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	for _, pkg := range order.Spec.Packages {
+	for _, pkg := range packages {
 		if pkg.Chart == nil {
 			continue
 		}
 
-		f3 := &Helm3CommandPrinter{
-			Registry:    reg,
-			ChartRef:    pkg.Chart.ChartRef,
-			Version:     pkg.Chart.Version,
-			ReleaseName: pkg.Chart.ReleaseName,
-			Namespace:   pkg.Chart.Namespace,
-			Values: values.Options{
-				ValuesFile:  pkg.Chart.ValuesFile,
-				ValuesPatch: pkg.Chart.ValuesPatch,
-			},
-			W: &buf,
-		}
-		err = f3.Do()
-		if err != nil {
-			return nil, err
-		}
-
-		f4 := &WaitForPrinter{
-			Name:      pkg.Chart.ReleaseName,
-			Namespace: pkg.Chart.Namespace,
-			WaitFors:  pkg.Chart.WaitFors,
-			W:         &buf,
-		}
-		err = f4.Do()
-		if err != nil {
-			return nil, err
-		}
+		for _, sw := range scripts {
+			f3 := &Helm3CommandPrinter{
+				Registry:    reg,
+				ChartRef:    pkg.Chart.ChartRef,
+				Version:     pkg.Chart.Version,
+				ReleaseName: pkg.Chart.ReleaseName,
+				Namespace:   pkg.Chart.Namespace,
+				Values: values.Options{
+					ValuesFile:  pkg.Chart.ValuesFile,
+					ValuesPatch: pkg.Chart.ValuesPatch,
+				},
+				Shell:  sw.Shell,
+				Digest: digests[releaseKey(pkg.Chart).String()],
+				W:      sw.W,
+			}
+			err = f3.Do()
+			if err != nil {
+				return nil, err
+			}
 
-		if pkg.Chart.Resources != nil && len(pkg.Chart.Resources.Owned) > 0 {
-			f5 := &CRDReadinessPrinter{
-				CRDs: pkg.Chart.Resources.Owned,
-				W:    &buf,
+			f4 := &WaitForPrinter{
+				Name:      pkg.Chart.ReleaseName,
+				Namespace: pkg.Chart.Namespace,
+				WaitFors:  pkg.Chart.WaitFors,
+				Shell:     sw.Shell,
+				W:         sw.W,
 			}
-			err = f5.Do()
+			err = f4.Do()
 			if err != nil {
 				return nil, err
 			}
+
+			if pkg.Chart.Resources != nil && len(pkg.Chart.Resources.Owned) > 0 {
+				f5 := &CRDReadinessPrinter{
+					CRDs:  pkg.Chart.Resources.Owned,
+					Shell: sw.Shell,
+					W:     sw.W,
+				}
+				err = f5.Do()
+				if err != nil {
+					return nil, err
+				}
+			}
 		}
 
 		if !scriptOptions.DisableAppReleaseCRD {
@@ -116,57 +171,31 @@ func GenerateHelm3Script(bs *BlobStore, reg repo.IRegistry, order releasesapi.Or
 				return nil, err
 			}
 
-			f7 := &ApplicationUploader{
-				App:       f6.Result(),
-				UID:       string(order.UID),
-				BucketURL: bs.Bucket,
-				PublicURL: bs.Host,
-				Prefix:    bs.Prefix,
-				W:         &buf,
-			}
-			err = f7.Do()
-			if err != nil {
-				return nil, err
+			for _, sw := range manifestWriters(scripts, scriptOptions) {
+				f7 := &ApplicationUploader{
+					App:       f6.Result(),
+					UID:       string(order.UID),
+					BucketURL: bs.Bucket,
+					PublicURL: bs.Host,
+					Prefix:    bs.Prefix,
+					Inline:    scriptOptions.SelfContained,
+					Shell:     sw.Shell,
+					W:         sw.W,
+				}
+				err = f7.Do()
+				if err != nil {
+					return nil, err
+				}
 			}
 		}
 
-		_, err = buf.WriteRune('\n')
+		_, err = fmt.Fprintln(all)
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	if scriptOptions.OsIndependentScript {
-		return []ScriptRef{
-			{
-				OS:      Neutral,
-				URL:     "",
-				Command: "",
-				Script:  strings.TrimSpace(buf.String()),
-			},
-		}, nil
-	}
-
-	err = bs.WriteFile(context.TODO(), path.Join(string(order.UID), "helm3.sh"), buf.Bytes())
-	if err != nil {
-		return nil, err
-	}
-
-	scriptURL := fmt.Sprintf("%s/%s/helm3.sh", bs.Host, order.UID)
-	return []ScriptRef{
-		{
-			OS:      Linux,
-			URL:     scriptURL,
-			Command: fmt.Sprintf("curl -fsSL %s | bash", scriptURL),
-			Script:  buf.String(),
-		},
-		{
-			OS:      MacOS,
-			URL:     scriptURL,
-			Command: fmt.Sprintf("curl -fsSL %s | bash", scriptURL),
-			Script:  buf.String(),
-		},
-	}, nil
+	return scriptRefs(bs, order, "helm3", buf.String(), psBuf.String(), scriptOptions)
 }
 
 func PrintHelm3CommandFromStructValues(reg repo.IRegistry, opts releasesapi.InstallOptions, baseValuesStruct, modValuesStruct any, useValuesFile bool) (string, []byte, error) {
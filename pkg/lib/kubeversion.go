@@ -0,0 +1,316 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"kubepack.dev/lib-helm/pkg/repo"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/types"
+	releasesapi "x-helm.dev/apimachinery/apis/releases/v1alpha1"
+)
+
+// KubeVersionConstraint is a Kubernetes version constraint of an Order or
+// of the chart of one of its packages.
+type KubeVersionConstraint struct {
+	// Release is empty for the constraint of the Order itself.
+	Release    types.NamespacedName `json:"release,omitempty"`
+	Chart      string               `json:"chart,omitempty"`
+	Version    string               `json:"version,omitempty"`
+	Constraint string               `json:"constraint"`
+}
+
+func (c KubeVersionConstraint) String() string {
+	if c.Chart == "" {
+		return fmt.Sprintf("order requires Kubernetes %s", c.Constraint)
+	}
+	return fmt.Sprintf("package %s (chart %s@%s) requires Kubernetes %s", c.Release, c.Chart, c.Version, c.Constraint)
+}
+
+// KubeVersionError is returned when the cluster version does not satisfy
+// the constraints of an Order.
+type KubeVersionError struct {
+	KubeVersion  string
+	Incompatible []KubeVersionConstraint
+}
+
+func (e *KubeVersionError) Error() string {
+	msgs := make([]string, 0, len(e.Incompatible))
+	for _, c := range e.Incompatible {
+		msgs = append(msgs, c.String())
+	}
+	return fmt.Sprintf("Kubernetes version %s is not supported: %s", e.KubeVersion, strings.Join(msgs, "; "))
+}
+
+// KubeVersionConstraints returns the kubeVersion constraint of the order
+// followed by the kubeVersion of the Chart.yaml of every package.
+func KubeVersionConstraints(reg repo.IRegistry, order releasesapi.Order) ([]KubeVersionConstraint, error) {
+	var out []KubeVersionConstraint
+	if order.Spec.KubeVersion != "" {
+		out = append(out, KubeVersionConstraint{
+			Constraint: order.Spec.KubeVersion,
+		})
+	}
+	for _, pkg := range order.Spec.Packages {
+		if pkg.Chart == nil {
+			continue
+		}
+		chrt, err := reg.GetChart(releasesapi.ChartSourceRef{
+			Name:      pkg.Chart.Name,
+			Version:   pkg.Chart.Version,
+			SourceRef: pkg.Chart.SourceRef,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if chrt.Metadata.KubeVersion == "" {
+			continue
+		}
+		out = append(out, KubeVersionConstraint{
+			Release:    releaseKey(pkg.Chart),
+			Chart:      pkg.Chart.Name,
+			Version:    pkg.Chart.Version,
+			Constraint: chrt.Metadata.KubeVersion,
+		})
+	}
+	return out, nil
+}
+
+// CheckKubeVersion checks kubeVersion against the constraints of the order
+// and its charts. It returns a *KubeVersionError listing every constraint
+// that is not satisfied.
+func CheckKubeVersion(reg repo.IRegistry, order releasesapi.Order, kubeVersion string) error {
+	v, err := semver.NewVersion(kubeVersion)
+	if err != nil {
+		return err
+	}
+
+	constraints, err := KubeVersionConstraints(reg, order)
+	if err != nil {
+		return err
+	}
+
+	var incompatible []KubeVersionConstraint
+	for _, c := range constraints {
+		ok, err := kubeVersionAllowed(c, v)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			incompatible = append(incompatible, c)
+		}
+	}
+	if len(incompatible) > 0 {
+		return &KubeVersionError{
+			KubeVersion:  kubeVersion,
+			Incompatible: incompatible,
+		}
+	}
+	return nil
+}
+
+func kubeVersionAllowed(c KubeVersionConstraint, v *semver.Version) (bool, error) {
+	cs, err := semver.NewConstraint(c.Constraint)
+	if err != nil {
+		return false, errors.Wrapf(err, "invalid kubeVersion constraint %q", c.Constraint)
+	}
+	return cs.Check(v), nil
+}
+
+// Kubernetes versions are encoded as major*1000000 + minor*1000 + patch in
+// the generated preflight check.
+func encodeKubeVersion(v *semver.Version) int {
+	return int(v.Major())*1000000 + int(v.Minor())*1000 + int(v.Patch())
+}
+
+var constraintVersionRegex = regexp.MustCompile(`(\d+|[xX*])(?:\.(\d+|[xX*]))?(?:\.(\d+|[xX*]))?`)
+
+// kubeVersionBounds returns the versions at which a constraint may start or
+// stop being satisfied: every version named by the constraint along with
+// its next patch, minor and major versions. Wildcards count as 0.
+func kubeVersionBounds(constraint string) []*semver.Version {
+	seen := map[string]bool{}
+	var out []*semver.Version
+	add := func(major, minor, patch uint64) {
+		if minor > 999 || patch > 999 {
+			// can't be encoded, and no Kubernetes version gets there
+			return
+		}
+		v := semver.New(major, minor, patch, "", "")
+		if !seen[v.String()] {
+			seen[v.String()] = true
+			out = append(out, v)
+		}
+	}
+
+	add(0, 0, 0)
+	for _, m := range constraintVersionRegex.FindAllStringSubmatch(constraint, -1) {
+		var parts [3]uint64
+		for i := range parts {
+			parts[i], _ = strconv.ParseUint(m[i+1], 10, 64)
+		}
+		major, minor, patch := parts[0], parts[1], parts[2]
+		add(major, minor, patch)
+		add(major, minor, patch+1)
+		add(major, minor, 0)
+		add(major, minor+1, 0)
+		add(major, 0, 0)
+		add(major+1, 0, 0)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].LessThan(out[j])
+	})
+	return out
+}
+
+// kubeVersionRanges returns the ranges of encoded versions allowed by a
+// constraint. A range with a negative bound is open on that side. Between
+// two consecutive bounds of the constraint, every version satisfies it the
+// same way the lower bound does.
+func kubeVersionRanges(cs *semver.Constraints) [][2]int {
+	bounds := kubeVersionBounds(cs.String())
+
+	var out [][2]int
+	for i, v := range bounds {
+		if !cs.Check(v) {
+			continue
+		}
+		lo, hi := encodeKubeVersion(v), -1
+		if i+1 < len(bounds) {
+			hi = encodeKubeVersion(bounds[i+1]) - 1
+		}
+		if i == 0 {
+			lo = -1
+		}
+		if n := len(out); n > 0 && out[n-1][1] == lo-1 {
+			out[n-1][1] = hi
+			continue
+		}
+		out = append(out, [2]int{lo, hi})
+	}
+	return out
+}
+
+// KubeVersionPrinter prints a shell preflight check that stops the script
+// if the cluster version does not satisfy the constraints.
+type KubeVersionPrinter struct {
+	Constraints []KubeVersionConstraint
+	Shell       Shell
+	W           io.Writer
+}
+
+func (x *KubeVersionPrinter) Do() error {
+	if len(x.Constraints) == 0 {
+		return nil
+	}
+
+	ps := x.Shell == ShellPowerShell
+	var err error
+	if ps {
+		_, err = fmt.Fprintln(x.W, `$kube_version = 0`)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(x.W, `if ((kubectl get --raw /version | Out-String | ConvertFrom-Json).gitVersion -match '^v?(\d+)\.(\d+)\.(\d+)') { $kube_version = [int]$Matches[1] * 1000000 + [int]$Matches[2] * 1000 + [int]$Matches[3] }`)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(x.W, "$kube_version_ok = $true")
+	} else {
+		_, err = fmt.Fprintln(x.W, `kube_version=$(kubectl get --raw /version | sed -n 's/.*"gitVersion": *"v\{0,1\}\([0-9]*\)\.\([0-9]*\)\.\([0-9]*\).*/\1 \2 \3/p' | awk '{ print $1 * 1000000 + $2 * 1000 + $3 }')`)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(x.W, "kube_version_ok=1")
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, c := range x.Constraints {
+		cs, err := semver.NewConstraint(c.Constraint)
+		if err != nil {
+			return errors.Wrapf(err, "invalid kubeVersion constraint %q", c.Constraint)
+		}
+		ranges := kubeVersionRanges(cs)
+
+		var checks []string
+		for _, r := range ranges {
+			var conds []string
+			if r[0] >= 0 {
+				if ps {
+					conds = append(conds, fmt.Sprintf(`($kube_version -ge %d)`, r[0]))
+				} else {
+					conds = append(conds, fmt.Sprintf(`[ "$kube_version" -ge %d ]`, r[0]))
+				}
+			}
+			if r[1] >= 0 {
+				if ps {
+					conds = append(conds, fmt.Sprintf(`($kube_version -le %d)`, r[1]))
+				} else {
+					conds = append(conds, fmt.Sprintf(`[ "$kube_version" -le %d ]`, r[1]))
+				}
+			}
+			if len(conds) == 0 {
+				// every version is allowed
+				checks = nil
+				break
+			}
+			if ps {
+				checks = append(checks, "("+strings.Join(conds, " -and ")+")")
+			} else {
+				checks = append(checks, "{ "+strings.Join(conds, " && ")+"; }")
+			}
+		}
+		if len(ranges) > 0 && len(checks) == 0 {
+			continue
+		}
+
+		if ps {
+			cond := "$false"
+			if len(checks) > 0 {
+				cond = strings.Join(checks, " -or ")
+			}
+			_, err = fmt.Fprintf(x.W, "if (-not (%s)) {\n  [Console]::Error.WriteLine(%s)\n  $kube_version_ok = $false\n}\n", cond, psQuote(c.String()))
+		} else {
+			cond := "false"
+			if len(checks) > 0 {
+				cond = strings.Join(checks, " || ")
+			}
+			_, err = fmt.Fprintf(x.W, "if ! { %s; }; then\n  echo %s >&2\n  kube_version_ok=0\nfi\n", cond, shQuote(c.String()))
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if ps {
+		// exit would close the session running the script using iex
+		_, err = fmt.Fprintln(x.W, `if (-not $kube_version_ok) { throw 'unsupported Kubernetes version' }`)
+		return err
+	}
+	_, err = fmt.Fprintln(x.W, `[ "$kube_version_ok" -eq 1 ] || exit 1`)
+	return err
+}
@@ -0,0 +1,94 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/Masterminds/semver/v3"
+)
+
+func TestKubeVersionRanges(t *testing.T) {
+	constraints := []string{
+		">= 1.20.0",
+		">=1.19.0-0",
+		"< 1.25",
+		"> 1.21",
+		"> 1.21.3",
+		"<= 1.22",
+		"<= 1.22.4",
+		">= 1.18, < 1.30",
+		"1.20.x",
+		"~1.24.2",
+		"^1.20",
+		"!= 1.23.1",
+		"!= 1.23.x",
+		"1.19 - 1.21",
+		">= 1.16 < 1.20 || >= 1.22.3",
+		"*",
+		">= 2.0.0",
+		"= 1.120.0",
+	}
+
+	for _, c := range constraints {
+		t.Run(c, func(t *testing.T) {
+			cs, err := semver.NewConstraint(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ranges := kubeVersionRanges(cs)
+			for major := uint64(0); major <= 2; major++ {
+				for minor := uint64(0); minor <= 130; minor++ {
+					for patch := uint64(0); patch <= 12; patch++ {
+						v := semver.New(major, minor, patch, "", "")
+						if got, want := inKubeVersionRanges(ranges, encodeKubeVersion(v)), cs.Check(v); got != want {
+							t.Fatalf("%s: got %v, want %v, ranges %v", v, got, want, ranges)
+						}
+					}
+				}
+			}
+		})
+	}
+}
+
+func inKubeVersionRanges(ranges [][2]int, v int) bool {
+	for _, r := range ranges {
+		if (r[0] < 0 || v >= r[0]) && (r[1] < 0 || v <= r[1]) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestKubeVersionPrinterQuotesMessage(t *testing.T) {
+	var buf bytes.Buffer
+	x := &KubeVersionPrinter{
+		Constraints: []KubeVersionConstraint{
+			{Chart: "it's", Version: "$(v)", Constraint: ">= 1.20"},
+		},
+		W: &buf,
+	}
+	if err := x.Do(); err != nil {
+		t.Fatal(err)
+	}
+	want := `echo 'package / (chart it'\''s@$(v)) requires Kubernetes >= 1.20' >&2`
+	if !strings.Contains(buf.String(), want) {
+		t.Errorf("got\n%s\nwant a line with\n%s", buf.String(), want)
+	}
+}
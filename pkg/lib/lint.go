@@ -0,0 +1,244 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"kubepack.dev/lib-helm/pkg/repo"
+	"kubepack.dev/lib-helm/pkg/values"
+
+	jsonpatch "github.com/evanphx/json-patch/v5"
+	"helm.sh/helm/v3/pkg/chart"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"kmodules.xyz/client-go/tools/parser"
+	releasesapi "x-helm.dev/apimachinery/apis/releases/v1alpha1"
+)
+
+// LintBundle checks a bundle chart. It renders the Bundle of the chart and
+// returns every problem found in its packages, such as charts, versions or
+// bundles missing from the registry, license key paths that don't exist in
+// the chart values, waitFors that don't match any rendered object, owned
+// CRDs that the chart does not ship and declared OneOf defaults that are not
+// one of their bundles. Nested bundles, including every OneOf alternative,
+// are linted too and their problems are reported below the path of the
+// bundle package.
+func LintBundle(reg repo.IRegistry, chrt *chart.Chart, opts ...ResolveOption) field.ErrorList {
+	r := newBundleResolver(reg, opts)
+	_, bundle, err := getBundle(chrt, r.opts.Values)
+	if err != nil {
+		return field.ErrorList{field.Invalid(field.NewPath("metadata", "name"), chrt.Name(), err.Error())}
+	}
+	// the linted chart is the top of the chain, so that the nesting depth
+	// matches the one used to create a BundleView
+	r.chain = append(r.chain, releasesapi.ChartSourceRef{
+		Name:    chrt.Name(),
+		Version: chrt.Metadata.Version,
+	})
+	return lintBundle(r, bundle, field.NewPath("spec", "packages"))
+}
+
+func lintBundle(r *bundleResolver, bundle *releasesapi.Bundle, fldPath *field.Path) field.ErrorList {
+	var errs field.ErrorList
+	for i, pkg := range bundle.Spec.Packages {
+		idxPath := fldPath.Index(i)
+		if pkg.Chart != nil {
+			errs = append(errs, lintChartOption(r.reg, bundle, pkg.Chart, idxPath.Child("chart"))...)
+		} else if pkg.Bundle != nil {
+			errs = append(errs, lintBundleOption(r, pkg.Bundle, idxPath.Child("bundle"))...)
+		} else if pkg.OneOf != nil {
+			if len(pkg.OneOf.Bundles) == 0 {
+				errs = append(errs, field.Required(idxPath.Child("oneOf", "bundles"), "must list at least one bundle"))
+			}
+			names := make([]string, 0, len(pkg.OneOf.Bundles))
+			for _, bo := range pkg.OneOf.Bundles {
+				names = append(names, bo.Name)
+			}
+			if _, err := defaultOneOf(bundle, pkg.OneOf.Description, names); err != nil {
+				errs = append(errs, field.Invalid(idxPath.Child("oneOf", "description"), pkg.OneOf.Description, err.Error()))
+			}
+			for j, bo := range pkg.OneOf.Bundles {
+				errs = append(errs, lintBundleOption(r, bo, idxPath.Child("oneOf", "bundles").Index(j))...)
+			}
+		}
+	}
+	return errs
+}
+
+func lintBundleOption(r *bundleResolver, in *releasesapi.BundleOption, fldPath *field.Path) field.ErrorList {
+	_, bundle, err := r.enter(in)
+	if err != nil {
+		return field.ErrorList{field.Invalid(fldPath.Child("version"), in.Version, fmt.Sprintf("failed to find bundle %s: %v", in.Name, err))}
+	}
+	defer r.leave()
+
+	return lintBundle(r, bundle, fldPath.Child("spec", "packages"))
+}
+
+func lintChartOption(reg repo.IRegistry, bundle *releasesapi.Bundle, in *releasesapi.ChartOption, fldPath *field.Path) field.ErrorList {
+	var errs field.ErrorList
+
+	if len(in.Versions) == 0 {
+		errs = append(errs, field.Required(fldPath.Child("versions"), "must list at least one version"))
+	}
+	selected := 0
+	for _, v := range in.Versions {
+		if v.Selected {
+			selected++
+		}
+	}
+	if selected > 1 && !in.MultiSelect {
+		errs = append(errs, field.Invalid(fldPath.Child("versions"), selected, "only one version can be selected unless multiSelect is set"))
+	}
+
+	for i, v := range in.Versions {
+		verPath := fldPath.Child("versions").Index(i)
+
+		c, err := reg.GetChart(releasesapi.ChartSourceRef{
+			Name:      in.Name,
+			Version:   v.Version,
+			SourceRef: in.SourceRef,
+		})
+		if err != nil {
+			errs = append(errs, field.Invalid(verPath.Child("version"), v.Version, fmt.Sprintf("failed to find chart %s: %v", in.Name, err)))
+			continue
+		}
+
+		opts := values.Options{
+			ValuesFile:  v.ValuesFile,
+			ValuesPatch: v.ValuesPatch,
+		}
+		vals, err := opts.MergeValues(c.Chart)
+		if err != nil {
+			var patch string
+			if v.ValuesPatch != nil {
+				patch = string(v.ValuesPatch.Raw)
+			}
+			errs = append(errs, field.Invalid(verPath.Child("valuesPatch"), patch, err.Error()))
+			continue
+		}
+
+		if v.LicenseKeyPath != "" {
+			if err := checkValuesPath(vals, v.LicenseKeyPath); err != nil {
+				errs = append(errs, field.Invalid(verPath.Child("licenseKeyPath"), v.LicenseKeyPath, err.Error()))
+			}
+		}
+
+		if len(v.WaitFors) > 0 {
+			errs = append(errs, validateWaitFors(reg, &releasesapi.ChartSelection{
+				ChartRef:    in.ChartRef,
+				Version:     v.Version,
+				ReleaseName: in.Name,
+				Namespace:   XorY(in.Namespace, bundle.Spec.Namespace),
+				ValuesFile:  v.ValuesFile,
+				ValuesPatch: v.ValuesPatch,
+				WaitFors:    v.WaitFors,
+			}, verPath)...)
+		}
+
+		if v.Resources != nil && len(v.Resources.Owned) > 0 {
+			errs = append(errs, lintOwnedCRDs(c.Chart, v.Resources.Owned, verPath.Child("resources", "owned"))...)
+		}
+	}
+	return errs
+}
+
+// checkValuesPath checks that path is a JSON pointer to an existing field of
+// the values, so that the license key can be set using a replace operation.
+func checkValuesPath(vals map[string]any, path string) error {
+	doc, err := json.Marshal(vals)
+	if err != nil {
+		return err
+	}
+	patch, err := json.Marshal([]map[string]any{
+		{"op": "replace", "path": path, "value": ""},
+	})
+	if err != nil {
+		return err
+	}
+	p, err := jsonpatch.DecodePatch(patch)
+	if err != nil {
+		return err
+	}
+	_, err = p.Apply(doc)
+	if err != nil {
+		return fmt.Errorf("does not point to a field of the chart values: %v", err)
+	}
+	return nil
+}
+
+// lintOwnedCRDs checks that the chart ships a CRD in its crds/ directory for
+// every owned resource.
+func lintOwnedCRDs(chrt *chart.Chart, owned []metav1.GroupVersionResource, fldPath *field.Path) field.ErrorList {
+	resources := sets.New[schema.GroupResource]()
+	versions := sets.New[schema.GroupVersionResource]()
+	for _, crd := range chrt.CRDObjects() {
+		err := parser.ProcessResources(crd.File.Data, func(ri parser.ResourceInfo) error {
+			if ri.Object.GroupVersionKind().GroupKind() != crdGroupKind {
+				return nil
+			}
+			gr := crdGroupResource(ri.Object)
+			resources.Insert(gr)
+			for _, v := range crdVersions(ri.Object) {
+				versions.Insert(gr.WithVersion(v))
+			}
+			return nil
+		})
+		if err != nil {
+			return field.ErrorList{field.Invalid(fldPath, crd.Name, fmt.Sprintf("failed to parse CRD file: %v", err))}
+		}
+	}
+
+	var errs field.ErrorList
+	for i, gvr := range owned {
+		gr := schema.GroupResource{Group: gvr.Group, Resource: gvr.Resource}
+		if !resources.Has(gr) {
+			errs = append(errs, field.NotFound(fldPath.Index(i), gr.String()))
+		} else if gvr.Version != "" && !versions.Has(gr.WithVersion(gvr.Version)) {
+			errs = append(errs, field.NotFound(fldPath.Index(i).Child("version"), gvr.Version))
+		}
+	}
+	return errs
+}
+
+func crdGroupResource(u *unstructured.Unstructured) schema.GroupResource {
+	group, _, _ := unstructured.NestedString(u.Object, "spec", "group")
+	plural, _, _ := unstructured.NestedString(u.Object, "spec", "names", "plural")
+	return schema.GroupResource{Group: group, Resource: plural}
+}
+
+func crdVersions(u *unstructured.Unstructured) []string {
+	var out []string
+	// apiextensions.k8s.io/v1beta1 CRDs may only set spec.version
+	if v, ok, _ := unstructured.NestedString(u.Object, "spec", "version"); ok && v != "" {
+		out = append(out, v)
+	}
+	versions, _, _ := unstructured.NestedSlice(u.Object, "spec", "versions")
+	for _, v := range versions {
+		if m, ok := v.(map[string]any); ok {
+			if name, ok := m["name"].(string); ok {
+				out = append(out, name)
+			}
+		}
+	}
+	return out
+}
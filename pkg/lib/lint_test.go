@@ -0,0 +1,168 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// The community bundles of testdata/charts are written in the
+// kubepack.com/v1alpha1 format of the old bundle-generator, which lib does not
+// read, so each is reported as not being a bundle chart.
+func TestLintCommunityBundles(t *testing.T) {
+	reg, err := NewArchiveRegistry(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bundles, err := filepath.Glob("../../testdata/charts/*-community")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bundles) == 0 {
+		t.Fatal("no community bundles found")
+	}
+	for _, name := range bundles {
+		t.Run(filepath.Base(name), func(t *testing.T) {
+			chrt, err := loader.LoadDir(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := field.ErrorList{
+				field.Invalid(field.NewPath("metadata", "name"), chrt.Name(),
+					`bundles.releases.x-helm.dev "bundle" not found`),
+			}
+			if got := LintBundle(reg, chrt); !reflect.DeepEqual(got, want) {
+				t.Errorf("got findings %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestLintBundleNested(t *testing.T) {
+	dir := t.TempDir()
+	writeBundleChart(t, dir, "outer", "0.1.0", nestedBundleSpec("inner"))
+	writeBundleChart(t, dir, "inner", "0.1.0", `  namespace: demo
+  packages:
+  - chart:
+      name: missing
+      sourceRef: {kind: Legacy, name: "`+ArchiveRepositoryURL+`"}
+      required: true
+      versions:
+      - version: 0.1.0
+      - version: 0.2.0
+`)
+	writeBundleChart(t, dir, "self", "0.1.0", nestedBundleSpec("self"))
+	writeBundleChart(t, dir, "l0", "0.1.0", nestedBundleSpec("l1"))
+	writeBundleChart(t, dir, "l1", "0.1.0", nestedBundleSpec("l2"))
+	writeBundleChart(t, dir, "l2", "0.1.0", nestedBundleSpec("l3"))
+	writeBundleChart(t, dir, "l3", "0.1.0", nestedBundleSpec())
+	reg, err := NewArchiveRegistry(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type finding struct {
+		Field  string
+		Detail string
+	}
+	missing := "spec.packages[0].bundle.spec.packages[0].chart.versions"
+	cases := []struct {
+		bundle  string
+		version string
+		opts    []ResolveOption
+		want    []finding
+	}{
+		{
+			// problems of nested bundles are reported below the bundle package
+			bundle:  "outer",
+			version: "0.1.0",
+			want: []finding{
+				{missing + "[0].version", "failed to find chart missing: no chart name found"},
+				{missing + "[1].version", "failed to find chart missing: no chart name found"},
+			},
+		},
+		{
+			bundle:  "self",
+			version: "0.1.0",
+			want: []finding{
+				{
+					"spec.packages[0].bundle.spec.packages[0].bundle.version",
+					"failed to find bundle self: bundle cycle found: self@0.1.0 -> self@0.1.0",
+				},
+			},
+		},
+		{
+			bundle:  "l0",
+			version: "0.1.0",
+			opts:    []ResolveOption{WithMaxBundleDepth(3)},
+		},
+		{
+			bundle:  "l0",
+			version: "0.1.0",
+			opts:    []ResolveOption{WithMaxBundleDepth(2)},
+			want: []finding{
+				{
+					"spec.packages[0].bundle.spec.packages[0].bundle.spec.packages[0].bundle.version",
+					"failed to find bundle l3: bundles are nested deeper than 2 levels: l0@0.1.0 -> l1@0.1.0 -> l2@0.1.0 -> l3@0.1.0",
+				},
+			},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.bundle, func(t *testing.T) {
+			chrt, err := reg.GetChart(archiveChartRef(c.bundle, c.version))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []finding
+			for _, e := range LintBundle(reg, chrt.Chart, c.opts...) {
+				got = append(got, finding{Field: e.Field, Detail: e.Detail})
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("got findings %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestLintBundleOneOfDefault(t *testing.T) {
+	dir := t.TempDir()
+	writeOneOfBundles(t, dir, map[string]string{DefaultOneOfAnnotation: `{"database":"redis"}`})
+	reg, err := NewArchiveRegistry(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chrt, err := reg.GetChart(archiveChartRef("plan", "0.1.0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errs := LintBundle(reg, chrt.Chart)
+	if len(errs) != 1 || errs[0].Field != "spec.packages[0].oneOf.description" {
+		t.Fatalf("got findings %v, want one for the default of the OneOf", errs)
+	}
+	want := "default bundle redis of OneOf \"database\" in bundle plan is not one of its bundles pg, my"
+	if errs[0].Detail != want {
+		t.Errorf("got %q, want %q", errs[0].Detail, want)
+	}
+}
@@ -0,0 +1,268 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"kubepack.dev/lib-helm/pkg/getter"
+	"kubepack.dev/lib-helm/pkg/repo"
+
+	"github.com/Masterminds/semver/v3"
+	"helm.sh/helm/v3/pkg/registry"
+	releasesapi "x-helm.dev/apimachinery/apis/releases/v1alpha1"
+)
+
+// LockedChart pins a chart or bundle to the exact version and archive
+// digest found in the repository index.
+type LockedChart struct {
+	releasesapi.ChartSourceRef `json:",inline"`
+	// Constraint is the version range the chart was resolved from, if any.
+	Constraint string `json:"constraint,omitempty"`
+	Digest     string `json:"digest,omitempty"`
+}
+
+// OrderLock records how the versions of the bundles and charts of an Order
+// were resolved, so that the same charts can be installed again later.
+type OrderLock struct {
+	Bundles []LockedChart `json:"bundles,omitempty"`
+	Charts  []LockedChart `json:"charts,omitempty"`
+
+	m sync.Mutex
+}
+
+func (l *OrderLock) addBundle(c LockedChart) {
+	l.m.Lock()
+	l.Bundles = addLockedChart(l.Bundles, c)
+	l.m.Unlock()
+}
+
+func (l *OrderLock) addChart(c LockedChart) {
+	l.m.Lock()
+	l.Charts = addLockedChart(l.Charts, c)
+	l.m.Unlock()
+}
+
+func addLockedChart(list []LockedChart, c LockedChart) []LockedChart {
+	for _, e := range list {
+		if e.ChartSourceRef == c.ChartSourceRef {
+			return list
+		}
+	}
+	return append(list, c)
+}
+
+func findLockedChart(list []LockedChart, name string, ref releasesapi.ChartSourceRef) (*LockedChart, bool) {
+	for i, e := range list {
+		if e.Name != name || e.SourceRef != ref.SourceRef {
+			continue
+		}
+		if e.Version == ref.Version || (e.Constraint != "" && e.Constraint == ref.Version) || versionMatches(ref.Version, e.Version) {
+			return &list[i], true
+		}
+	}
+	return nil, false
+}
+
+// Apply pins the version of every chart and bundle of the order to the
+// version recorded in the lock.
+func (l *OrderLock) Apply(order *releasesapi.Order) error {
+	var missing []string
+	for _, pkg := range order.Spec.Packages {
+		if pkg.Chart == nil {
+			continue
+		}
+		c, ok := findLockedChart(l.Charts, pkg.Chart.Name, releasesapi.ChartSourceRef{
+			Name:      pkg.Chart.Name,
+			Version:   pkg.Chart.Version,
+			SourceRef: pkg.Chart.SourceRef,
+		})
+		if !ok {
+			missing = append(missing, pkg.Chart.Name+"@"+pkg.Chart.Version)
+			continue
+		}
+		pkg.Chart.Version = c.Version
+
+		if pkg.Chart.Bundle != nil {
+			if b, ok := findLockedChart(l.Bundles, pkg.Chart.Bundle.Name, *pkg.Chart.Bundle); ok {
+				pkg.Chart.Bundle.Version = b.Version
+			}
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("charts not found in lock: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// Verify checks that the repository index still lists every locked chart
+// with the same digest.
+func (l *OrderLock) Verify(reg repo.IRegistry) error {
+	var changed []string
+	for _, c := range l.Charts {
+		if c.Digest == "" {
+			continue
+		}
+		chrt, err := reg.GetChart(c.ChartSourceRef)
+		if err != nil {
+			return err
+		}
+		if chrt.Digest != "" && chrt.Digest != c.Digest {
+			changed = append(changed, fmt.Sprintf("%s@%s (locked %s, found %s)", c.Name, c.Version, c.Digest, chrt.Digest))
+		}
+	}
+	if len(changed) > 0 {
+		return fmt.Errorf("charts changed since they were locked: %s", strings.Join(changed, ", "))
+	}
+	return nil
+}
+
+// applyLock returns a copy of the order pinned to the lock in opts, if any.
+func applyLock(reg repo.IRegistry, order releasesapi.Order, opts ScriptOptions) (releasesapi.Order, error) {
+	if opts.Lock == nil {
+		return order, nil
+	}
+	out := order.DeepCopy()
+	err := opts.Lock.Apply(out)
+	if err != nil {
+		return order, err
+	}
+	err = opts.Lock.Verify(reg)
+	if err != nil {
+		return order, err
+	}
+	return *out, nil
+}
+
+// isExactVersion reports whether v is a complete semantic version instead
+// of a version range.
+func isExactVersion(v string) bool {
+	_, err := semver.StrictNewVersion(strings.TrimPrefix(v, "v"))
+	return err == nil
+}
+
+// versionMatches reports whether version satisfies the constraint. An empty
+// constraint matches any version.
+func versionMatches(constraint, version string) bool {
+	v, err := semver.NewVersion(version)
+	if err != nil {
+		return false
+	}
+	if constraint == "" {
+		// "*" does not match prereleases
+		return true
+	}
+	c, err := semver.NewConstraint(constraint)
+	if err != nil {
+		return false
+	}
+	return c.Check(v)
+}
+
+// resolveChart loads the chart referenced by ref. If ref.Version is a range,
+// the registry resolves it against the repository index and the exact
+// version is checked against the range. The chart is recorded in the lock.
+func (r *bundleResolver) resolveChart(ref releasesapi.ChartSourceRef) (*repo.ChartExtended, error) {
+	chrt, err := r.reg.GetChart(ref)
+	if err != nil {
+		return nil, err
+	}
+	locked := LockedChart{
+		ChartSourceRef: ref,
+		Digest:         chrt.Digest,
+	}
+	if !isExactVersion(ref.Version) {
+		if !versionMatches(ref.Version, chrt.Metadata.Version) {
+			return nil, fmt.Errorf("chart %s@%s does not satisfy version %q", ref.Name, chrt.Metadata.Version, ref.Version)
+		}
+		locked.Constraint = ref.Version
+		locked.Version = chrt.Metadata.Version
+	}
+	r.lock.addChart(locked)
+	return chrt, nil
+}
+
+// resolveVersion returns the exact version of the chart referenced by ref.
+// Exact versions are returned as is. Ranges are resolved using the
+// repository index, if the registry has one, so that no chart archive is
+// downloaded. The resolved range is recorded in the lock.
+func (r *bundleResolver) resolveVersion(ref releasesapi.ChartSourceRef) (string, error) {
+	if isExactVersion(ref.Version) {
+		return ref.Version, nil
+	}
+
+	cv, found, err := findChartVersion(r.reg, ref)
+	if err != nil {
+		return "", err
+	}
+	if !found {
+		chrt, err := r.resolveChart(ref)
+		if err != nil {
+			return "", err
+		}
+		return chrt.Metadata.Version, nil
+	}
+	if !versionMatches(ref.Version, cv.Version) {
+		return "", fmt.Errorf("chart %s@%s does not satisfy version %q", ref.Name, cv.Version, ref.Version)
+	}
+	r.lock.addChart(LockedChart{
+		ChartSourceRef: releasesapi.ChartSourceRef{
+			Name:      ref.Name,
+			Version:   cv.Version,
+			SourceRef: ref.SourceRef,
+		},
+		Constraint: ref.Version,
+		Digest:     cv.Digest,
+	})
+	return cv.Version, nil
+}
+
+// findChartVersion looks up a chart in the repository index, without
+// downloading the chart archive. It reports false if the registry can't
+// look up the index of the chart source, eg, for OCI registries.
+func findChartVersion(reg repo.IRegistry, ref releasesapi.ChartSourceRef) (*repo.ChartVersion, bool, error) {
+	switch r := reg.(type) {
+	case *ArchiveRegistry:
+		cv, err := r.index.Get(ref.Name, ref.Version)
+		return cv, err == nil, err
+	case *repo.Registry:
+		repoURL := ref.SourceRef.Name
+		switch ref.SourceRef.Kind {
+		case releasesapi.SourceKindLegacy:
+		case releasesapi.SourceKindHelmRepository:
+			helmRepo, err := r.GetHelmRepository(ref)
+			if err != nil {
+				return nil, false, err
+			}
+			repoURL = helmRepo.Spec.URL
+		default:
+			return nil, false, nil
+		}
+		if registry.IsOCI(repoURL) {
+			return nil, false, nil
+		}
+		rc, _, err := r.Get(repoURL)
+		if err != nil {
+			return nil, false, err
+		}
+		cv, err := repo.FindChartInAuthRepoURL(rc, ref.Name, ref.Version, getter.All())
+		return cv, err == nil, err
+	}
+	return nil, false, nil
+}
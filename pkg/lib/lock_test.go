@@ -0,0 +1,239 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	releasesapi "x-helm.dev/apimachinery/apis/releases/v1alpha1"
+)
+
+func TestIsExactVersion(t *testing.T) {
+	cases := map[string]bool{
+		"0.1.0":         true,
+		"v0.13.0-rc.0":  true,
+		"v0.9.0-rc.6":   true,
+		"5.6.4":         true,
+		"1.0.0+build.1": true,
+		"5.6":           false,
+		"7":             false,
+		"~0.14":         false,
+		">= 0.1.0":      false,
+		"0.1.x":         false,
+		"":              false,
+	}
+	for v, want := range cases {
+		if got := isExactVersion(v); got != want {
+			t.Errorf("isExactVersion(%q): got %v, want %v", v, got, want)
+		}
+	}
+}
+
+func TestVersionMatches(t *testing.T) {
+	cases := []struct {
+		constraint string
+		version    string
+		want       bool
+	}{
+		{"", "v0.13.0-rc.0", true},
+		{"", "5.6", true},
+		{"5.6", "5.6", true},
+		{"5.6", "5.6.4", true},
+		{"5.6", "6.2", false},
+		{"~0.14", "v0.14.3", true},
+		{"~0.14", "v0.15.0", false},
+		{">= 0.13.0-0", "v0.13.0-rc.0", true},
+		{">= 0.13.0", "v0.13.0-rc.0", false},
+		{"^0.9.0-0", "v0.9.0-rc.6", true},
+		{"v0.13.0-rc.0", "v0.13.0-rc.0", true},
+		{"not a range", "0.1.0", false},
+		{"*", "not a version", false},
+	}
+	for _, c := range cases {
+		if got := versionMatches(c.constraint, c.version); got != c.want {
+			t.Errorf("versionMatches(%q, %q): got %v, want %v", c.constraint, c.version, got, c.want)
+		}
+	}
+}
+
+func writeLockCharts(t *testing.T, dir string) {
+	t.Helper()
+	for _, v := range []string{"5.6", "5.6.4", "6.2", "6.2.4"} {
+		writeBundleChart(t, dir, "es", v, nestedBundleSpec())
+	}
+	for _, v := range []string{"v0.12.0", "v0.13.0-rc.0"} {
+		writeBundleChart(t, dir, "kubedb", v, nestedBundleSpec())
+	}
+}
+
+func TestResolveVersion(t *testing.T) {
+	dir := t.TempDir()
+	writeLockCharts(t, dir)
+	reg, err := NewArchiveRegistry(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name    string
+		version string
+		want    string
+		wantErr string
+		// locked reports whether the version is recorded in the lock
+		locked bool
+	}{
+		// the index lists the non-strict version as is
+		{name: "es", version: "5.6", want: "5.6", locked: true},
+		{name: "es", version: "5.6.4", want: "5.6.4"},
+		{name: "es", version: "~6", want: "6.2.4", locked: true},
+		{name: "es", version: ">= 5.6.1, < 6", want: "5.6.4", locked: true},
+		{name: "kubedb", version: "v0.13.0-rc.0", want: "v0.13.0-rc.0"},
+		{name: "kubedb", version: ">= 0.13.0-0", want: "v0.13.0-rc.0", locked: true},
+		{name: "kubedb", version: "~0.12", want: "v0.12.0", locked: true},
+		{name: "es", version: "~7", wantErr: "no chart version found"},
+		{name: "kubedb", version: ">= 0.13.0", wantErr: "no chart version found"},
+	}
+	for _, c := range cases {
+		t.Run(c.name+"@"+c.version, func(t *testing.T) {
+			r := newBundleResolver(reg, nil)
+			got, err := r.resolveVersion(archiveChartRef(c.name, c.version))
+			if c.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), c.wantErr) {
+					t.Fatalf("got error %v, want %q", err, c.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != c.want {
+				t.Errorf("got version %s, want %s", got, c.want)
+			}
+
+			if !c.locked {
+				if len(r.lock.Charts) != 0 {
+					t.Errorf("got locked charts %v, want none", r.lock.Charts)
+				}
+				return
+			}
+			if len(r.lock.Charts) != 1 {
+				t.Fatalf("got locked charts %v, want one", r.lock.Charts)
+			}
+			locked := r.lock.Charts[0]
+			if locked.Version != c.want || locked.Constraint != c.version || locked.Digest == "" {
+				t.Errorf("got locked chart %+v, want version %s, constraint %s and a digest", locked, c.want, c.version)
+			}
+		})
+	}
+}
+
+func TestOrderLockRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	writeLockCharts(t, dir)
+	writeBundleChart(t, dir, "plan", "0.1.0", `  namespace: demo
+  packages:
+  - chart:
+      name: es
+      sourceRef: {kind: Legacy, name: "`+ArchiveRepositoryURL+`"}
+      required: true
+      versions:
+      - version: "~6"
+        selected: true
+  - chart:
+      name: kubedb
+      sourceRef: {kind: Legacy, name: "`+ArchiveRepositoryURL+`"}
+      required: true
+      versions:
+      - version: ">= 0.13.0-0"
+        selected: true
+`)
+	reg, err := NewArchiveRegistry(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ref := archiveChartRef("plan", "0.1.0")
+	bv, err := CreateBundleViewForBundle(reg, &ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	order, lock, err := CreateOrderWithLock(reg, *bv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	versions := func(order *releasesapi.Order) string {
+		var out []string
+		for _, pkg := range order.Spec.Packages {
+			out = append(out, pkg.Chart.Name+"@"+pkg.Chart.Version)
+		}
+		return strings.Join(out, ",")
+	}
+	if got, want := versions(order), "es@6.2.4,kubedb@v0.13.0-rc.0"; got != want {
+		t.Fatalf("got order charts %s, want %s", got, want)
+	}
+
+	data, err := json.Marshal(lock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved OrderLock
+	err = json.Unmarshal(data, &saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved.Bundles) != 1 || saved.Bundles[0].Name != "plan" {
+		t.Errorf("got locked bundles %v, want plan", saved.Bundles)
+	}
+
+	// the lock pins an order with version ranges to the locked versions
+	unpinned := order.DeepCopy()
+	unpinned.Spec.Packages[0].Chart.Version = "~6"
+	unpinned.Spec.Packages[1].Chart.Version = ">= 0.13.0-0"
+	err = saved.Apply(unpinned)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := versions(unpinned), versions(order); got != want {
+		t.Errorf("got pinned charts %s, want %s", got, want)
+	}
+	err = saved.Verify(reg)
+	if err != nil {
+		t.Errorf("got error %v, want none", err)
+	}
+
+	missing := order.DeepCopy()
+	missing.Spec.Packages[0].Chart.Version = "~5"
+	err = saved.Apply(missing)
+	if err == nil || err.Error() != "charts not found in lock: es@~5" {
+		t.Errorf("got error %v, want es@~5 not found", err)
+	}
+
+	// a chart archive republished with the same version is detected
+	changedDir := t.TempDir()
+	writeLockCharts(t, changedDir)
+	writeBundleChart(t, changedDir, "es", "6.2.4", nestedBundleSpec("kubedb"))
+	changed, err := NewArchiveRegistry(changedDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = saved.Verify(changed)
+	if err == nil || !strings.HasPrefix(err.Error(), "charts changed since they were locked: es@6.2.4") {
+		t.Errorf("got error %v, want es@6.2.4 changed", err)
+	}
+}
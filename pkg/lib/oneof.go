@@ -0,0 +1,265 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	releasesapi "x-helm.dev/apimachinery/apis/releases/v1alpha1"
+)
+
+// An alternative of a OneOf is chosen by marking its charts as Required in
+// the BundleView, the same way the user picks the charts of the top level
+// bundle. If no alternative is chosen, the bundle declared as the default of
+// the OneOf in the bundle definition is used with the charts it selects by
+// default, see DefaultOneOfAnnotation. If the bundle definition declares no
+// default either, CreateOrder fails.
+
+// DefaultOneOfAnnotation is set by the author of a bundle on its Bundle. It
+// holds a JSON map from the description of each OneOf of the bundle to the
+// name of the bundle used when the user chooses none, eg,
+// {"database":"postgres"}. A OneOf that lists a single bundle defaults to it.
+const DefaultOneOfAnnotation = "kubepack.dev/default-oneof"
+
+// SelectOneOf chooses the bundle with the given name in the OneOf that lists
+// it. The charts selected by default in that bundle are marked Required and
+// the charts of the other alternatives are unmarked. The OneOfs nested in
+// the chosen bundle are left unchosen, so CreateOrder uses their declared
+// default unless another call to SelectOneOf chooses one of their bundles.
+func SelectOneOf(bv *releasesapi.BundleOptionView, name string) error {
+	found, err := selectOneOf(bv, name)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("bundle %s is not an alternative of any OneOf in bundle %s", name, bv.Name)
+	}
+	return nil
+}
+
+func selectOneOf(bv *releasesapi.BundleOptionView, name string) (bool, error) {
+	for _, pkg := range bv.Packages {
+		if pkg.Bundle != nil {
+			if found, err := selectOneOf(pkg.Bundle, name); found || err != nil {
+				return found, err
+			}
+		} else if pkg.OneOf != nil {
+			idx := -1
+			for i, alt := range pkg.OneOf.Bundles {
+				if alt.Name == name {
+					idx = i
+					break
+				}
+			}
+			if idx < 0 {
+				for _, alt := range pkg.OneOf.Bundles {
+					if found, err := selectOneOf(alt, name); found || err != nil {
+						return found, err
+					}
+				}
+				continue
+			}
+
+			for i, alt := range pkg.OneOf.Bundles {
+				if i != idx {
+					clearRequired(alt)
+				} else if !bundleSelected(alt) {
+					if err := requireDefaultCharts(alt); err != nil {
+						return true, err
+					}
+				}
+			}
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// defaultOneOf returns the name of the bundle the bundle definition declares
+// as the default of its OneOf with the given description and bundle names,
+// or "" if none is declared.
+func defaultOneOf(bundle *releasesapi.Bundle, description string, names []string) (string, error) {
+	defaults, err := oneOfDefaults(bundle)
+	if err != nil {
+		return "", err
+	}
+	name, ok := defaults[description]
+	if !ok {
+		if len(names) == 1 {
+			return names[0], nil
+		}
+		return "", nil
+	}
+	if !slices.Contains(names, name) {
+		return "", fmt.Errorf("default bundle %s of OneOf %q in bundle %s is not one of its bundles %s", name, description, bundle.Name, strings.Join(names, ", "))
+	}
+	return name, nil
+}
+
+// oneOfDefaults returns the defaults declared in the DefaultOneOfAnnotation
+// of a bundle.
+func oneOfDefaults(bundle *releasesapi.Bundle) (map[string]string, error) {
+	data, ok := bundle.Annotations[DefaultOneOfAnnotation]
+	if !ok || data == "" {
+		return nil, nil
+	}
+	var out map[string]string
+	err := json.Unmarshal([]byte(data), &out)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s annotation of bundle %s: %w", DefaultOneOfAnnotation, bundle.Name, err)
+	}
+	return out, nil
+}
+
+// viewOneOfDefault returns the index of the bundle of a OneOf of a bundle
+// view that its bundle definition declares as the default, or -1.
+func viewOneOfDefault(bundle *releasesapi.Bundle, in *releasesapi.OneOfBundleOptionView) (int, error) {
+	names := make([]string, 0, len(in.Bundles))
+	for _, alt := range in.Bundles {
+		names = append(names, alt.Name)
+	}
+	name, err := defaultOneOf(bundle, in.Description, names)
+	if err != nil || name == "" {
+		return -1, err
+	}
+	return slices.Index(names, name), nil
+}
+
+// chosenOneOfIndex returns the index of the chosen alternative of a OneOf,
+// or -1 if none is chosen. It fails if more than one alternative is chosen.
+func chosenOneOfIndex(in *releasesapi.OneOfBundleOptionView) (int, error) {
+	if len(in.Bundles) == 0 {
+		return -1, fmt.Errorf("OneOf %q does not list any bundle", in.Description)
+	}
+
+	var chosen []int
+	for i, alt := range in.Bundles {
+		if bundleSelected(alt) {
+			chosen = append(chosen, i)
+		}
+	}
+	switch len(chosen) {
+	case 0:
+		return -1, nil
+	case 1:
+		return chosen[0], nil
+	default:
+		names := make([]string, 0, len(chosen))
+		for _, i := range chosen {
+			names = append(names, in.Bundles[i].Name)
+		}
+		return -1, fmt.Errorf("only one bundle of OneOf %q can be selected, found %s", in.Description, strings.Join(names, ", "))
+	}
+}
+
+// chosenOneOf returns the chosen alternative of a OneOf of a view of the
+// given bundle. If none is chosen, the charts selected by default in the
+// bundle declared as the default of the OneOf are marked Required in a copy
+// of it. It fails if none is chosen and no default is declared.
+func chosenOneOf(bundle *releasesapi.Bundle, in *releasesapi.OneOfBundleOptionView) (*releasesapi.BundleOptionView, error) {
+	idx, err := chosenOneOfIndex(in)
+	if err != nil {
+		return nil, err
+	}
+	if idx >= 0 {
+		return in.Bundles[idx], nil
+	}
+	idx, err = viewOneOfDefault(bundle, in)
+	if err != nil {
+		return nil, err
+	}
+	if idx < 0 {
+		return nil, fmt.Errorf("no bundle of OneOf %q is selected and bundle %s declares no default, select one using SelectOneOf", in.Description, bundle.Name)
+	}
+	out := in.Bundles[idx].DeepCopy()
+	if err := requireDefaultCharts(out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// bundleSelected reports whether any chart of the bundle or its nested
+// bundles is marked Required.
+func bundleSelected(bv *releasesapi.BundleOptionView) bool {
+	for _, pkg := range bv.Packages {
+		if pkg.Chart != nil && pkg.Chart.Required {
+			return true
+		} else if pkg.Bundle != nil && bundleSelected(pkg.Bundle) {
+			return true
+		} else if pkg.OneOf != nil {
+			for _, alt := range pkg.OneOf.Bundles {
+				if bundleSelected(alt) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// requireDefaultCharts marks the charts of a bundle and its nested bundles
+// that are selected by the bundle definition as Required. Nested OneOfs are
+// left unchosen, so their declared default is used. It fails if the bundle
+// selects no chart and has no OneOf, as choosing it would install nothing.
+func requireDefaultCharts(bv *releasesapi.BundleOptionView) error {
+	markDefaultCharts(bv)
+	if !bundleSelected(bv) && !hasOneOf(bv) {
+		return fmt.Errorf("bundle %s does not select any chart by default", bv.Name)
+	}
+	return nil
+}
+
+func markDefaultCharts(bv *releasesapi.BundleOptionView) {
+	for _, pkg := range bv.Packages {
+		if pkg.Chart != nil {
+			pkg.Chart.Required = pkg.Chart.Selected
+		} else if pkg.Bundle != nil {
+			markDefaultCharts(pkg.Bundle)
+		} else if pkg.OneOf != nil {
+			for _, alt := range pkg.OneOf.Bundles {
+				clearRequired(alt)
+			}
+		}
+	}
+}
+
+// hasOneOf reports whether a bundle or its nested bundles have a OneOf.
+func hasOneOf(bv *releasesapi.BundleOptionView) bool {
+	for _, pkg := range bv.Packages {
+		if pkg.OneOf != nil || (pkg.Bundle != nil && hasOneOf(pkg.Bundle)) {
+			return true
+		}
+	}
+	return false
+}
+
+func clearRequired(bv *releasesapi.BundleOptionView) {
+	for _, pkg := range bv.Packages {
+		if pkg.Chart != nil {
+			pkg.Chart.Required = false
+		} else if pkg.Bundle != nil {
+			clearRequired(pkg.Bundle)
+		} else if pkg.OneOf != nil {
+			for _, alt := range pkg.OneOf.Bundles {
+				clearRequired(alt)
+			}
+		}
+	}
+}
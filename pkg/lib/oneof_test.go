@@ -0,0 +1,288 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kmapi "kmodules.xyz/client-go/api/v1"
+	"sigs.k8s.io/yaml"
+	releasesapi "x-helm.dev/apimachinery/apis/releases/v1alpha1"
+)
+
+const oneOfView = `
+name: top
+packages:
+- oneOf:
+    description: backend
+    bundles:
+    - name: a
+      packages:
+      - chart:
+          name: a1
+          required: true
+          selected: true
+    - name: b
+      packages:
+      - bundle:
+          name: b-nested
+          packages:
+          - chart:
+              name: b1
+              selected: true
+          - oneOf:
+              description: storage
+              bundles:
+              - name: b-first
+                packages:
+                - chart:
+                    name: b2
+                    selected: true
+              - name: b-second
+                packages:
+                - chart:
+                    name: b3
+                    selected: true
+    - name: c
+      packages:
+      - chart:
+          name: c1
+`
+
+func TestSelectOneOf(t *testing.T) {
+	cases := []struct {
+		name     string
+		required []string
+		wantErr  bool
+	}{
+		{name: "a", required: []string{"a1"}},
+		// the nested OneOf of b is left to its declared default
+		{name: "b", required: []string{"b1"}},
+		{name: "c", wantErr: true},
+		{name: "missing", wantErr: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var bv releasesapi.BundleOptionView
+			if err := yaml.Unmarshal([]byte(oneOfView), &bv); err != nil {
+				t.Fatal(err)
+			}
+
+			err := SelectOneOf(&bv, c.name)
+			if c.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := requiredCharts(&bv); !slices.Equal(got, c.required) {
+				t.Errorf("got required charts %v, want %v", got, c.required)
+			}
+		})
+	}
+}
+
+func requiredCharts(bv *releasesapi.BundleOptionView) []string {
+	var out []string
+	for _, pkg := range bv.Packages {
+		if pkg.Chart != nil && pkg.Chart.Required {
+			out = append(out, pkg.Chart.Name)
+		} else if pkg.Bundle != nil {
+			out = append(out, requiredCharts(pkg.Bundle)...)
+		} else if pkg.OneOf != nil {
+			for _, alt := range pkg.OneOf.Bundles {
+				out = append(out, requiredCharts(alt)...)
+			}
+		}
+	}
+	return out
+}
+
+func TestDefaultOneOf(t *testing.T) {
+	cases := []struct {
+		name        string
+		annotation  string
+		description string
+		names       []string
+		want        string
+		wantErr     bool
+	}{
+		{
+			name:        "declared",
+			annotation:  `{"database":"my","cache":"redis"}`,
+			description: "database",
+			names:       []string{"pg", "my"},
+			want:        "my",
+		},
+		{
+			name:        "declared for another OneOf",
+			annotation:  `{"cache":"redis"}`,
+			description: "database",
+			names:       []string{"pg", "my"},
+		},
+		{name: "not declared", description: "database", names: []string{"pg", "my"}},
+		{name: "single bundle", description: "database", names: []string{"pg"}, want: "pg"},
+		{
+			name:        "not a bundle of the OneOf",
+			annotation:  `{"database":"redis"}`,
+			description: "database",
+			names:       []string{"pg", "my"},
+			wantErr:     true,
+		},
+		{
+			name:        "invalid annotation",
+			annotation:  `database=my`,
+			description: "database",
+			names:       []string{"pg", "my"},
+			wantErr:     true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			bundle := &releasesapi.Bundle{ObjectMeta: metav1.ObjectMeta{Name: "plan"}}
+			if c.annotation != "" {
+				bundle.Annotations = map[string]string{DefaultOneOfAnnotation: c.annotation}
+			}
+			got, err := defaultOneOf(bundle, c.description, c.names)
+			if c.wantErr {
+				if err == nil {
+					t.Fatalf("got default %q, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != c.want {
+				t.Errorf("got default %q, want %q", got, c.want)
+			}
+		})
+	}
+}
+
+// writeOneOfBundles writes the bundle plan, whose OneOf database chooses
+// between the bundles pg and my, each installing a chart of the same name.
+func writeOneOfBundles(t *testing.T, dir string, annotations map[string]string) {
+	t.Helper()
+	writeAnnotatedBundleChart(t, dir, "plan", "0.1.0", annotations, `  namespace: demo
+  packages:
+  - oneOf:
+      description: database
+      bundles:
+      - name: pg
+        sourceRef: {kind: Legacy, name: "`+ArchiveRepositoryURL+`"}
+        version: 0.1.0
+      - name: my
+        sourceRef: {kind: Legacy, name: "`+ArchiveRepositoryURL+`"}
+        version: 0.1.0
+`)
+	for _, name := range []string{"pg", "my"} {
+		writeBundleChart(t, dir, name, "0.1.0", `  namespace: demo
+  packages:
+  - chart:
+      name: `+name+`-server
+      sourceRef: {kind: Legacy, name: "`+ArchiveRepositoryURL+`"}
+      required: true
+      versions:
+      - version: 0.1.0
+        selected: true
+`)
+		writeManifestChart(t, dir, name+"-server", "", "")
+	}
+}
+
+func TestCreateOrderOneOfDefault(t *testing.T) {
+	cases := []struct {
+		name        string
+		annotations map[string]string
+		selected    string
+		want        []string
+		wantErr     string
+	}{
+		{
+			name:        "declared default",
+			annotations: map[string]string{DefaultOneOfAnnotation: `{"database":"my"}`},
+			want:        []string{"my-server"},
+		},
+		{
+			name:        "selected over the default",
+			annotations: map[string]string{DefaultOneOfAnnotation: `{"database":"my"}`},
+			selected:    "pg",
+			want:        []string{"pg-server"},
+		},
+		{
+			name:     "selected without a default",
+			selected: "my",
+			want:     []string{"my-server"},
+		},
+		{
+			name:    "no default",
+			wantErr: `no bundle of OneOf "database" is selected and bundle plan declares no default`,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeOneOfBundles(t, dir, c.annotations)
+			reg, err := NewArchiveRegistry(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			bv, err := CreateBundleViewForBundle(reg, &releasesapi.ChartSourceRef{
+				Name:    "plan",
+				Version: "0.1.0",
+				SourceRef: kmapi.TypedObjectReference{
+					Kind: releasesapi.SourceKindLegacy,
+					Name: ArchiveRepositoryURL,
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.selected != "" {
+				err = SelectOneOf(&bv.BundleOptionView, c.selected)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			order, err := CreateOrder(reg, *bv)
+			if c.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), c.wantErr) {
+					t.Fatalf("got error %v, want %q", err, c.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, pkg := range order.Spec.Packages {
+				got = append(got, pkg.Chart.Name)
+			}
+			if !slices.Equal(got, c.want) {
+				t.Errorf("got charts %v, want %v", got, c.want)
+			}
+		})
+	}
+}
@@ -18,6 +18,7 @@ package lib
 
 import (
 	"encoding/json"
+	"sync"
 	"time"
 
 	"kubepack.dev/lib-helm/pkg/action"
@@ -29,18 +30,36 @@ import (
 	"github.com/pkg/errors"
 	"gomodules.xyz/jsonpatch/v2"
 	crd_cs "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/cli-runtime/pkg/genericclioptions"
+	"k8s.io/client-go/dynamic"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"x-helm.dev/apimachinery/apis"
 	releasesapi "x-helm.dev/apimachinery/apis/releases/v1alpha1"
 )
 
-func CreateOrder(reg repo.IRegistry, bv releasesapi.BundleView) (*releasesapi.Order, error) {
-	selection, err := toPackageSelection(reg, &bv.BundleOptionView, bv.LicenseKey)
+// CreateOrder creates an Order from a BundleView. The BundleView does not
+// record the values used to render its bundle chart, so the same values must
+// be passed using WithBundleValues. It fails if a chart selected in the
+// BundleView is not listed in the rendered bundle. Nested bundles are always
+// rendered with their default values.
+func CreateOrder(reg repo.IRegistry, bv releasesapi.BundleView, opts ...ResolveOption) (*releasesapi.Order, error) {
+	out, _, err := CreateOrderWithLock(reg, bv, opts...)
+	return out, err
+}
+
+// CreateOrderWithLock creates an Order from a BundleView and returns the lock
+// recording the exact version and digest of every bundle and chart used.
+// Packages whose chart can't be pinned to a digest are listed in the
+// UnpinnedChartsAnnotation of the Order.
+func CreateOrderWithLock(reg repo.IRegistry, bv releasesapi.BundleView, opts ...ResolveOption) (*releasesapi.Order, *OrderLock, error) {
+	r := newBundleResolver(reg, opts)
+	selection, err := toPackageSelection(r, &bv.BundleOptionView, bv.LicenseKey)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	out := releasesapi.Order{
 		TypeMeta: metav1.TypeMeta{
@@ -56,7 +75,11 @@ func CreateOrder(reg repo.IRegistry, bv releasesapi.BundleView) (*releasesapi.Or
 			Packages: selection,
 		},
 	}
-	return &out, nil
+	err = setChartDigests(&out, r.digests, r.unpinned)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &out, r.lock, nil
 }
 
 // releaseNameMaxLen is the maximum length of a release name.
@@ -67,10 +90,10 @@ func CreateOrder(reg repo.IRegistry, bv releasesapi.BundleView) (*releasesapi.Or
 // xref: helm.sh/helm/v3/pkg/action/install.go
 const releaseNameMaxLen = 53
 
-func toPackageSelection(reg repo.IRegistry, in *releasesapi.BundleOptionView, licenseKey string) ([]releasesapi.PackageSelection, error) {
+func toPackageSelection(r *bundleResolver, in *releasesapi.BundleOptionView, licenseKey string) ([]releasesapi.PackageSelection, error) {
 	var out []releasesapi.PackageSelection
 
-	_, bundle, err := GetBundle(reg, &releasesapi.BundleOption{
+	_, bundle, err := r.enter(&releasesapi.BundleOption{
 		BundleRef: releasesapi.BundleRef{
 			Name:      in.Name,
 			SourceRef: in.SourceRef,
@@ -80,6 +103,7 @@ func toPackageSelection(reg repo.IRegistry, in *releasesapi.BundleOptionView, li
 	if err != nil {
 		return nil, err
 	}
+	defer r.leave()
 
 	for _, pkg := range in.Packages {
 		if pkg.Chart != nil {
@@ -89,6 +113,22 @@ func toPackageSelection(reg repo.IRegistry, in *releasesapi.BundleOptionView, li
 
 			for _, v := range pkg.Chart.Versions {
 				if v.Selected {
+					c, err := r.resolveChart(releasesapi.ChartSourceRef{
+						Name:      pkg.Chart.Name,
+						Version:   v.Version,
+						SourceRef: pkg.Chart.SourceRef,
+					})
+					if err != nil {
+						return nil, err
+					}
+					v.Version = c.Metadata.Version
+
+					// the BundleView does not record the values its bundle
+					// was rendered with, a chart missing from the bundle
+					// rendered here means they differ
+					if findVersionDetail(bundle, pkg.Chart.ChartRef, v.Version) == nil {
+						return nil, errors.Errorf("chart %s@%s of the BundleView is not listed in bundle %s, the BundleView may have been created with other bundle values", pkg.Chart.Name, v.Version, in.Name)
+					}
 					crds, waitFors, licenseKeyPath := FindChartData(bundle, pkg.Chart.ChartRef, v.Version)
 
 					releaseName := pkg.Chart.Name
@@ -117,6 +157,23 @@ func toPackageSelection(reg repo.IRegistry, in *releasesapi.BundleOptionView, li
 						v.ValuesPatch = &runtime.RawExtension{Raw: data}
 					}
 
+					digest := c.Digest
+					if digest == "" {
+						digest, _, err = ociChartDigest(r.reg, releasesapi.ChartSourceRef{
+							Name:      pkg.Chart.Name,
+							Version:   v.Version,
+							SourceRef: pkg.Chart.SourceRef,
+						})
+						if err != nil {
+							return nil, err
+						}
+					}
+					if digest != "" {
+						r.digests[pkg.Chart.Namespace+"/"+releaseName] = digest
+					} else {
+						r.unpinned = append(r.unpinned, pkg.Chart.Namespace+"/"+releaseName)
+					}
+
 					selection := releasesapi.PackageSelection{
 						Chart: &releasesapi.ChartSelection{
 							ChartRef:    pkg.Chart.ChartRef,
@@ -138,13 +195,21 @@ func toPackageSelection(reg repo.IRegistry, in *releasesapi.BundleOptionView, li
 				}
 			}
 		} else if pkg.Bundle != nil {
-			selections, err := toPackageSelection(reg, pkg.Bundle, licenseKey)
+			selections, err := toPackageSelection(r, pkg.Bundle, licenseKey)
 			if err != nil {
 				return nil, err
 			}
 			out = append(out, selections...)
 		} else if pkg.OneOf != nil {
-			return nil, errors.New("User must select one bundle")
+			chosen, err := chosenOneOf(bundle, pkg.OneOf)
+			if err != nil {
+				return nil, err
+			}
+			selections, err := toPackageSelection(r, chosen, licenseKey)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, selections...)
 		}
 	}
 
@@ -152,155 +217,391 @@ func toPackageSelection(reg repo.IRegistry, in *releasesapi.BundleOptionView, li
 }
 
 func FindChartData(bundle *releasesapi.Bundle, chrtRef releasesapi.ChartRef, chrtVersion string) (*releasesapi.ResourceDefinitions, []releasesapi.WaitFlags, string) {
+	v := findVersionDetail(bundle, chrtRef, chrtVersion)
+	if v == nil {
+		return nil, nil, ""
+	}
+	return v.Resources, v.WaitFors, v.LicenseKeyPath
+}
+
+// findVersionDetail returns the version of a chart listed in a bundle that
+// matches chrtVersion, or nil if the bundle does not list it.
+func findVersionDetail(bundle *releasesapi.Bundle, chrtRef releasesapi.ChartRef, chrtVersion string) *releasesapi.VersionDetail {
 	for _, pkg := range bundle.Spec.Packages {
 		if pkg.Chart != nil &&
 			pkg.Chart.SourceRef == chrtRef.SourceRef &&
 			pkg.Chart.Name == chrtRef.Name {
 
-			for _, v := range pkg.Chart.Versions {
+			for i, v := range pkg.Chart.Versions {
 				if v.Version == chrtVersion {
-					return v.Resources, v.WaitFors, v.LicenseKeyPath
+					return &pkg.Chart.Versions[i]
+				}
+			}
+			// the bundle may list a version range
+			for i, v := range pkg.Chart.Versions {
+				if !isExactVersion(v.Version) && versionMatches(v.Version, chrtVersion) {
+					return &pkg.Chart.Versions[i]
 				}
 			}
 		}
 	}
-	return nil, nil, ""
+	return nil
 }
 
 func InstallOrder(getter genericclioptions.RESTClientGetter, reg repo.IRegistry, order releasesapi.Order, opts ...ScriptOption) error {
-	config, err := getter.ToRESTConfig()
+	var scriptOptions ScriptOptions
+	for _, opt := range opts {
+		opt.Apply(&scriptOptions)
+	}
+
+	order, reg, kubeVersion, err := preflightOrder(getter, reg, order, scriptOptions)
 	if err != nil {
 		return err
 	}
 
-	cc, err := crd_cs.NewForConfig(config)
+	g, err := newPackageGraph(order.Spec.Packages)
+	if err != nil {
+		return err
+	}
+	ids, err := g.sorted()
 	if err != nil {
 		return err
 	}
 
-	info, err := cc.ServerVersion()
+	x, err := newOrderInstaller(getter, reg, kubeVersion, scriptOptions)
 	if err != nil {
 		return err
 	}
+	if scriptOptions.DryRun {
+		return x.dryRunOrder(order, ids)
+	}
+
+	x.status = newOrderStatusRecorder(order, scriptOptions.StatusHandler)
+	return installPackages(g, order, scriptOptions, x.status, x.installPackage, func(cause error) error {
+		return rollbackReleases(x.installed, cause, x.status, func(r *installedRelease) error {
+			return uninstallRelease(getter, x.kc, r)
+		})
+	})
+}
+
+// installPackages runs install for the packages of order in dependency order
+// and records their phases in status. In atomic mode, rollback is called
+// with the install error after a failure.
+func installPackages(g *packageGraph, order releasesapi.Order, opts ScriptOptions, status *orderStatusRecorder, install func(chrt *releasesapi.ChartSelection) error, rollback func(cause error) error) error {
+	err := g.run(opts.MaxConcurrency, opts.Atomic, func(i int) error {
+		chrt := order.Spec.Packages[i].Chart
+		if chrt == nil {
+			return nil
+		}
+		err := install(chrt)
+		if err != nil {
+			status.setPhase(chrt, PackageFailed, err)
+		}
+		return err
+	}, func(i int, err error) {
+		if chrt := order.Spec.Packages[i].Chart; chrt != nil {
+			status.setPhase(chrt, PackageSkipped, err)
+		}
+	})
+	if err != nil && opts.Atomic {
+		err = rollback(err)
+	}
+	status.finish(err)
+	return err
+}
+
+// preflightOrder pins the order to the lock in opts, if any, verifies the
+// digests of its charts and checks the cluster version against it. It
+// returns the pinned order, the registry serving the verified charts and the
+// cluster version. It runs before anything is registered, so that a failed
+// preflight leaves the cluster as is.
+func preflightOrder(getter genericclioptions.RESTClientGetter, reg repo.IRegistry, order releasesapi.Order, opts ScriptOptions) (releasesapi.Order, repo.IRegistry, string, error) {
+	order, err := applyLock(reg, order, opts)
+	if err != nil {
+		return order, nil, "", err
+	}
+	reg, err = VerifyChartDigests(reg, order)
+	if err != nil {
+		return order, nil, "", err
+	}
+	kubeVersion, err := serverKubeVersion(getter)
+	if err != nil {
+		return order, nil, "", err
+	}
+	err = CheckKubeVersion(reg, order, kubeVersion)
+	if err != nil {
+		return order, nil, "", err
+	}
+	return order, reg, kubeVersion, nil
+}
+
+// serverKubeVersion returns the version of the cluster, without prerelease
+// and build metadata.
+func serverKubeVersion(getter genericclioptions.RESTClientGetter) (string, error) {
+	config, err := getter.ToRESTConfig()
+	if err != nil {
+		return "", err
+	}
+	cc, err := crd_cs.NewForConfig(config)
+	if err != nil {
+		return "", err
+	}
+
+	info, err := cc.ServerVersion()
+	if err != nil {
+		return "", err
+	}
 	kubeVersionPtr, err := semver.NewVersion(info.GitVersion)
 	if err != nil {
-		return err
+		return "", err
 	}
 	kubeVersion := *kubeVersionPtr
 	kubeVersion, _ = kubeVersion.SetPrerelease("")
 	kubeVersion, _ = kubeVersion.SetMetadata("")
+	return kubeVersion.Original(), nil
+}
 
-	var scriptOptions ScriptOptions
-	for _, opt := range opts {
-		opt.Apply(&scriptOptions)
+func newOrderInstaller(getter genericclioptions.RESTClientGetter, reg repo.IRegistry, kubeVersion string, scriptOptions ScriptOptions) (*orderInstaller, error) {
+	config, err := getter.ToRESTConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	cc, err := crd_cs.NewForConfig(config)
+	if err != nil {
+		return nil, err
 	}
 
-	if !scriptOptions.DisableAppReleaseCRD {
+	x := &orderInstaller{
+		getter:      getter,
+		reg:         reg,
+		cc:          cc,
+		kubeVersion: kubeVersion,
+		opts:        scriptOptions,
+	}
+
+	if !scriptOptions.DisableAppReleaseCRD && !scriptOptions.DryRun {
 		f1 := &AppReleaseCRDRegistrar{
 			Config: config,
 		}
 		err = f1.Do()
 		if err != nil {
-			return err
+			return nil, err
 		}
-	}
 
-	for _, pkg := range order.Spec.Packages {
-		if pkg.Chart == nil {
-			continue
-		}
-
-		f3, err := action.NewInstaller(getter, pkg.Chart.Namespace, "secret")
+		x.kc, err = action.NewUncachedClientForConfig(config)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		f3.
-			WithRegistry(reg).
-			WithOptions(action.InstallOptions{
-				ChartSourceFlatRef: releasesapi.ChartSourceFlatRef{
-					Name:            pkg.Chart.Name,
-					Version:         pkg.Chart.Version,
-					SourceAPIGroup:  pkg.Chart.SourceRef.APIGroup,
-					SourceKind:      pkg.Chart.SourceRef.Kind,
-					SourceNamespace: pkg.Chart.SourceRef.Namespace,
-					SourceName:      pkg.Chart.SourceRef.Name,
-				},
-				Options: values.Options{
-					ValuesFile:  pkg.Chart.ValuesFile,
-					ValuesPatch: pkg.Chart.ValuesPatch,
-				},
-				Namespace:       pkg.Chart.Namespace,
-				CreateNamespace: !apis.BuiltinNamespaces.Has(pkg.Chart.Namespace),
-				ReleaseName:     pkg.Chart.ReleaseName,
-			})
-		err = f3.Do()
+	}
+	return x, nil
+}
+
+type orderInstaller struct {
+	getter      genericclioptions.RESTClientGetter
+	reg         repo.IRegistry
+	cc          crd_cs.Interface
+	kc          client.Client
+	kubeVersion string
+	opts        ScriptOptions
+
+	// dc and mapper are used by the dry-run instead of the clients
+	// created from getter, if set.
+	dc     dynamic.Interface
+	mapper meta.RESTMapper
+
+	status    *orderStatusRecorder
+	installed []*installedRelease
+	m         sync.Mutex
+}
+
+func (x *orderInstaller) track(r *installedRelease) {
+	x.m.Lock()
+	x.installed = append(x.installed, r)
+	x.m.Unlock()
+}
+
+// installPackage brings the release of chrt to the state requested in the
+// Order. An up to date release is kept as is, so that an interrupted
+// InstallOrder can be run again.
+func (x *orderInstaller) installPackage(chrt *releasesapi.ChartSelection) error {
+	x.status.setPhase(chrt, PackageInstalling, nil)
+
+	repair, last, err := x.inspectRelease(chrt)
+	if err != nil {
+		return err
+	}
+
+	// only releases created by this run are uninstalled on rollback
+	var rls *installedRelease
+	switch repair {
+	case repairNone:
+		x.status.setRevision(chrt, last.Version)
+	case repairUpgrade:
+		err = x.deployRelease(chrt)
+	case repairReinstall:
+		err = uninstallPackage(x.getter, chrt, x.opts.Timeout)
 		if err != nil {
 			return err
 		}
+		rls, err = x.installRelease(chrt, false)
+	case repairReplace:
+		rls, err = x.installRelease(chrt, true)
+	default:
+		rls, err = x.installRelease(chrt, false)
+	}
+	if err != nil {
+		return err
+	}
 
-		f4 := &WaitForChecker{
-			Namespace:    pkg.Chart.Namespace,
-			WaitFors:     pkg.Chart.WaitFors,
-			ClientGetter: getter,
+	x.status.setPhase(chrt, PackageWaiting, nil)
+	err = x.waitForPackage(chrt)
+	if err != nil {
+		return err
+	}
+
+	app, err := x.applyAppRelease(chrt)
+	if err != nil {
+		return err
+	}
+	if rls != nil {
+		x.m.Lock()
+		rls.App = app
+		x.m.Unlock()
+	}
+	x.status.setPhase(chrt, PackageReady, nil)
+	return nil
+}
+
+func (x *orderInstaller) installRelease(chrt *releasesapi.ChartSelection, replace bool) (*installedRelease, error) {
+	f3, err := action.NewInstaller(x.getter, chrt.Namespace, "secret")
+	if err != nil {
+		return nil, err
+	}
+	f3.
+		WithRegistry(x.reg).
+		WithOptions(action.InstallOptions{
+			ChartSourceFlatRef: releasesapi.ChartSourceFlatRef{
+				Name:            chrt.Name,
+				Version:         chrt.Version,
+				SourceAPIGroup:  chrt.SourceRef.APIGroup,
+				SourceKind:      chrt.SourceRef.Kind,
+				SourceNamespace: chrt.SourceRef.Namespace,
+				SourceName:      chrt.SourceRef.Name,
+			},
+			Options: values.Options{
+				ValuesFile:  chrt.ValuesFile,
+				ValuesPatch: chrt.ValuesPatch,
+			},
+			Namespace:       chrt.Namespace,
+			CreateNamespace: !apis.BuiltinNamespaces.Has(chrt.Namespace),
+			ReleaseName:     chrt.ReleaseName,
+			Replace:         replace,
+		})
+	err = f3.Do()
+	if f3.Result() == nil {
+		return nil, err
+	}
+	// helm stores a release even when the install fails half way
+	rls := &installedRelease{Chart: chrt}
+	x.track(rls)
+	x.status.setRevision(chrt, f3.Result().Version)
+	return rls, err
+}
+
+func (x *orderInstaller) waitForPackage(chrt *releasesapi.ChartSelection) error {
+	f4 := &WaitForChecker{
+		Namespace:    chrt.Namespace,
+		WaitFors:     chrt.WaitFors,
+		ClientGetter: x.getter,
+	}
+	err := f4.Do()
+	if err != nil {
+		return err
+	}
+
+	if chrt.Resources != nil && len(chrt.Resources.Owned) > 0 {
+		f5 := &CRDReadinessChecker{
+			CRDs:   chrt.Resources.Owned,
+			Client: x.cc,
 		}
-		err = f4.Do()
+		err = f5.Do()
 		if err != nil {
 			return err
 		}
+	}
+	return nil
+}
 
-		if pkg.Chart.Resources != nil && len(pkg.Chart.Resources.Owned) > 0 {
-			f5 := &CRDReadinessChecker{
-				CRDs:   pkg.Chart.Resources.Owned,
-				Client: cc,
-			}
-			err = f5.Do()
-			if err != nil {
-				return err
-			}
-		}
-
-		if !scriptOptions.DisableAppReleaseCRD {
-			f6 := &ApplicationGenerator{
-				Registry:    reg,
-				Chart:       *pkg.Chart,
-				KubeVersion: kubeVersion.Original(),
-			}
-			err = f6.Do()
-			if err != nil {
-				return err
-			}
+// UninstallOrder uninstalls the packages of an order in reverse dependency
+// order. It waits for the objects of each release to be deleted before moving
+// on to the packages it depends on.
+func UninstallOrder(getter genericclioptions.RESTClientGetter, order releasesapi.Order, opts ...ScriptOption) error {
+	var scriptOptions ScriptOptions
+	for _, opt := range opts {
+		opt.Apply(&scriptOptions)
+	}
 
-			kc, err := action.NewUncachedClientForConfig(config)
-			if err != nil {
-				return err
-			}
-			f7 := &ApplicationCreator{
-				App:    f6.Result(),
-				Client: kc,
-			}
-			err = f7.Do()
-			if err != nil {
-				return err
-			}
+	charts, err := uninstallSequence(order.Spec.Packages)
+	if err != nil {
+		return err
+	}
+	for _, chrt := range charts {
+		err = uninstallPackage(getter, chrt, scriptOptions.Timeout)
+		if err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
-func UninstallOrder(getter genericclioptions.RESTClientGetter, order releasesapi.Order) error {
-	for _, pkg := range order.Spec.Packages {
-		if pkg.Chart == nil {
-			continue
+// uninstallSequence returns the charts of the packages in the order they
+// are uninstalled, the reverse of the install order.
+func uninstallSequence(packages []releasesapi.PackageSelection) ([]*releasesapi.ChartSelection, error) {
+	sorted, err := SortPackages(packages)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]*releasesapi.ChartSelection, 0, len(sorted))
+	for i := len(sorted) - 1; i >= 0; i-- {
+		if sorted[i].Chart != nil {
+			out = append(out, sorted[i].Chart)
 		}
+	}
+	return out, nil
+}
 
-		f1, err := action.NewUninstaller(getter, pkg.Chart.Namespace, "secret")
-		if err != nil {
-			return err
-		}
-		f1.WithReleaseName(pkg.Chart.ReleaseName)
-		err = f1.Do()
-		if err != nil {
-			return err
+func uninstallPackage(getter genericclioptions.RESTClientGetter, chrt *releasesapi.ChartSelection, timeout time.Duration) error {
+	f1, err := action.NewUninstaller(getter, chrt.Namespace, "secret")
+	if err != nil {
+		return err
+	}
+	f1.WithReleaseName(chrt.ReleaseName).
+		WithOptions(action.UninstallOptions{
+			Timeout: timeout,
+		})
+	err = f1.Do()
+	if err != nil {
+		return err
+	}
+	if f1.Result() == nil || f1.Result().Release == nil {
+		return nil
+	}
+
+	f2 := &DeletionChecker{
+		Manifest:     f1.Result().Release.Manifest,
+		Namespace:    chrt.Namespace,
+		Timeout:      timeout,
+		ClientGetter: getter,
+	}
+	err = f2.Do()
+	if err != nil {
+		return err
+	}
+	if stuck := f2.Result(); len(stuck) > 0 {
+		return &StuckResourcesError{
+			Release:   chrt.Namespace + "/" + chrt.ReleaseName,
+			Resources: stuck,
 		}
 	}
 	return nil
@@ -24,14 +24,22 @@ import (
 	releasesapi "x-helm.dev/apimachinery/apis/releases/v1alpha1"
 )
 
+// ComparePlans returns the features of the named bundles side by side. The
+// features of a bundle include the ones inherited from its nested bundles and
+// the default bundle of its OneOfs, the same as shown in its BundleView, so
+// that a plan is compared by what it installs. So the table also has rows for
+// traits that only a nested bundle declares. A trait declared by the bundle
+// itself wins over the inherited one and a OneOf without a default bundle
+// adds no features. Bundles shared by the plans are fetched once.
 func ComparePlans(reg repo.IRegistry, srcRef kmapi.TypedObjectReference, names []string, version string) (productsapi.FeatureTable, error) {
 	var table productsapi.FeatureTable
 
 	ids := map[string]int{} // trait -> idx
 	idx := 0
 
+	r := newBundleResolver(reg, nil)
 	for bundleIdx, bundleName := range names {
-		_, bundle, err := GetBundle(reg, &releasesapi.BundleOption{
+		features, err := bundleFeatures(r, &releasesapi.BundleOption{
 			BundleRef: releasesapi.BundleRef{
 				Name:      bundleName,
 				SourceRef: srcRef,
@@ -41,7 +49,7 @@ func ComparePlans(reg repo.IRegistry, srcRef kmapi.TypedObjectReference, names [
 		if err != nil {
 			return productsapi.FeatureTable{}, err
 		}
-		for _, feature := range bundle.Spec.Features {
+		for _, feature := range features {
 			id, ok := ids[feature.Trait]
 			if !ok {
 				id = idx
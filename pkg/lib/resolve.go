@@ -0,0 +1,220 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"kubepack.dev/lib-helm/pkg/repo"
+
+	"helm.sh/helm/v3/pkg/chart"
+	releasesapi "x-helm.dev/apimachinery/apis/releases/v1alpha1"
+)
+
+// DefaultMaxBundleDepth is the maximum nesting of bundles, unless overridden
+// using WithMaxBundleDepth.
+const DefaultMaxBundleDepth = 10
+
+type ResolveOptions struct {
+	// MaxDepth is the maximum number of nested bundles below the top level
+	// bundle.
+	MaxDepth int
+	// Cache holds the bundles already loaded. It can be shared between calls.
+	Cache *BundleCache
+	// Values are used to render the top level bundle chart. Nested bundles
+	// are rendered with their default values.
+	Values map[string]any
+}
+
+type ResolveOption interface {
+	Apply(opt *ResolveOptions)
+}
+
+type ResolveOptionFunc func(opt *ResolveOptions)
+
+func (fn ResolveOptionFunc) Apply(opt *ResolveOptions) {
+	fn(opt)
+}
+
+func WithMaxBundleDepth(n int) ResolveOption {
+	return ResolveOptionFunc(func(opt *ResolveOptions) {
+		opt.MaxDepth = n
+	})
+}
+
+func WithBundleCache(c *BundleCache) ResolveOption {
+	return ResolveOptionFunc(func(opt *ResolveOptions) {
+		opt.Cache = c
+	})
+}
+
+// WithBundleValues sets the values used to render the top level bundle
+// chart. Nested bundles are always rendered with their default values. The
+// values are not recorded in the BundleView, so the same values must be used
+// to create the BundleView and the Order.
+func WithBundleValues(vals map[string]any) ResolveOption {
+	return ResolveOptionFunc(func(opt *ResolveOptions) {
+		opt.Values = vals
+	})
+}
+
+type bundleCacheKey struct {
+	releasesapi.ChartSourceRef
+	values string
+}
+
+type cachedBundle struct {
+	chart  *repo.ChartExtended
+	bundle *releasesapi.Bundle
+}
+
+// BundleCache stores the bundles loaded from a registry, so that bundles
+// shared by several parent bundles are only fetched once.
+type BundleCache struct {
+	bundles map[bundleCacheKey]cachedBundle
+	m       sync.Mutex
+}
+
+func NewBundleCache() *BundleCache {
+	return &BundleCache{
+		bundles: map[bundleCacheKey]cachedBundle{},
+	}
+}
+
+func (c *BundleCache) GetBundle(reg repo.IRegistry, in *releasesapi.BundleOption, vals map[string]any) (*repo.ChartExtended, *releasesapi.Bundle, error) {
+	key := bundleCacheKey{ChartSourceRef: bundleKey(in)}
+	if vals != nil {
+		data, err := json.Marshal(vals)
+		if err != nil {
+			return nil, nil, err
+		}
+		key.values = string(data)
+	}
+
+	c.m.Lock()
+	b, ok := c.bundles[key]
+	c.m.Unlock()
+	if ok {
+		return b.chart, b.bundle, nil
+	}
+
+	chrt, err := reg.GetChart(key.ChartSourceRef)
+	if err != nil {
+		return nil, nil, err
+	}
+	_, bundle, err := getBundle(chrt.Chart, vals)
+	if err != nil {
+		return nil, nil, err
+	}
+	c.m.Lock()
+	c.bundles[key] = cachedBundle{chart: chrt, bundle: bundle}
+	c.m.Unlock()
+	return chrt, bundle, nil
+}
+
+func bundleKey(in *releasesapi.BundleOption) releasesapi.ChartSourceRef {
+	return releasesapi.ChartSourceRef{
+		Name:      in.Name,
+		Version:   in.Version,
+		SourceRef: in.SourceRef,
+	}
+}
+
+// bundleResolver tracks the chain of bundles being resolved to detect cycles
+// and limit the nesting depth. Resolved versions are recorded in lock.
+type bundleResolver struct {
+	reg   repo.IRegistry
+	opts  ResolveOptions
+	chain []releasesapi.ChartSourceRef
+	lock  *OrderLock
+	// digests maps namespace/release to the digest of the selected chart
+	digests map[string]string
+	// unpinned lists the namespace/release of charts without a digest
+	unpinned []string
+}
+
+func newBundleResolver(reg repo.IRegistry, opts []ResolveOption) *bundleResolver {
+	r := &bundleResolver{
+		reg: reg,
+		opts: ResolveOptions{
+			MaxDepth: DefaultMaxBundleDepth,
+		},
+		lock:    &OrderLock{},
+		digests: map[string]string{},
+	}
+	for _, opt := range opts {
+		opt.Apply(&r.opts)
+	}
+	if r.opts.Cache == nil {
+		r.opts.Cache = NewBundleCache()
+	}
+	return r
+}
+
+// enter loads a bundle and adds it to the chain. Every successful call must
+// be followed by a call to leave.
+func (r *bundleResolver) enter(in *releasesapi.BundleOption) (*chart.Chart, *releasesapi.Bundle, error) {
+	key := bundleKey(in)
+	if len(r.chain) > r.opts.MaxDepth {
+		return nil, nil, fmt.Errorf("bundles are nested deeper than %d levels: %s", r.opts.MaxDepth, formatBundleChain(append(r.chain[:len(r.chain):len(r.chain)], key)))
+	}
+
+	var vals map[string]any
+	if len(r.chain) == 0 {
+		vals = r.opts.Values
+	}
+	chrt, bundle, err := r.opts.Cache.GetBundle(r.reg, in, vals)
+	if err != nil {
+		return nil, nil, err
+	}
+	locked := LockedChart{
+		ChartSourceRef: key,
+		Digest:         chrt.Digest,
+	}
+	if !isExactVersion(key.Version) {
+		if !versionMatches(key.Version, chrt.Metadata.Version) {
+			return nil, nil, fmt.Errorf("bundle %s@%s does not satisfy version %q", key.Name, chrt.Metadata.Version, key.Version)
+		}
+		locked.Constraint = key.Version
+		locked.Version = chrt.Metadata.Version
+		key.Version = chrt.Metadata.Version
+	}
+
+	for i, ref := range r.chain {
+		if ref == key {
+			return nil, nil, fmt.Errorf("bundle cycle found: %s", formatBundleChain(append(r.chain[i:len(r.chain):len(r.chain)], key)))
+		}
+	}
+	r.lock.addBundle(locked)
+	r.chain = append(r.chain, key)
+	return chrt.Chart, bundle, nil
+}
+
+func (r *bundleResolver) leave() {
+	r.chain = r.chain[:len(r.chain)-1]
+}
+
+func formatBundleChain(chain []releasesapi.ChartSourceRef) string {
+	names := make([]string, 0, len(chain))
+	for _, ref := range chain {
+		names = append(names, ref.Name+"@"+ref.Version)
+	}
+	return strings.Join(names, " -> ")
+}
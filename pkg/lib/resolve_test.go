@@ -0,0 +1,245 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// nestedBundleSpec returns the spec of a bundle that includes the named
+// bundles of the archive.
+func nestedBundleSpec(names ...string) string {
+	spec := "  namespace: demo\n  packages:"
+	if len(names) == 0 {
+		return spec + " []\n"
+	}
+	spec += "\n"
+	for _, name := range names {
+		spec += `  - bundle:
+      name: ` + name + `
+      sourceRef: {kind: Legacy, name: "` + ArchiveRepositoryURL + `"}
+      version: 0.1.0
+`
+	}
+	return spec
+}
+
+func TestBundleResolverCycles(t *testing.T) {
+	dir := t.TempDir()
+	writeBundleChart(t, dir, "self", "0.1.0", nestedBundleSpec("self"))
+	writeBundleChart(t, dir, "a", "0.1.0", nestedBundleSpec("b"))
+	writeBundleChart(t, dir, "b", "0.1.0", nestedBundleSpec("c"))
+	writeBundleChart(t, dir, "c", "0.1.0", nestedBundleSpec("a"))
+	writeBundleChart(t, dir, "top", "0.1.0", nestedBundleSpec("a"))
+
+	reg, err := NewArchiveRegistry(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		bundle  string
+		wantErr string
+	}{
+		{
+			bundle:  "self",
+			wantErr: "bundle cycle found: self@0.1.0 -> self@0.1.0",
+		},
+		{
+			bundle:  "a",
+			wantErr: "bundle cycle found: a@0.1.0 -> b@0.1.0 -> c@0.1.0 -> a@0.1.0",
+		},
+		{
+			// the chain starts at the bundle that is included again
+			bundle:  "top",
+			wantErr: "bundle cycle found: a@0.1.0 -> b@0.1.0 -> c@0.1.0 -> a@0.1.0",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.bundle, func(t *testing.T) {
+			ref := archiveChartRef(c.bundle, "0.1.0")
+			_, err := CreateBundleViewForBundle(reg, &ref)
+			if err == nil || err.Error() != c.wantErr {
+				t.Fatalf("got error %v, want %q", err, c.wantErr)
+			}
+		})
+	}
+}
+
+func TestBundleResolverMaxDepth(t *testing.T) {
+	dir := t.TempDir()
+	writeBundleChart(t, dir, "l0", "0.1.0", nestedBundleSpec("l1"))
+	writeBundleChart(t, dir, "l1", "0.1.0", nestedBundleSpec("l2"))
+	writeBundleChart(t, dir, "l2", "0.1.0", nestedBundleSpec("l3"))
+	writeBundleChart(t, dir, "l3", "0.1.0", nestedBundleSpec())
+
+	reg, err := NewArchiveRegistry(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref := archiveChartRef("l0", "0.1.0")
+
+	cases := []struct {
+		opts    []ResolveOption
+		wantErr string
+	}{
+		{},
+		{opts: []ResolveOption{WithMaxBundleDepth(3)}},
+		{
+			opts:    []ResolveOption{WithMaxBundleDepth(2)},
+			wantErr: "bundles are nested deeper than 2 levels: l0@0.1.0 -> l1@0.1.0 -> l2@0.1.0 -> l3@0.1.0",
+		},
+		{
+			opts:    []ResolveOption{WithMaxBundleDepth(0)},
+			wantErr: "bundles are nested deeper than 0 levels: l0@0.1.0 -> l1@0.1.0",
+		},
+	}
+	for _, c := range cases {
+		_, err := CreateBundleViewForBundle(reg, &ref, c.opts...)
+		if c.wantErr == "" {
+			if err != nil {
+				t.Errorf("got error %v, want none", err)
+			}
+		} else if err == nil || err.Error() != c.wantErr {
+			t.Errorf("got error %v, want %q", err, c.wantErr)
+		}
+	}
+}
+
+func TestBundleCacheFetchesSharedBundlesOnce(t *testing.T) {
+	dir := t.TempDir()
+	writeBundleChart(t, dir, "top", "0.1.0", nestedBundleSpec("left", "right", "shared"))
+	writeBundleChart(t, dir, "left", "0.1.0", nestedBundleSpec("shared"))
+	writeBundleChart(t, dir, "right", "0.1.0", nestedBundleSpec("shared"))
+	writeBundleChart(t, dir, "shared", "0.1.0", nestedBundleSpec())
+
+	ar, err := NewArchiveRegistry(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := &countingRegistry{IRegistry: ar, fetched: map[string]int{}}
+	ref := archiveChartRef("top", "0.1.0")
+
+	cache := NewBundleCache()
+	for i := 0; i < 2; i++ {
+		bv, err := CreateBundleViewForBundle(reg, &ref, WithBundleCache(cache))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, pkg := range bv.Packages {
+			names = append(names, pkg.Bundle.Name)
+		}
+		if got := strings.Join(names, ","); got != "left,right,shared" {
+			t.Fatalf("got nested bundles %s, want left,right,shared", got)
+		}
+	}
+
+	want := map[string]int{"top": 1, "left": 1, "right": 1, "shared": 1}
+	if !reflect.DeepEqual(reg.fetched, want) {
+		t.Errorf("got fetched charts %v, want %v", reg.fetched, want)
+	}
+}
+
+func TestBundleValues(t *testing.T) {
+	dir := t.TempDir()
+	writeBundleChart(t, dir, "gated", "0.1.0", `  namespace: demo
+  packages:
+  - chart:
+{{- if .Values.ha }}
+      name: replicated
+{{- else }}
+      name: single
+{{- end }}
+      sourceRef: {kind: Legacy, name: "`+ArchiveRepositoryURL+`"}
+      required: true
+      versions:
+      - version: 0.1.0
+`)
+	writeManifestChart(t, dir, "single", "", "")
+	writeManifestChart(t, dir, "replicated", "", "")
+
+	ar, err := NewArchiveRegistry(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := &countingRegistry{IRegistry: ar, fetched: map[string]int{}}
+	ref := archiveChartRef("gated", "0.1.0")
+	cache := NewBundleCache()
+
+	cases := []struct {
+		name string
+		vals map[string]any
+		want string
+	}{
+		{name: "default values", want: "single"},
+		{name: "ha", vals: map[string]any{"ha": true}, want: "replicated"},
+		{name: "ha off", vals: map[string]any{"ha": false}, want: "single"},
+		// served from the cache, not from the entry of the last values
+		{name: "default values again", want: "single"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			opts := []ResolveOption{WithBundleCache(cache), WithBundleValues(c.vals)}
+			bv, err := CreateBundleViewForBundle(reg, &ref, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := bv.Packages[0].Chart.Name; got != c.want {
+				t.Errorf("got BundleView chart %s, want %s", got, c.want)
+			}
+
+			order, err := CreateOrder(reg, *bv, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := order.Spec.Packages[0].Chart.Name; got != c.want {
+				t.Errorf("got Order chart %s, want %s", got, c.want)
+			}
+		})
+	}
+
+	// a BundleView rendered with other values is not accepted
+	bv, err := CreateBundleViewForBundle(reg, &ref, WithBundleCache(cache), WithBundleValues(map[string]any{"ha": true}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = CreateOrder(reg, *bv, WithBundleCache(cache))
+	if err == nil || !strings.Contains(err.Error(), "created with other bundle values") {
+		t.Errorf("got error %v, want the BundleView to be refused", err)
+	}
+
+	var keys []string
+	for key := range cache.bundles {
+		keys = append(keys, key.Name+"@"+key.Version+" "+key.values)
+	}
+	sort.Strings(keys)
+	want := []string{
+		"gated@0.1.0 ",
+		`gated@0.1.0 {"ha":false}`,
+		`gated@0.1.0 {"ha":true}`,
+	}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("got cached bundles %q, want %q", keys, want)
+	}
+	if got := reg.fetched["gated"]; got != len(want) {
+		t.Errorf("got the bundle chart fetched %d times, want once per values", got)
+	}
+}
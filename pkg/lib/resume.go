@@ -0,0 +1,170 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"encoding/json"
+	"reflect"
+
+	"kubepack.dev/lib-helm/pkg/action"
+	"kubepack.dev/lib-helm/pkg/values"
+
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/release"
+	"helm.sh/helm/v3/pkg/releaseutil"
+	"helm.sh/helm/v3/pkg/storage"
+	"helm.sh/helm/v3/pkg/storage/driver"
+	releasesapi "x-helm.dev/apimachinery/apis/releases/v1alpha1"
+)
+
+// releaseRepair is what InstallOrder has to do with the existing release of
+// a package to bring it to the state requested in the Order.
+type releaseRepair string
+
+const (
+	// repairInstall installs a release that does not exist yet.
+	repairInstall releaseRepair = "install"
+	// repairNone keeps a deployed release that is already up to date.
+	repairNone releaseRepair = "none"
+	// repairUpgrade upgrades a deployed or failed release.
+	repairUpgrade releaseRepair = "upgrade"
+	// repairReplace installs over an uninstalled release kept in history.
+	repairReplace releaseRepair = "replace"
+	// repairReinstall finishes uninstalling a release and installs it again.
+	repairReinstall releaseRepair = "reinstall"
+)
+
+// inspectRelease checks the helm release storage for the release of chrt.
+// Releases left in a pending state by an interrupted run are marked failed,
+// so that helm accepts to upgrade them. A release of another chart with the
+// same name is an error.
+func (x *orderInstaller) inspectRelease(chrt *releasesapi.ChartSelection) (releaseRepair, *release.Release, error) {
+	cfg := new(action.Configuration)
+	err := cfg.Init(x.getter, chrt.Namespace, "secret")
+	if err != nil {
+		return "", nil, err
+	}
+	return x.inspectHistory(cfg.Releases, chrt)
+}
+
+// inspectHistory is inspectRelease for the release storage of the
+// namespace of chrt.
+func (x *orderInstaller) inspectHistory(releases *storage.Storage, chrt *releasesapi.ChartSelection) (releaseRepair, *release.Release, error) {
+	history, err := releases.History(chrt.ReleaseName)
+	if errors.Is(err, driver.ErrReleaseNotFound) || (err == nil && len(history) == 0) {
+		return repairInstall, nil, nil
+	} else if err != nil {
+		return "", nil, err
+	}
+	releaseutil.Reverse(history, releaseutil.SortByRevision)
+	last := history[0]
+
+	// never take over a live release of another chart that happens to use
+	// the same name
+	if last.Info.Status != release.StatusUninstalled &&
+		last.Chart != nil && last.Chart.Metadata != nil &&
+		last.Chart.Metadata.Name != chrt.Name {
+		return "", nil, errors.Errorf("release %s/%s exists and was installed from chart %s, not %s", chrt.Namespace, chrt.ReleaseName, last.Chart.Metadata.Name, chrt.Name)
+	}
+
+	switch last.Info.Status {
+	case release.StatusDeployed:
+		ok, err := x.releaseUpToDate(chrt, last)
+		if err != nil {
+			return "", nil, err
+		}
+		if ok {
+			return repairNone, last, nil
+		}
+		return repairUpgrade, last, nil
+	case release.StatusPendingInstall, release.StatusPendingUpgrade, release.StatusPendingRollback:
+		last.SetStatus(release.StatusFailed, "operation was interrupted")
+		err = releases.Update(last)
+		if err != nil {
+			return "", nil, err
+		}
+		return repairUpgrade, last, nil
+	case release.StatusUninstalling:
+		return repairReinstall, last, nil
+	case release.StatusUninstalled:
+		return repairReplace, last, nil
+	default:
+		return repairUpgrade, last, nil
+	}
+}
+
+// releaseUpToDate reports whether a release was deployed from the chart
+// version and with the effective values requested by chrt.
+func (x *orderInstaller) releaseUpToDate(chrt *releasesapi.ChartSelection, rel *release.Release) (bool, error) {
+	if rel.Chart == nil || rel.Chart.Metadata == nil ||
+		rel.Chart.Metadata.Name != chrt.Name ||
+		rel.Chart.Metadata.Version != chrt.Version {
+		return false, nil
+	}
+
+	c, err := x.reg.GetChart(releasesapi.ChartSourceRef{
+		Name:      chrt.Name,
+		Version:   chrt.Version,
+		SourceRef: chrt.SourceRef,
+	})
+	if err != nil {
+		return false, err
+	}
+	opts := values.Options{
+		ValuesFile:  chrt.ValuesFile,
+		ValuesPatch: chrt.ValuesPatch,
+	}
+	vals, err := opts.MergeValues(c.Chart)
+	if err != nil {
+		return false, err
+	}
+	return jsonEqual(vals, rel.Config)
+}
+
+// jsonEqual compares two values after a round trip through JSON, so that
+// numbers and empty maps compare the same way they are stored by helm.
+func jsonEqual(a, b any) (bool, error) {
+	normalize := func(in any) (any, error) {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return nil, err
+		}
+		var out any
+		err = json.Unmarshal(data, &out)
+		return out, err
+	}
+	x, err := normalize(a)
+	if err != nil {
+		return false, err
+	}
+	y, err := normalize(b)
+	if err != nil {
+		return false, err
+	}
+	if isEmptyValues(x) && isEmptyValues(y) {
+		return true, nil
+	}
+	return reflect.DeepEqual(x, y), nil
+}
+
+func isEmptyValues(v any) bool {
+	if v == nil {
+		return true
+	}
+	m, ok := v.(map[string]any)
+	return ok && len(m) == 0
+}
@@ -0,0 +1,227 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"strings"
+	"testing"
+
+	"kubepack.dev/lib-helm/pkg/values"
+
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/release"
+	"helm.sh/helm/v3/pkg/storage"
+	"helm.sh/helm/v3/pkg/storage/driver"
+	"k8s.io/apimachinery/pkg/runtime"
+	releasesapi "x-helm.dev/apimachinery/apis/releases/v1alpha1"
+)
+
+func TestInspectRelease(t *testing.T) {
+	reg, err := NewArchiveRegistry("../../testdata/archives")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref := archiveChartRef("stash", "v0.9.0-rc.6")
+	chrt := &releasesapi.ChartSelection{
+		ChartRef: releasesapi.ChartRef{
+			Name:      ref.Name,
+			SourceRef: ref.SourceRef,
+		},
+		Version:     ref.Version,
+		ReleaseName: "stash",
+		Namespace:   "kube-system",
+		ValuesPatch: &runtime.RawExtension{Raw: []byte(`[{"op":"replace","path":"/replicaCount","value":2}]`)},
+	}
+	c, err := reg.GetChart(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := values.Options{ValuesPatch: chrt.ValuesPatch}
+	vals, err := opts.MergeValues(c.Chart)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rel := func(version int, name, chartVersion string, status release.Status, config map[string]any) *release.Release {
+		return &release.Release{
+			Name:      "stash",
+			Namespace: "kube-system",
+			Version:   version,
+			Info:      &release.Info{Status: status},
+			Chart: &chart.Chart{
+				Metadata: &chart.Metadata{Name: name, Version: chartVersion},
+			},
+			Config: config,
+		}
+	}
+	changed := map[string]any{}
+	for k, v := range vals {
+		changed[k] = v
+	}
+	changed["replicaCount"] = 3
+
+	cases := []struct {
+		name       string
+		history    []*release.Release
+		want       releaseRepair
+		wantStatus release.Status
+		wantErr    string
+	}{
+		{
+			name: "not installed",
+			want: repairInstall,
+		},
+		{
+			name: "deployed and up to date",
+			history: []*release.Release{
+				rel(1, "stash", "v0.9.0-rc.5", release.StatusSuperseded, nil),
+				rel(2, "stash", "v0.9.0-rc.6", release.StatusDeployed, vals),
+			},
+			want:       repairNone,
+			wantStatus: release.StatusDeployed,
+		},
+		{
+			name: "changed values",
+			history: []*release.Release{
+				rel(1, "stash", "v0.9.0-rc.6", release.StatusDeployed, changed),
+			},
+			want:       repairUpgrade,
+			wantStatus: release.StatusDeployed,
+		},
+		{
+			name: "changed version",
+			history: []*release.Release{
+				rel(1, "stash", "v0.9.0-rc.5", release.StatusDeployed, vals),
+			},
+			want:       repairUpgrade,
+			wantStatus: release.StatusDeployed,
+		},
+		{
+			// an interrupted run is marked failed, so helm accepts to upgrade it
+			name: "pending",
+			history: []*release.Release{
+				rel(1, "stash", "v0.9.0-rc.6", release.StatusDeployed, vals),
+				rel(2, "stash", "v0.9.0-rc.6", release.StatusPendingUpgrade, changed),
+			},
+			want:       repairUpgrade,
+			wantStatus: release.StatusFailed,
+		},
+		{
+			name: "failed",
+			history: []*release.Release{
+				rel(1, "stash", "v0.9.0-rc.6", release.StatusFailed, vals),
+			},
+			want:       repairUpgrade,
+			wantStatus: release.StatusFailed,
+		},
+		{
+			name: "uninstalling",
+			history: []*release.Release{
+				rel(1, "stash", "v0.9.0-rc.6", release.StatusUninstalling, vals),
+			},
+			want:       repairReinstall,
+			wantStatus: release.StatusUninstalling,
+		},
+		{
+			name: "uninstalled",
+			history: []*release.Release{
+				rel(1, "other", "1.0.0", release.StatusUninstalled, nil),
+			},
+			want:       repairReplace,
+			wantStatus: release.StatusUninstalled,
+		},
+		{
+			name: "release of another chart",
+			history: []*release.Release{
+				rel(1, "other", "1.0.0", release.StatusDeployed, nil),
+			},
+			wantErr: "release kube-system/stash exists and was installed from chart other, not stash",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			releases := storage.Init(driver.NewMemory())
+			for _, r := range c.history {
+				err := releases.Create(r)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			x := &orderInstaller{reg: reg}
+			got, last, err := x.inspectHistory(releases, chrt)
+			if c.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), c.wantErr) {
+					t.Fatalf("got error %v, want %q", err, c.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != c.want {
+				t.Errorf("got repair %s, want %s", got, c.want)
+			}
+			if len(c.history) == 0 {
+				if last != nil {
+					t.Errorf("got last release %v, want none", last)
+				}
+				return
+			}
+			if last == nil || last.Version != len(c.history) {
+				t.Fatalf("got last release %v, want revision %d", last, len(c.history))
+			}
+			stored, err := releases.Get(chrt.ReleaseName, last.Version)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored.Info.Status != c.wantStatus {
+				t.Errorf("got stored status %s, want %s", stored.Info.Status, c.wantStatus)
+			}
+		})
+	}
+}
+
+func TestJSONEqual(t *testing.T) {
+	cases := []struct {
+		name string
+		a, b any
+		want bool
+	}{
+		{name: "nil and empty", a: nil, b: map[string]any{}, want: true},
+		{name: "number types", a: map[string]any{"a": 1}, b: map[string]any{"a": 1.0}, want: true},
+		{
+			name: "nested",
+			a:    map[string]any{"a": map[string]any{"b": []any{"x"}}},
+			b:    map[string]any{"a": map[string]any{"b": []string{"x"}}},
+			want: true,
+		},
+		{name: "different", a: map[string]any{"a": 1}, b: map[string]any{"a": 2}},
+		{name: "empty and set", a: map[string]any{}, b: map[string]any{"a": nil}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := jsonEqual(c.a, c.b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != c.want {
+				t.Errorf("got equal %v, want %v", got, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"kubepack.dev/lib-helm/pkg/action"
+
+	kerr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	driversapi "x-helm.dev/apimachinery/apis/drivers/v1alpha1"
+	releasesapi "x-helm.dev/apimachinery/apis/releases/v1alpha1"
+)
+
+type installedRelease struct {
+	Chart *releasesapi.ChartSelection
+	App   *driversapi.AppRelease
+}
+
+type RollbackFailure struct {
+	Release types.NamespacedName
+	Err     error
+}
+
+// RollbackError is returned by InstallOrder in atomic mode. Err holds the
+// errors of the packages that failed to install.
+type RollbackError struct {
+	Err        error
+	RolledBack []types.NamespacedName
+	Failed     []RollbackFailure
+}
+
+func (e *RollbackError) Error() string {
+	var sb strings.Builder
+	_, _ = fmt.Fprintf(&sb, "failed to install order: %v", e.Err)
+	if len(e.RolledBack) > 0 {
+		names := make([]string, 0, len(e.RolledBack))
+		for _, r := range e.RolledBack {
+			names = append(names, r.String())
+		}
+		_, _ = fmt.Fprintf(&sb, "; rolled back %s", strings.Join(names, ", "))
+	}
+	for _, f := range e.Failed {
+		_, _ = fmt.Fprintf(&sb, "; failed to roll back %s: %v", f.Release, f.Err)
+	}
+	return sb.String()
+}
+
+func (e *RollbackError) Unwrap() error {
+	return e.Err
+}
+
+// rollbackReleases uninstalls the installed releases in reverse order using
+// uninstall and records their phases in status.
+func rollbackReleases(installed []*installedRelease, cause error, status *orderStatusRecorder, uninstall func(r *installedRelease) error) error {
+	out := &RollbackError{
+		Err: cause,
+	}
+	for i := len(installed) - 1; i >= 0; i-- {
+		rls := types.NamespacedName{
+			Namespace: installed[i].Chart.Namespace,
+			Name:      installed[i].Chart.ReleaseName,
+		}
+		if err := uninstall(installed[i]); err != nil {
+			out.Failed = append(out.Failed, RollbackFailure{Release: rls, Err: err})
+			status.setPhase(installed[i].Chart, PackageFailed, fmt.Errorf("failed to roll back: %w", err))
+		} else {
+			out.RolledBack = append(out.RolledBack, rls)
+			status.setPhase(installed[i].Chart, PackageRolledBack, cause)
+		}
+	}
+	return out
+}
+
+func uninstallRelease(getter genericclioptions.RESTClientGetter, kc client.Client, r *installedRelease) error {
+	if r.App != nil {
+		err := kc.Delete(context.TODO(), r.App)
+		if err != nil && !kerr.IsNotFound(err) {
+			return err
+		}
+	}
+
+	f1, err := action.NewUninstaller(getter, r.Chart.Namespace, "secret")
+	if err != nil {
+		return err
+	}
+	f1.WithReleaseName(r.Chart.ReleaseName)
+	return f1.Do()
+}
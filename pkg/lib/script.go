@@ -16,9 +16,46 @@ limitations under the License.
 
 package lib
 
+import "time"
+
 type ScriptOptions struct {
 	DisableAppReleaseCRD bool
 	OsIndependentScript  bool
+	// SelfContained embeds every manifest, CRD and AppRelease in the
+	// generated scripts instead of uploading them, so that no BlobStore is
+	// needed and the scripts don't download anything but charts.
+	SelfContained bool
+	// Atomic uninstalls the packages already installed by an order
+	// if a later package fails to install.
+	Atomic bool
+	// MaxConcurrency is the number of packages that InstallOrder installs in
+	// parallel. Packages are only installed after the packages they depend on.
+	MaxConcurrency int
+	// Timeout limits how long uninstalling a package waits for the objects of
+	// its release to be deleted. It applies to UninstallOrder, to packages
+	// removed by UpgradeOrder and to releases that InstallOrder finds
+	// half uninstalled and reinstalls.
+	Timeout time.Duration
+	// StatusHandler is called by InstallOrder every time the status of a
+	// package changes.
+	StatusHandler func(status OrderStatus)
+	// DryRun makes InstallOrder and UpgradeOrder check the rendered objects
+	// of the packages they would install or upgrade using server-side dry-run
+	// instead of changing the cluster. If any check fails, they return a
+	// *DryRunError holding the report.
+	DryRun bool
+	// DryRunHandler is called with the result of a dry run.
+	DryRunHandler func(report DryRunReport)
+	// Lock pins the charts of the order to the versions and digests
+	// recorded when the order was created.
+	Lock *OrderLock
+	// DeleteCRDs makes GenerateUninstallScript delete the CRDs shipped by
+	// the charts of the order.
+	DeleteCRDs bool
+	// DeleteNamespaces are the namespaces deleted by GenerateUninstallScript.
+	// Each must be the namespace of a package of the order and not a builtin
+	// one. Namespaces shared with other workloads must not be listed.
+	DeleteNamespaces []string
 }
 
 type ScriptOption interface {
@@ -38,3 +75,52 @@ var DisableAppReleaseCRD = ScriptOptionFunc(func(opt *ScriptOptions) {
 var OsIndependentScript = ScriptOptionFunc(func(opt *ScriptOptions) {
 	opt.OsIndependentScript = true
 })
+
+var SelfContainedScript = ScriptOptionFunc(func(opt *ScriptOptions) {
+	opt.SelfContained = true
+})
+
+var AtomicInstall = ScriptOptionFunc(func(opt *ScriptOptions) {
+	opt.Atomic = true
+})
+
+var DeleteCRDs = ScriptOptionFunc(func(opt *ScriptOptions) {
+	opt.DeleteCRDs = true
+})
+
+func WithDeleteNamespaces(namespaces ...string) ScriptOption {
+	return ScriptOptionFunc(func(opt *ScriptOptions) {
+		opt.DeleteNamespaces = namespaces
+	})
+}
+
+func WithMaxConcurrency(n int) ScriptOption {
+	return ScriptOptionFunc(func(opt *ScriptOptions) {
+		opt.MaxConcurrency = n
+	})
+}
+
+func WithTimeout(d time.Duration) ScriptOption {
+	return ScriptOptionFunc(func(opt *ScriptOptions) {
+		opt.Timeout = d
+	})
+}
+
+func WithStatusHandler(fn func(status OrderStatus)) ScriptOption {
+	return ScriptOptionFunc(func(opt *ScriptOptions) {
+		opt.StatusHandler = fn
+	})
+}
+
+func WithDryRun(fn func(report DryRunReport)) ScriptOption {
+	return ScriptOptionFunc(func(opt *ScriptOptions) {
+		opt.DryRun = true
+		opt.DryRunHandler = fn
+	})
+}
+
+func WithLock(lock *OrderLock) ScriptOption {
+	return ScriptOptionFunc(func(opt *ScriptOptions) {
+		opt.Lock = lock
+	})
+}
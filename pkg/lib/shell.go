@@ -0,0 +1,250 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	releasesapi "x-helm.dev/apimachinery/apis/releases/v1alpha1"
+)
+
+// Shell is the shell that the printers write commands for.
+type Shell string
+
+const (
+	// ShellSh writes POSIX shell commands, used for Linux and MacOS.
+	ShellSh Shell = ""
+	// ShellPowerShell writes PowerShell commands, used for Windows.
+	ShellPowerShell Shell = "powershell"
+)
+
+// lineContinuation returns the characters that continue a command on the
+// next line.
+func (s Shell) lineContinuation() string {
+	if s == ShellPowerShell {
+		return " `\n"
+	}
+	return " \\\n"
+}
+
+// psQuote quotes s as a PowerShell verbatim string, so that characters
+// such as $, `, commas and braces are passed to native commands as is.
+func psQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// shQuote quotes s as a single-quoted sh word.
+func shQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// shUnquote removes the sh quotes and escapes of a word, eg, of the values
+// returned by values.GetChangedValues, so that it can be quoted for another
+// shell.
+func shUnquote(s string) string {
+	var buf strings.Builder
+	var quote rune
+	escaped := false
+	for _, r := range s {
+		switch {
+		case escaped:
+			if quote == '"' && !strings.ContainsRune("$`\"\\\n", r) {
+				buf.WriteRune('\\')
+			}
+			buf.WriteRune(r)
+			escaped = false
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				buf.WriteRune(r)
+			}
+		case r == '\\':
+			escaped = true
+		case quote == '"':
+			if r == '"' {
+				quote = 0
+			} else {
+				buf.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+		default:
+			buf.WriteRune(r)
+		}
+	}
+	return buf.String()
+}
+
+// scriptWriter is the writer of the script generated for a shell.
+type scriptWriter struct {
+	Shell Shell
+	W     io.Writer
+}
+
+// scriptWriters returns the writers of the generated scripts. The
+// PowerShell script is skipped for OS independent scripts.
+func scriptWriters(sh, ps io.Writer, opts ScriptOptions) []scriptWriter {
+	out := []scriptWriter{{Shell: ShellSh, W: sh}}
+	if !opts.OsIndependentScript {
+		out = append(out, scriptWriter{Shell: ShellPowerShell, W: ps})
+	}
+	return out
+}
+
+// allScripts returns a writer that writes to every script. It is used for
+// commands that are the same in every shell, so that objects are uploaded
+// only once.
+func allScripts(writers []scriptWriter) io.Writer {
+	ws := make([]io.Writer, 0, len(writers))
+	for _, sw := range writers {
+		ws = append(ws, sw.W)
+	}
+	return io.MultiWriter(ws...)
+}
+
+// manifestWriters returns the writers used by the printers that upload
+// objects. Their commands are the same in every shell, unless the objects
+// are embedded in self-contained scripts.
+func manifestWriters(writers []scriptWriter, opts ScriptOptions) []scriptWriter {
+	if opts.SelfContained {
+		return writers
+	}
+	return []scriptWriter{{Shell: ShellSh, W: allScripts(writers)}}
+}
+
+// printInline prints cmd, eg, kubectl apply -f -, reading a manifest that
+// is embedded in the script.
+func (s Shell) printInline(w io.Writer, cmd string, data []byte) error {
+	doc := strings.TrimSuffix(string(data), "\n")
+	if s == ShellPowerShell {
+		// A verbatim here-string can't contain its terminator.
+		if strings.HasPrefix(doc, "'@") || strings.Contains(doc, "\n'@") {
+			return fmt.Errorf("can't embed manifest with a line starting with '@ in a PowerShell script")
+		}
+		_, err := fmt.Fprintf(w, "@'\n%s\n'@ | %s\n", doc, cmd)
+		return err
+	}
+
+	delim := "EOF"
+	for i := 1; strings.Contains("\n"+doc+"\n", "\n"+delim+"\n"); i++ {
+		delim = fmt.Sprintf("EOF_%d", i)
+	}
+	_, err := fmt.Fprintf(w, "%s <<'%s'\n%s\n%s\n", cmd, delim, doc, delim)
+	return err
+}
+
+// printChartDownload prints the commands that download a chart archive to
+// file and stop the script unless the archive has the sha256 digest.
+func (s Shell) printChartDownload(w io.Writer, archiveURL, file, digest string) error {
+	var err error
+	if s == ShellPowerShell {
+		_, err = fmt.Fprintf(w, "Invoke-WebRequest -Uri %s -OutFile %s\n", psQuote(archiveURL), psQuote(file))
+	} else {
+		_, err = fmt.Fprintf(w, "curl -fsSL -o %s %s || exit 1\n", shQuote(file), shQuote(archiveURL))
+	}
+	if err != nil {
+		return err
+	}
+	return s.printChartCheck(w, file, digest)
+}
+
+// printChartCheck prints the command that stops the script unless the chart
+// archive file has the sha256 digest.
+func (s Shell) printChartCheck(w io.Writer, file, digest string) error {
+	if s == ShellPowerShell {
+		_, err := fmt.Fprintf(w, "if ((Get-FileHash -Algorithm SHA256 %s).Hash -ne %s) { throw %s }\n",
+			psQuote(file), psQuote(digest), psQuote("digest of chart archive "+file+" changed"))
+		return err
+	}
+
+	// macOS ships shasum, but not always sha256sum
+	check := shQuote(digest + "  " + file)
+	_, err := fmt.Fprintf(w, "if command -v sha256sum >/dev/null; then echo %s | sha256sum -c -; else echo %s | shasum -a 256 -c -; fi || exit 1\n", check, check)
+	return err
+}
+
+// scriptRefs returns the scripts of an order. Unless the scripts are OS
+// independent or self-contained, they are uploaded as <name>.sh and
+// <name>.ps1 along with the commands that run them.
+func scriptRefs(bs *BlobStore, order releasesapi.Order, name, script, psScript string, opts ScriptOptions) ([]ScriptRef, error) {
+	if opts.OsIndependentScript {
+		return []ScriptRef{
+			{
+				OS:      Neutral,
+				URL:     "",
+				Command: "",
+				Script:  strings.TrimSpace(script),
+			},
+		}, nil
+	}
+	if opts.SelfContained {
+		return []ScriptRef{
+			{OS: Linux, Script: script},
+			{OS: MacOS, Script: script},
+			{OS: Windows, Script: psScript},
+		}, nil
+	}
+
+	err := bs.WriteFile(context.TODO(), path.Join(string(order.UID), name+".sh"), []byte(script))
+	if err != nil {
+		return nil, err
+	}
+	err = bs.WriteFile(context.TODO(), path.Join(string(order.UID), name+".ps1"), []byte(psScript))
+	if err != nil {
+		return nil, err
+	}
+
+	scriptURL := fmt.Sprintf("%s/%s/%s.sh", bs.Host, order.UID, name)
+	psScriptURL := fmt.Sprintf("%s/%s/%s.ps1", bs.Host, order.UID, name)
+	return []ScriptRef{
+		{
+			OS:      Linux,
+			URL:     scriptURL,
+			Command: fmt.Sprintf("curl -fsSL %s | bash", scriptURL),
+			Script:  script,
+		},
+		{
+			OS:      MacOS,
+			URL:     scriptURL,
+			Command: fmt.Sprintf("curl -fsSL %s | bash", scriptURL),
+			Script:  script,
+		},
+		{
+			OS:      Windows,
+			URL:     psScriptURL,
+			Command: fmt.Sprintf("iwr -useb %s | iex", psScriptURL),
+			Script:  psScript,
+		},
+	}, nil
+}
+
+// scriptBlobStore returns the BlobStore used to generate a script. It may
+// only be nil for self-contained scripts, that don't upload anything.
+func scriptBlobStore(bs *BlobStore, opts ScriptOptions) (*BlobStore, error) {
+	if bs != nil {
+		return bs, nil
+	}
+	if !opts.SelfContained {
+		return nil, fmt.Errorf("a BlobStore is required unless the script is self-contained")
+	}
+	return &BlobStore{}, nil
+}
@@ -0,0 +1,182 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	"kubepack.dev/lib-helm/pkg/repo"
+
+	"gomodules.xyz/blobfs"
+	releasesapi "x-helm.dev/apimachinery/apis/releases/v1alpha1"
+)
+
+func TestShUnquote(t *testing.T) {
+	cases := []struct {
+		in   string
+		want string
+	}{
+		{in: `plain`, want: `plain`},
+		{in: `'single quoted'`, want: `single quoted`},
+		{in: `"double quoted"`, want: `double quoted`},
+		{in: `a\ b`, want: `a b`},
+		{in: `'it'\''s'`, want: `it's`},
+		{in: `'$(v) \n'`, want: `$(v) \n`},
+		{in: `"\$HOME \"x\" \\ \n"`, want: `$HOME "x" \ \n`},
+		{in: `key='a,b'.c="d"`, want: `key=a,b.c=d`},
+		{in: `"it's"`, want: `it's`},
+		{in: `''`, want: ``},
+	}
+	for _, c := range cases {
+		t.Run(c.in, func(t *testing.T) {
+			if got := shUnquote(c.in); got != c.want {
+				t.Errorf("got %q, want %q", got, c.want)
+			}
+			// quoting the result again gives the same word
+			if got := shUnquote(shQuote(c.want)); got != c.want {
+				t.Errorf("round trip: got %q, want %q", got, c.want)
+			}
+		})
+	}
+}
+
+func TestPrintInline(t *testing.T) {
+	cases := []struct {
+		name    string
+		shell   Shell
+		data    string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "sh",
+			data: "kind: ConfigMap\n",
+			want: "kubectl apply -f - <<'EOF'\nkind: ConfigMap\nEOF\n",
+		},
+		{
+			name: "sh with EOF line",
+			data: "a\nEOF\nEOF_1\nb\n",
+			want: "kubectl apply -f - <<'EOF_2'\na\nEOF\nEOF_1\nb\nEOF_2\n",
+		},
+		{
+			name: "sh keeps a line containing EOF",
+			data: "x: EOF\n",
+			want: "kubectl apply -f - <<'EOF'\nx: EOF\nEOF\n",
+		},
+		{
+			name:  "powershell",
+			shell: ShellPowerShell,
+			data:  "x: '$y'\n",
+			want:  "@'\nx: '$y'\n'@ | kubectl apply -f -\n",
+		},
+		{
+			name:    "powershell with terminator",
+			shell:   ShellPowerShell,
+			data:    "a\n'@ b\n",
+			wantErr: true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			err := c.shell.printInline(&buf, "kubectl apply -f -", []byte(c.data))
+			if c.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := buf.String(); got != c.want {
+				t.Errorf("got\n%s\nwant\n%s", got, c.want)
+			}
+		})
+	}
+}
+
+func TestSelfContainedScript(t *testing.T) {
+	reg, err := NewArchiveRegistry("../../testdata/archives")
+	if err != nil {
+		t.Fatal(err)
+	}
+	order := stashOrder(t, "59060c795cb2ff4109ef9cbfb44cca9d3670be44a4089fe0047d1da9a4242355")
+	order.UID = "demo"
+
+	generators := []struct {
+		name     string
+		generate func(bs *BlobStore, reg repo.IRegistry, order releasesapi.Order, opts ...ScriptOption) ([]ScriptRef, error)
+	}{
+		{"yaml", GenerateYAMLScript},
+		{"helm3", GenerateHelm3Script},
+	}
+	for _, g := range generators {
+		t.Run(g.name, func(t *testing.T) {
+			_, err := g.generate(nil, reg, order)
+			if err == nil {
+				t.Error("generated a script that uploads manifests without a BlobStore")
+			}
+
+			dir := t.TempDir()
+			store := &BlobStore{
+				Host:      "https://blobs.example.com",
+				Bucket:    "file://" + dir,
+				Interface: blobfs.New("file://" + dir),
+			}
+			for _, bs := range []*BlobStore{nil, store} {
+				scripts, err := g.generate(bs, reg, order, SelfContainedScript)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				want := map[OS][]string{
+					Linux:   {"kubectl apply -f - <<'EOF'\n", "\nkind: AppRelease\n", "\nEOF\n"},
+					MacOS:   {"kubectl apply -f - <<'EOF'\n", "\nkind: AppRelease\n", "\nEOF\n"},
+					Windows: {"@'\n", "\nkind: AppRelease\n", "\n'@ | kubectl apply -f -\n"},
+				}
+				if len(scripts) != len(want) {
+					t.Fatalf("got %d scripts, want one per OS", len(scripts))
+				}
+				for _, script := range scripts {
+					if script.URL != "" || script.Command != "" {
+						t.Errorf("got %s script at %q run by %q, want it embedded", script.OS, script.URL, script.Command)
+					}
+					for _, s := range want[script.OS] {
+						if !strings.Contains(script.Script, s) {
+							t.Errorf("%s script does not contain %q:\n%s", script.OS, s, script.Script)
+						}
+					}
+					if strings.Contains(script.Script, store.Host) {
+						t.Errorf("%s script refers to an upload:\n%s", script.OS, script.Script)
+					}
+				}
+			}
+
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 0 {
+				t.Errorf("got %d uploaded files, want none", len(entries))
+			}
+		})
+	}
+}
@@ -0,0 +1,251 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	kmapi "kmodules.xyz/client-go/api/v1"
+	releasesapi "x-helm.dev/apimachinery/apis/releases/v1alpha1"
+)
+
+type PackagePhase string
+
+const (
+	PackagePending    PackagePhase = "Pending"
+	PackageInstalling PackagePhase = "Installing"
+	PackageWaiting    PackagePhase = "Waiting"
+	PackageReady      PackagePhase = "Ready"
+	PackageFailed     PackagePhase = "Failed"
+	// PackageSkipped is the phase of a package that was not installed since
+	// a package it depends on failed or the atomic install stopped.
+	PackageSkipped PackagePhase = "Skipped"
+	// PackageRolledBack is the phase of a package that was installed and
+	// then uninstalled by the rollback of an atomic install.
+	PackageRolledBack PackagePhase = "RolledBack"
+)
+
+const (
+	ConditionProgressing kmapi.ConditionType = "Progressing"
+
+	ReasonInstalling     = "Installing"
+	ReasonInstalled      = "Installed"
+	ReasonPackageFailed  = "PackageFailed"
+	ReasonPackagePending = "PackagePending"
+)
+
+// PackageStatus records the progress of a single package of an Order.
+type PackageStatus struct {
+	releasesapi.ChartRef `json:",inline"`
+	Version              string       `json:"version"`
+	ReleaseName          string       `json:"releaseName"`
+	Namespace            string       `json:"namespace"`
+	Phase                PackagePhase `json:"phase"`
+	StartTime            *metav1.Time `json:"startTime,omitempty"`
+	CompletionTime       *metav1.Time `json:"completionTime,omitempty"`
+	// Revision is the helm release revision.
+	Revision  int    `json:"revision,omitempty"`
+	LastError string `json:"lastError,omitempty"`
+}
+
+// OrderStatus extends releasesapi.OrderStatus with the status of every
+// package of the Order.
+type OrderStatus struct {
+	releasesapi.OrderStatus `json:",inline"`
+	Packages                []PackageStatus  `json:"packages,omitempty"`
+	Conditions              kmapi.Conditions `json:"conditions,omitempty"`
+}
+
+type orderStatusRecorder struct {
+	status OrderStatus
+	index  map[types.NamespacedName]int
+	fn     func(OrderStatus)
+	m      sync.Mutex
+	// nm serializes the calls of fn, which are made without holding m.
+	nm sync.Mutex
+}
+
+func newOrderStatusRecorder(order releasesapi.Order, fn func(OrderStatus)) *orderStatusRecorder {
+	r := &orderStatusRecorder{
+		status: OrderStatus{
+			OrderStatus: releasesapi.OrderStatus{
+				ObservedGeneration: order.Generation,
+			},
+		},
+		index: map[types.NamespacedName]int{},
+		fn:    fn,
+	}
+	for _, pkg := range order.Spec.Packages {
+		if pkg.Chart == nil {
+			continue
+		}
+		r.index[releaseKey(pkg.Chart)] = len(r.status.Packages)
+		r.status.Packages = append(r.status.Packages, PackageStatus{
+			ChartRef:    pkg.Chart.ChartRef,
+			Version:     pkg.Chart.Version,
+			ReleaseName: pkg.Chart.ReleaseName,
+			Namespace:   pkg.Chart.Namespace,
+			Phase:       PackagePending,
+		})
+	}
+	r.setCondition(kmapi.Condition{
+		Type:   ConditionProgressing,
+		Status: metav1.ConditionTrue,
+		Reason: ReasonInstalling,
+	})
+	r.setCondition(kmapi.Condition{
+		Type:   kmapi.ReadyCondition,
+		Status: metav1.ConditionUnknown,
+		Reason: ReasonInstalling,
+	})
+	r.notify()
+	return r
+}
+
+func (r *orderStatusRecorder) setPhase(chrt *releasesapi.ChartSelection, phase PackagePhase, err error) {
+	if r == nil {
+		return
+	}
+
+	r.m.Lock()
+	i, ok := r.index[releaseKey(chrt)]
+	if !ok {
+		r.m.Unlock()
+		return
+	}
+	s := &r.status.Packages[i]
+	now := metav1.Now()
+	s.Phase = phase
+	switch phase {
+	case PackageInstalling:
+		s.StartTime = &now
+		s.CompletionTime = nil
+		s.LastError = ""
+	case PackageReady:
+		s.CompletionTime = &now
+	case PackageFailed, PackageSkipped, PackageRolledBack:
+		s.CompletionTime = &now
+		if err != nil {
+			s.LastError = err.Error()
+		}
+	}
+	r.m.Unlock()
+	r.notify()
+}
+
+func (r *orderStatusRecorder) setRevision(chrt *releasesapi.ChartSelection, revision int) {
+	if r == nil {
+		return
+	}
+
+	r.m.Lock()
+	i, ok := r.index[releaseKey(chrt)]
+	if ok {
+		r.status.Packages[i].Revision = revision
+	}
+	r.m.Unlock()
+	if ok {
+		r.notify()
+	}
+}
+
+// finish summarizes the package phases in the order conditions.
+func (r *orderStatusRecorder) finish(err error) {
+	if r == nil {
+		return
+	}
+
+	r.m.Lock()
+	var failed, pending []string
+	for _, s := range r.status.Packages {
+		switch s.Phase {
+		case PackageFailed:
+			failed = append(failed, s.Namespace+"/"+s.ReleaseName)
+		case PackageReady:
+		default:
+			pending = append(pending, s.Namespace+"/"+s.ReleaseName)
+		}
+	}
+
+	ready := kmapi.Condition{
+		Type:   kmapi.ReadyCondition,
+		Status: metav1.ConditionTrue,
+		Reason: ReasonInstalled,
+	}
+	if len(failed) > 0 {
+		ready.Status = metav1.ConditionFalse
+		ready.Severity = kmapi.ConditionSeverityError
+		ready.Reason = ReasonPackageFailed
+		ready.Message = fmt.Sprintf("failed to install %s", strings.Join(failed, ", "))
+	} else if len(pending) > 0 || err != nil {
+		ready.Status = metav1.ConditionFalse
+		ready.Severity = kmapi.ConditionSeverityWarning
+		ready.Reason = ReasonPackagePending
+		ready.Message = fmt.Sprintf("not installed %s", strings.Join(pending, ", "))
+	}
+	if err != nil {
+		ready.Message = err.Error()
+	}
+	r.setCondition(ready)
+	r.setCondition(kmapi.Condition{
+		Type:   ConditionProgressing,
+		Status: metav1.ConditionFalse,
+		Reason: ready.Reason,
+	})
+	r.m.Unlock()
+	r.notify()
+}
+
+func (r *orderStatusRecorder) setCondition(c kmapi.Condition) {
+	c.ObservedGeneration = r.status.ObservedGeneration
+	c.LastTransitionTime = metav1.Now()
+	for i := range r.status.Conditions {
+		if r.status.Conditions[i].Type == c.Type {
+			if r.status.Conditions[i].Status == c.Status {
+				c.LastTransitionTime = r.status.Conditions[i].LastTransitionTime
+			}
+			r.status.Conditions[i] = c
+			return
+		}
+	}
+	r.status.Conditions = append(r.status.Conditions, c)
+}
+
+// notify calls the status handler with a copy of the current status. It
+// must be called without holding the lock, so that a slow handler does
+// not block the recording of other packages. Since the copy
+// is taken after the previous call returned, the handler never sees an
+// older status after a newer one.
+func (r *orderStatusRecorder) notify() {
+	if r.fn == nil {
+		return
+	}
+
+	r.nm.Lock()
+	defer r.nm.Unlock()
+
+	r.m.Lock()
+	out := r.status
+	out.Packages = append([]PackageStatus(nil), r.status.Packages...)
+	out.Conditions = append(kmapi.Conditions(nil), r.status.Conditions...)
+	r.m.Unlock()
+	r.fn(out)
+}
@@ -0,0 +1,187 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kmapi "kmodules.xyz/client-go/api/v1"
+	releasesapi "x-helm.dev/apimachinery/apis/releases/v1alpha1"
+)
+
+func TestInstallPackagesAtomicStatus(t *testing.T) {
+	cases := []struct {
+		name         string
+		uninstallErr error
+		want         map[string]PackagePhase
+		wantErrs     map[string]string
+	}{
+		{
+			name: "rolled back",
+			want: map[string]PackagePhase{
+				"a": PackageRolledBack,
+				"b": PackageFailed,
+				"c": PackageSkipped,
+				"d": PackageSkipped,
+			},
+			wantErrs: map[string]string{
+				"a": "b failed",
+				"b": "b failed",
+				"c": "skipped since dependency ns/b failed",
+				"d": "skipped since the install stopped after a failure",
+			},
+		},
+		{
+			name:         "rollback failed",
+			uninstallErr: errors.New("uninstall failed"),
+			want: map[string]PackagePhase{
+				"a": PackageFailed,
+				"b": PackageFailed,
+				"c": PackageSkipped,
+				"d": PackageSkipped,
+			},
+			wantErrs: map[string]string{
+				"a": "failed to roll back: uninstall failed",
+			},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			order := releasesapi.Order{
+				Spec: releasesapi.OrderSpec{
+					Packages: []releasesapi.PackageSelection{
+						testPackage("a", nil, nil),
+						testPackage("b", []string{"foos.example.com"}, nil),
+						testPackage("c", nil, []string{"foos.example.com"}),
+						testPackage("d", nil, nil),
+					},
+				},
+			}
+			g, err := newPackageGraph(order.Spec.Packages)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var status OrderStatus
+			recorder := newOrderStatusRecorder(order, func(s OrderStatus) { status = s })
+			var installed []*installedRelease
+			install := func(chrt *releasesapi.ChartSelection) error {
+				installed = append(installed, &installedRelease{Chart: chrt})
+				if chrt.ReleaseName == "b" {
+					return errors.New("b failed")
+				}
+				recorder.setPhase(chrt, PackageReady, nil)
+				return nil
+			}
+			rollback := func(cause error) error {
+				// b failed to install, so only a is rolled back
+				return rollbackReleases(installed[:1], cause, recorder, func(r *installedRelease) error {
+					return c.uninstallErr
+				})
+			}
+			err = installPackages(g, order, ScriptOptions{Atomic: true}, recorder, install, rollback)
+			var rerr *RollbackError
+			if !errors.As(err, &rerr) {
+				t.Fatalf("got error %v, want a RollbackError", err)
+			}
+
+			for _, s := range status.Packages {
+				if s.Phase != c.want[s.ReleaseName] {
+					t.Errorf("package %s: got phase %s, want %s", s.ReleaseName, s.Phase, c.want[s.ReleaseName])
+				}
+				if s.CompletionTime == nil {
+					t.Errorf("package %s: got no completion time", s.ReleaseName)
+				}
+				if want, ok := c.wantErrs[s.ReleaseName]; ok && !strings.Contains(s.LastError, want) {
+					t.Errorf("package %s: got error %q, want it to contain %q", s.ReleaseName, s.LastError, want)
+				}
+			}
+			var ready kmapi.Condition
+			for _, cond := range status.Conditions {
+				if cond.Type == kmapi.ReadyCondition {
+					ready = cond
+				}
+			}
+			if ready.Status != metav1.ConditionFalse || ready.Reason != ReasonPackageFailed {
+				t.Errorf("got Ready condition %s/%s, want False/%s", ready.Status, ready.Reason, ReasonPackageFailed)
+			}
+		})
+	}
+}
+
+func TestOrderStatusRecorderNotifyUnlocked(t *testing.T) {
+	order := releasesapi.Order{
+		Spec: releasesapi.OrderSpec{
+			Packages: []releasesapi.PackageSelection{
+				testPackage("a", nil, nil),
+				testPackage("b", nil, nil),
+			},
+		},
+	}
+	a, b := order.Spec.Packages[0].Chart, order.Spec.Packages[1].Chart
+
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	var blocked bool
+	var last OrderStatus
+	recorder := newOrderStatusRecorder(order, func(s OrderStatus) {
+		if s.Packages[0].Phase == PackageInstalling && !blocked {
+			blocked = true
+			close(entered)
+			<-release
+		}
+		last = s
+	})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		recorder.setPhase(a, PackageInstalling, nil)
+	}()
+	<-entered
+
+	// the blocked handler must not keep b from being recorded
+	recorded := make(chan struct{})
+	go func() {
+		defer close(recorded)
+		recorder.setPhase(b, PackageReady, nil)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		recorder.m.Lock()
+		phase := recorder.status.Packages[1].Phase
+		recorder.m.Unlock()
+		if phase == PackageReady {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("status of b was not recorded while the handler was blocked")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	close(release)
+	<-done
+	<-recorded
+	if got := []PackagePhase{last.Packages[0].Phase, last.Packages[1].Phase}; got[0] != PackageInstalling || got[1] != PackageReady {
+		t.Errorf("got last notified phases %v, want [%s %s]", got, PackageInstalling, PackageReady)
+	}
+}
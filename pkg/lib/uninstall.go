@@ -0,0 +1,512 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"kubepack.dev/lib-helm/pkg/repo"
+	"kubepack.dev/lib-helm/pkg/values"
+
+	"gocloud.dev/blob"
+	kerr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
+	"k8s.io/client-go/dynamic"
+	"kmodules.xyz/client-go/tools/parser"
+	"x-helm.dev/apimachinery/apis"
+	releasesapi "x-helm.dev/apimachinery/apis/releases/v1alpha1"
+)
+
+// DefaultUninstallTimeout is the time UninstallOrder waits for the objects
+// of a release to be deleted, unless overridden using WithTimeout.
+const DefaultUninstallTimeout = 5 * time.Minute
+
+const resourcePolicyAnnotation = "helm.sh/resource-policy"
+
+type StuckResource struct {
+	Resource          schema.GroupVersionResource
+	Namespace         string
+	Name              string
+	Finalizers        []string
+	DeletionTimestamp *metav1.Time
+}
+
+func (r StuckResource) String() string {
+	name := r.Resource.GroupResource().String() + "/" + r.Name
+	if r.Namespace != "" {
+		name = r.Namespace + "/" + name
+	}
+	if len(r.Finalizers) > 0 {
+		name += fmt.Sprintf(" (finalizers: %s)", strings.Join(r.Finalizers, ", "))
+	}
+	return name
+}
+
+// StuckResourcesError is returned by UninstallOrder when the objects of a
+// release are not deleted within the timeout.
+type StuckResourcesError struct {
+	Release   string
+	Resources []StuckResource
+}
+
+func (e *StuckResourcesError) Error() string {
+	names := make([]string, 0, len(e.Resources))
+	for _, r := range e.Resources {
+		names = append(names, r.String())
+	}
+	return fmt.Sprintf("timed out waiting for resources of release %s to be deleted: %s", e.Release, strings.Join(names, "; "))
+}
+
+// DeletionChecker waits until the objects rendered in a release manifest
+// are gone from the cluster. Client and Mapper are created from
+// ClientGetter, unless set.
+type DeletionChecker struct {
+	Manifest  string
+	Namespace string
+	Timeout   time.Duration
+
+	ClientGetter genericclioptions.RESTClientGetter
+	Client       dynamic.Interface
+	Mapper       meta.RESTMapper
+
+	stuck []StuckResource
+}
+
+type manifestObject struct {
+	gvr       schema.GroupVersionResource
+	namespace string
+	name      string
+}
+
+func (x *DeletionChecker) Do() error {
+	mapper := x.Mapper
+	if mapper == nil {
+		var err error
+		mapper, err = x.ClientGetter.ToRESTMapper()
+		if err != nil {
+			return err
+		}
+	}
+	dc := x.Client
+	if dc == nil {
+		config, err := x.ClientGetter.ToRESTConfig()
+		if err != nil {
+			return err
+		}
+		dc, err = dynamic.NewForConfig(config)
+		if err != nil {
+			return err
+		}
+	}
+
+	var objects []manifestObject
+	err := parser.ProcessResources([]byte(x.Manifest), func(ri parser.ResourceInfo) error {
+		if ri.Object.GetAnnotations()[resourcePolicyAnnotation] == "keep" {
+			return nil
+		}
+		gvk := ri.Object.GroupVersionKind()
+		mapping, err := mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+		if meta.IsNoMatchError(err) {
+			// The CRD is already gone, so are its objects.
+			return nil
+		} else if err != nil {
+			return err
+		}
+		obj := manifestObject{
+			gvr:  mapping.Resource,
+			name: ri.Object.GetName(),
+		}
+		if mapping.Scope.Name() == meta.RESTScopeNameNamespace {
+			obj.namespace = XorY(ri.Object.GetNamespace(), x.Namespace)
+		}
+		objects = append(objects, obj)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	timeout := x.Timeout
+	if timeout <= 0 {
+		timeout = DefaultUninstallTimeout
+	}
+
+	x.stuck = nil
+	err = wait.PollUntilContextTimeout(context.TODO(), 2*time.Second, timeout, true, func(ctx context.Context) (bool, error) {
+		remaining := objects[:0]
+		x.stuck = x.stuck[:0]
+		for _, obj := range objects {
+			u, err := dc.Resource(obj.gvr).Namespace(obj.namespace).Get(ctx, obj.name, metav1.GetOptions{})
+			if kerr.IsNotFound(err) {
+				continue
+			} else if err != nil {
+				return false, err
+			}
+			remaining = append(remaining, obj)
+			x.stuck = append(x.stuck, StuckResource{
+				Resource:          obj.gvr,
+				Namespace:         obj.namespace,
+				Name:              obj.name,
+				Finalizers:        u.GetFinalizers(),
+				DeletionTimestamp: u.GetDeletionTimestamp(),
+			})
+		}
+		objects = remaining
+		return len(objects) == 0, nil
+	})
+	if wait.Interrupted(err) {
+		return nil
+	}
+	return err
+}
+
+// Result returns the objects that still exist after the timeout.
+func (x *DeletionChecker) Result() []StuckResource {
+	return x.stuck
+}
+
+// ScriptFlavor is the tool that a generated script uses to manage releases.
+type ScriptFlavor string
+
+const (
+	FlavorYAML  ScriptFlavor = "yaml"
+	FlavorHelm3 ScriptFlavor = "helm3"
+)
+
+// GenerateUninstallScript generates the script that uninstalls an order
+// installed by the script of the same flavor. The packages are uninstalled
+// in reverse order and their AppReleases are deleted. The CRDs shipped by
+// the charts are only deleted if DeleteCRDs is set. Only the namespaces
+// listed in DeleteNamespaces are deleted, since the namespaces of the
+// packages may be shared with other workloads. The AppRelease CRD is never
+// deleted, since other orders may use it.
+func GenerateUninstallScript(bs *BlobStore, reg repo.IRegistry, order releasesapi.Order, flavor ScriptFlavor, opts ...ScriptOption) ([]ScriptRef, error) {
+	var name string
+	switch flavor {
+	case FlavorYAML:
+		name = "uninstall"
+	case FlavorHelm3:
+		name = "helm3-uninstall"
+	default:
+		return nil, fmt.Errorf("unknown script flavor %q", flavor)
+	}
+
+	var buf, psBuf bytes.Buffer
+
+	var scriptOptions ScriptOptions
+	for _, opt := range opts {
+		opt.Apply(&scriptOptions)
+	}
+
+	bs, err := scriptBlobStore(bs, scriptOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	order, err = applyLock(reg, order, scriptOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	packages, err := SortPackages(order.Spec.Packages)
+	if err != nil {
+		return nil, err
+	}
+
+	deleteNamespaces, err := namespacesToDelete(packages, scriptOptions.DeleteNamespaces)
+	if err != nil {
+		return nil, err
+	}
+
+	if !scriptOptions.OsIndependentScript {
+		_, err = buf.WriteString("#!/usr/bin/env sh\n")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	scripts := scriptWriters(&buf, &psBuf, scriptOptions)
+	all := allScripts(scripts)
+
+	var namespaces []string
+	seen := sets.New[string]()
+	for i := len(packages) - 1; i >= 0; i-- {
+		pkg := packages[i]
+		if pkg.Chart == nil {
+			continue
+		}
+
+		if !scriptOptions.DisableAppReleaseCRD {
+			_, err = fmt.Fprintf(all, "kubectl delete appreleases.drivers.x-helm.dev %s -n %s --ignore-not-found\n", pkg.Chart.ReleaseName, pkg.Chart.Namespace)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if flavor == FlavorHelm3 {
+			f1 := &Helm3UninstallPrinter{
+				ReleaseName: pkg.Chart.ReleaseName,
+				Namespace:   pkg.Chart.Namespace,
+				W:           all,
+			}
+			err = f1.Do()
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			for _, sw := range manifestWriters(scripts, scriptOptions) {
+				f1 := &YAMLUninstallPrinter{
+					Registry:    reg,
+					Chart:       *pkg.Chart,
+					KubeVersion: apis.DefaultKubernetesVersion,
+					BucketURL:   bs.Bucket,
+					UID:         string(order.UID),
+					PublicURL:   bs.Host,
+					Prefix:      bs.Prefix,
+					Inline:      scriptOptions.SelfContained,
+					Shell:       sw.Shell,
+					W:           sw.W,
+				}
+				err = f1.Do()
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		if scriptOptions.DeleteCRDs {
+			f2 := &CRDDeletePrinter{
+				Registry: reg,
+				ChartSourceRef: releasesapi.ChartSourceRef{
+					Name:      pkg.Chart.Name,
+					Version:   pkg.Chart.Version,
+					SourceRef: pkg.Chart.SourceRef,
+				},
+				W: all,
+			}
+			err = f2.Do()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if ns := pkg.Chart.Namespace; deleteNamespaces.Has(ns) && !seen.Has(ns) {
+			seen.Insert(ns)
+			namespaces = append(namespaces, ns)
+		}
+
+		_, err = fmt.Fprintln(all)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(namespaces) > 0 {
+		_, err = fmt.Fprintln(all, "# delete namespaces")
+		if err != nil {
+			return nil, err
+		}
+		for _, ns := range namespaces {
+			_, err = fmt.Fprintf(all, "kubectl delete namespace %s --ignore-not-found\n", ns)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return scriptRefs(bs, order, name, buf.String(), psBuf.String(), scriptOptions)
+}
+
+// namespacesToDelete checks that the namespaces to delete are namespaces of
+// the packages and not builtin ones.
+func namespacesToDelete(packages []releasesapi.PackageSelection, namespaces []string) (sets.Set[string], error) {
+	used := sets.New[string]()
+	for _, pkg := range packages {
+		if pkg.Chart != nil {
+			used.Insert(pkg.Chart.Namespace)
+		}
+	}
+	out := sets.New[string]()
+	for _, ns := range namespaces {
+		if apis.BuiltinNamespaces.Has(ns) {
+			return nil, fmt.Errorf("can't delete builtin namespace %s", ns)
+		}
+		if !used.Has(ns) {
+			return nil, fmt.Errorf("can't delete namespace %s, it is not the namespace of any package of the order", ns)
+		}
+		out.Insert(ns)
+	}
+	return out, nil
+}
+
+// Helm3UninstallPrinter prints the helm command that uninstalls a release.
+type Helm3UninstallPrinter struct {
+	ReleaseName string
+	Namespace   string
+	W           io.Writer
+}
+
+func (x *Helm3UninstallPrinter) Do() error {
+	if x.Namespace != "" {
+		_, err := fmt.Fprintf(x.W, "helm uninstall %s --namespace %s --wait\n", x.ReleaseName, x.Namespace)
+		return err
+	}
+	_, err := fmt.Fprintf(x.W, "helm uninstall %s --wait\n", x.ReleaseName)
+	return err
+}
+
+// YAMLUninstallPrinter uploads the rendered manifest of a release and
+// prints the kubectl command that deletes its objects. Unlike the manifest
+// uploaded by YAMLPrinter, it includes neither the CRDs nor the namespace of
+// the release. If Inline is set, the manifest is embedded in the command
+// instead, written for Shell.
+type YAMLUninstallPrinter struct {
+	Registry    repo.IRegistry
+	Chart       releasesapi.ChartSelection
+	KubeVersion string
+
+	BucketURL string
+	UID       string
+	PublicURL string
+	Prefix    string
+	Inline    bool
+	Shell     Shell
+	W         io.Writer
+}
+
+func (x *YAMLUninstallPrinter) Do() error {
+	src := releasesapi.ChartSourceRef{
+		Name:      x.Chart.Name,
+		Version:   x.Chart.Version,
+		SourceRef: x.Chart.SourceRef,
+	}
+	chrt, err := x.Registry.GetChart(src)
+	if err != nil {
+		return err
+	}
+	opts := values.Options{
+		ValuesFile:  x.Chart.ValuesFile,
+		ValuesPatch: x.Chart.ValuesPatch,
+	}
+	vals, err := opts.MergeValues(chrt.Chart)
+	if err != nil {
+		return err
+	}
+
+	f1 := &ChartRenderer{
+		Registry:       x.Registry,
+		ChartSourceRef: src,
+		ReleaseName:    x.Chart.ReleaseName,
+		Namespace:      x.Chart.Namespace,
+		KubeVersion:    x.KubeVersion,
+		Values:         vals,
+	}
+	err = f1.Do()
+	if err != nil {
+		return err
+	}
+	_, manifest := f1.Result()
+	if manifest == nil || len(bytes.TrimSpace(manifest.Data)) == 0 {
+		return nil
+	}
+
+	if x.Inline {
+		return x.Shell.printInline(x.W, "kubectl delete --ignore-not-found -f -", manifest.Data)
+	}
+
+	ctx := context.Background()
+	bucket, err := blob.OpenBucket(ctx, x.BucketURL)
+	if err != nil {
+		return err
+	}
+	if x.Prefix != "" {
+		bucket = blob.PrefixedBucket(bucket, strings.TrimSuffix(x.Prefix, "/")+"/")
+	}
+	dir := blob.PrefixedBucket(bucket, x.UID+"/uninstall/")
+	defer dir.Close() // nolint:errcheck
+
+	w, err := dir.NewWriter(ctx, x.Chart.ReleaseName+".yaml", nil)
+	if err != nil {
+		return err
+	}
+	_, writeErr := w.Write(manifest.Data)
+	// Always check the return value of Close when writing.
+	closeErr := w.Close() // nolint:errcheck
+	if writeErr != nil {
+		return writeErr
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+
+	_, err = fmt.Fprintf(x.W, "kubectl delete -f %s --ignore-not-found\n", x.PublicURL+"/"+path.Join(x.UID, "uninstall", x.Chart.ReleaseName+".yaml"))
+	return err
+}
+
+// CRDDeletePrinter prints the kubectl commands that delete the CRDs in the
+// crds/ directory of a chart.
+type CRDDeletePrinter struct {
+	Registry repo.IRegistry
+	releasesapi.ChartSourceRef
+	W io.Writer
+}
+
+func (x *CRDDeletePrinter) Do() error {
+	chrt, err := x.Registry.GetChart(x.ChartSourceRef)
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	for _, crd := range chrt.CRDObjects() {
+		err = parser.ProcessResources(crd.File.Data, func(ri parser.ResourceInfo) error {
+			if ri.Object.GroupVersionKind().GroupKind() == crdGroupKind {
+				names = append(names, ri.Object.GetName())
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+
+	_, err = fmt.Fprintln(x.W, "# delete CRDs")
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		_, err = fmt.Fprintf(x.W, "kubectl delete crds %s --ignore-not-found\n", name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
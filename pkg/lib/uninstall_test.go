@@ -0,0 +1,331 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/sets"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	releasesapi "x-helm.dev/apimachinery/apis/releases/v1alpha1"
+)
+
+const uninstallManifest = `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: stash
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: stash-config
+  namespace: other
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: stash-license
+  annotations:
+    helm.sh/resource-policy: keep
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRole
+metadata:
+  name: stash
+---
+apiVersion: stash.appscode.com/v1beta1
+kind: BackupConfiguration
+metadata:
+  name: gone-with-its-crd
+`
+
+func uninstallMapper() meta.RESTMapper {
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"}, meta.RESTScopeNamespace)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}, meta.RESTScopeNamespace)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "Secret"}, meta.RESTScopeNamespace)
+	mapper.Add(schema.GroupVersionKind{Group: "rbac.authorization.k8s.io", Version: "v1", Kind: "ClusterRole"}, meta.RESTScopeRoot)
+	return mapper
+}
+
+func uninstallObject(apiVersion, kind, namespace, name string, finalizers ...string) runtime.Object {
+	u := &unstructured.Unstructured{}
+	u.SetAPIVersion(apiVersion)
+	u.SetKind(kind)
+	u.SetNamespace(namespace)
+	u.SetName(name)
+	u.SetFinalizers(finalizers)
+	return u
+}
+
+func TestDeletionChecker(t *testing.T) {
+	deployments := schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}
+	clusterRoles := schema.GroupVersionResource{Group: "rbac.authorization.k8s.io", Version: "v1", Resource: "clusterroles"}
+
+	cases := []struct {
+		name    string
+		objects []runtime.Object
+		want    []StuckResource
+	}{
+		{
+			name: "resources gone",
+			objects: []runtime.Object{
+				// kept by the resource policy
+				uninstallObject("v1", "Secret", "demo", "stash-license"),
+				// not part of the release
+				uninstallObject("apps/v1", "Deployment", "other", "stash"),
+			},
+		},
+		{
+			name: "finalizer keeps the object",
+			objects: []runtime.Object{
+				uninstallObject("apps/v1", "Deployment", "demo", "stash", "example.com/cleanup"),
+				uninstallObject("rbac.authorization.k8s.io/v1", "ClusterRole", "", "stash"),
+			},
+			want: []StuckResource{
+				{Resource: deployments, Namespace: "demo", Name: "stash", Finalizers: []string{"example.com/cleanup"}},
+				{Resource: clusterRoles, Name: "stash"},
+			},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			x := &DeletionChecker{
+				Manifest:  uninstallManifest,
+				Namespace: "demo",
+				Timeout:   100 * time.Millisecond,
+				Client:    dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), c.objects...),
+				Mapper:    uninstallMapper(),
+			}
+			err := x.Do()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := x.Result()
+			if len(got) == 0 {
+				got = nil
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("got stuck resources %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestStuckResourcesError(t *testing.T) {
+	err := &StuckResourcesError{
+		Release: "demo/stash",
+		Resources: []StuckResource{
+			{
+				Resource:          schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"},
+				Namespace:         "demo",
+				Name:              "stash",
+				Finalizers:        []string{"example.com/a", "example.com/b"},
+				DeletionTimestamp: &metav1.Time{},
+			},
+			{
+				Resource: schema.GroupVersionResource{Group: "rbac.authorization.k8s.io", Version: "v1", Resource: "clusterroles"},
+				Name:     "stash",
+			},
+		},
+	}
+	want := "timed out waiting for resources of release demo/stash to be deleted: " +
+		"demo/deployments.apps/stash (finalizers: example.com/a, example.com/b); clusterroles.rbac.authorization.k8s.io/stash"
+	if err.Error() != want {
+		t.Errorf("got %q, want %q", err.Error(), want)
+	}
+}
+
+func TestUninstallSequence(t *testing.T) {
+	packages := []releasesapi.PackageSelection{
+		testPackage("a", nil, []string{"bars.example.com"}),
+		{},
+		testPackage("b", []string{"bars.example.com"}, []string{"foos.example.com"}),
+		testPackage("c", nil, nil),
+		testPackage("d", []string{"foos.example.com"}, nil),
+	}
+	sorted, err := SortPackages(packages)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want []string
+	for i := len(sorted) - 1; i >= 0; i-- {
+		if sorted[i].Chart != nil {
+			want = append(want, sorted[i].Chart.ReleaseName)
+		}
+	}
+
+	charts, err := uninstallSequence(packages)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, chrt := range charts {
+		got = append(got, chrt.ReleaseName)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got uninstall order %v, want %v", got, want)
+	}
+	// dependents are uninstalled before the packages owning their resources
+	if want := []string{"a", "b", "d", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got uninstall order %v, want %v", got, want)
+	}
+}
+
+func TestGenerateUninstallScript(t *testing.T) {
+	dir := t.TempDir()
+	configMap := func(name string) string {
+		return "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: " + name + "\n"
+	}
+	writeManifestChart(t, dir, "crds", dryRunCRD, configMap("crds"))
+	writeManifestChart(t, dir, "tools", "", configMap("tools"))
+	writeManifestChart(t, dir, "app", "", configMap("app"))
+	reg, err := NewArchiveRegistry(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pkg := func(name, namespace string) releasesapi.PackageSelection {
+		ref := archiveChartRef(name, "0.1.0")
+		return releasesapi.PackageSelection{
+			Chart: &releasesapi.ChartSelection{
+				ChartRef:    releasesapi.ChartRef{Name: ref.Name, SourceRef: ref.SourceRef},
+				Version:     ref.Version,
+				ReleaseName: name,
+				Namespace:   namespace,
+			},
+		}
+	}
+	order := releasesapi.Order{
+		Spec: releasesapi.OrderSpec{
+			Packages: []releasesapi.PackageSelection{
+				pkg("crds", "shared"),
+				pkg("tools", "tools"),
+				pkg("app", "shared"),
+			},
+		},
+	}
+
+	appRelease := func(name, namespace string) string {
+		return "kubectl delete appreleases.drivers.x-helm.dev " + name + " -n " + namespace + " --ignore-not-found"
+	}
+	const deleteManifest = "kubectl delete --ignore-not-found -f -"
+	cases := []struct {
+		name   string
+		flavor ScriptFlavor
+		opts   []ScriptOption
+		want   []string
+	}{
+		{
+			// shared is deleted only after crds, the last package in it,
+			// is uninstalled
+			name:   "yaml",
+			flavor: FlavorYAML,
+			opts:   []ScriptOption{DeleteCRDs, WithDeleteNamespaces("shared")},
+			want: []string{
+				appRelease("app", "shared"),
+				deleteManifest,
+				appRelease("tools", "tools"),
+				deleteManifest,
+				appRelease("crds", "shared"),
+				deleteManifest,
+				"kubectl delete crds foos.example.com --ignore-not-found",
+				"kubectl delete namespace shared --ignore-not-found",
+			},
+		},
+		{
+			name:   "helm3",
+			flavor: FlavorHelm3,
+			want: []string{
+				appRelease("app", "shared"),
+				"helm uninstall app --namespace shared --wait",
+				appRelease("tools", "tools"),
+				"helm uninstall tools --namespace tools --wait",
+				appRelease("crds", "shared"),
+				"helm uninstall crds --namespace shared --wait",
+			},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			scripts, err := GenerateUninstallScript(nil, reg, order, c.flavor, append(c.opts, SelfContainedScript)...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(scripts) != 3 {
+				t.Fatalf("got %d scripts, want one per OS", len(scripts))
+			}
+			for _, script := range scripts {
+				var got []string
+				for _, line := range strings.Split(script.Script, "\n") {
+					switch {
+					case strings.Contains(line, deleteManifest):
+						got = append(got, deleteManifest)
+					case strings.HasPrefix(line, "kubectl "), strings.HasPrefix(line, "helm "):
+						got = append(got, line)
+					}
+				}
+				if !reflect.DeepEqual(got, c.want) {
+					t.Errorf("got %s commands\n%s\nwant\n%s", script.OS, strings.Join(got, "\n"), strings.Join(c.want, "\n"))
+				}
+			}
+		})
+	}
+}
+
+func TestNamespacesToDelete(t *testing.T) {
+	packages := []releasesapi.PackageSelection{
+		testPackage("a", nil, nil),
+		{},
+	}
+	cases := []struct {
+		name       string
+		namespaces []string
+		want       []string
+		wantErr    string
+	}{
+		{name: "none", want: []string{}},
+		{name: "namespace of a package", namespaces: []string{"ns"}, want: []string{"ns"}},
+		{name: "builtin", namespaces: []string{"kube-system"}, wantErr: "can't delete builtin namespace kube-system"},
+		{name: "not used by the order", namespaces: []string{"other"}, wantErr: "can't delete namespace other"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := namespacesToDelete(packages, c.namespaces)
+			if c.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), c.wantErr) {
+					t.Fatalf("got error %v, want %q", err, c.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(sets.List(got), c.want) {
+				t.Errorf("got namespaces %v, want %v", sets.List(got), c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,332 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+
+	"kubepack.dev/lib-helm/pkg/action"
+	"kubepack.dev/lib-helm/pkg/repo"
+	"kubepack.dev/lib-helm/pkg/values"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
+	cu "kmodules.xyz/client-go/client"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"x-helm.dev/apimachinery/apis"
+	driversapi "x-helm.dev/apimachinery/apis/drivers/v1alpha1"
+	releasesapi "x-helm.dev/apimachinery/apis/releases/v1alpha1"
+)
+
+type PackageActionType string
+
+const (
+	PackageInstall   PackageActionType = "Install"
+	PackageUpgrade   PackageActionType = "Upgrade"
+	PackageUninstall PackageActionType = "Uninstall"
+	PackageUnchanged PackageActionType = "Unchanged"
+)
+
+// PackageAction describes what UpgradeOrder did with a release.
+type PackageAction struct {
+	Release     types.NamespacedName `json:"release"`
+	Action      PackageActionType    `json:"action"`
+	FromVersion string               `json:"fromVersion,omitempty"`
+	ToVersion   string               `json:"toVersion,omitempty"`
+}
+
+// UpgradeOrder moves the cluster from the installed order old to the desired order.
+// Packages are matched by release name and namespace. Packages only found in
+// desired are installed, changed packages are upgraded and packages only found in
+// old are uninstalled in reverse dependency order. Like InstallOrder, desired is
+// pinned to the lock in opts and its chart digests and Kubernetes version
+// constraints are checked before anything is changed.
+// In dry-run mode, the packages that would be installed or upgraded are
+// checked like InstallOrder does and the cluster is not changed. The
+// returned actions are the ones that would be run.
+func UpgradeOrder(getter genericclioptions.RESTClientGetter, reg repo.IRegistry, old, desired releasesapi.Order, opts ...ScriptOption) ([]PackageAction, error) {
+	var scriptOptions ScriptOptions
+	for _, opt := range opts {
+		opt.Apply(&scriptOptions)
+	}
+
+	desired, reg, kubeVersion, err := preflightOrder(getter, reg, desired, scriptOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	steps, err := planUpgrade(old, desired)
+	if err != nil {
+		return nil, err
+	}
+
+	x, err := newOrderInstaller(getter, reg, kubeVersion, scriptOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	var actions []PackageAction
+	var checked []int // packages checked in dry-run mode
+	for _, step := range steps {
+		switch {
+		case step.Action == PackageUnchanged:
+		case scriptOptions.DryRun:
+			if step.Action != PackageUninstall {
+				checked = append(checked, step.index)
+			}
+		case step.Action == PackageInstall:
+			err = x.installPackage(step.chart)
+		case step.Action == PackageUpgrade:
+			err = x.upgradePackage(step.chart)
+		case step.Action == PackageUninstall:
+			err = x.deleteAppRelease(step.chart)
+			if err == nil {
+				err = uninstallPackage(getter, step.chart, scriptOptions.Timeout)
+			}
+		}
+		if err != nil {
+			return actions, err
+		}
+		actions = append(actions, step.PackageAction)
+	}
+	if scriptOptions.DryRun {
+		return actions, x.dryRunOrder(desired, checked)
+	}
+	return actions, nil
+}
+
+// upgradeStep is an action of UpgradeOrder with the package it applies to.
+type upgradeStep struct {
+	PackageAction
+	chart *releasesapi.ChartSelection
+	// index of the package in the desired order, -1 for uninstalls
+	index int
+}
+
+// planUpgrade returns the steps that move the cluster from the installed
+// order old to the desired order. The packages of desired are installed or
+// upgraded in dependency order, then the packages only found in old are
+// uninstalled in reverse dependency order.
+func planUpgrade(old, desired releasesapi.Order) ([]upgradeStep, error) {
+	oldGraph, err := newPackageGraph(old.Spec.Packages)
+	if err != nil {
+		return nil, err
+	}
+	oldIds, err := oldGraph.sorted()
+	if err != nil {
+		return nil, err
+	}
+	newGraph, err := newPackageGraph(desired.Spec.Packages)
+	if err != nil {
+		return nil, err
+	}
+	newIds, err := newGraph.sorted()
+	if err != nil {
+		return nil, err
+	}
+
+	installed := map[types.NamespacedName]*releasesapi.ChartSelection{}
+	for _, pkg := range old.Spec.Packages {
+		if pkg.Chart != nil {
+			installed[releaseKey(pkg.Chart)] = pkg.Chart
+		}
+	}
+
+	var steps []upgradeStep
+	wanted := map[types.NamespacedName]bool{}
+	for _, i := range newIds {
+		chrt := desired.Spec.Packages[i].Chart
+		if chrt == nil {
+			continue
+		}
+		key := releaseKey(chrt)
+		wanted[key] = true
+
+		step := upgradeStep{
+			PackageAction: PackageAction{
+				Release:   key,
+				Action:    PackageInstall,
+				ToVersion: chrt.Version,
+			},
+			chart: chrt,
+			index: i,
+		}
+		if cur, found := installed[key]; found {
+			changed, err := packageChanged(cur, chrt)
+			if err != nil {
+				return nil, err
+			}
+			step.Action = PackageUnchanged
+			if changed {
+				step.Action = PackageUpgrade
+			}
+			step.FromVersion = cur.Version
+		}
+		steps = append(steps, step)
+	}
+
+	for k := len(oldIds) - 1; k >= 0; k-- {
+		chrt := old.Spec.Packages[oldIds[k]].Chart
+		if chrt == nil || wanted[releaseKey(chrt)] {
+			continue
+		}
+		steps = append(steps, upgradeStep{
+			PackageAction: PackageAction{
+				Release:     releaseKey(chrt),
+				Action:      PackageUninstall,
+				FromVersion: chrt.Version,
+			},
+			chart: chrt,
+			index: -1,
+		})
+	}
+	return steps, nil
+}
+
+// deleteAppRelease deletes the AppRelease of a release, if the installer has
+// a Kubernetes client.
+func (x *orderInstaller) deleteAppRelease(chrt *releasesapi.ChartSelection) error {
+	if x.kc == nil {
+		return nil
+	}
+	app := &driversapi.AppRelease{}
+	app.Namespace = chrt.Namespace
+	app.Name = chrt.ReleaseName
+	return client.IgnoreNotFound(x.kc.Delete(context.TODO(), app))
+}
+
+func releaseKey(chrt *releasesapi.ChartSelection) types.NamespacedName {
+	return types.NamespacedName{Namespace: chrt.Namespace, Name: chrt.ReleaseName}
+}
+
+// packageChanged reports whether the chart, version or values of a package
+// differ between two orders.
+func packageChanged(a, b *releasesapi.ChartSelection) (bool, error) {
+	if a.Name != b.Name ||
+		a.SourceRef != b.SourceRef ||
+		a.Version != b.Version ||
+		a.ValuesFile != b.ValuesFile {
+		return true, nil
+	}
+	return valuesPatchChanged(a.ValuesPatch, b.ValuesPatch)
+}
+
+func valuesPatchChanged(x, y *runtime.RawExtension) (bool, error) {
+	decode := func(in *runtime.RawExtension) (any, error) {
+		if in == nil {
+			return nil, nil
+		}
+		data, err := json.Marshal(in)
+		if err != nil {
+			return nil, err
+		}
+		var out any
+		err = json.Unmarshal(data, &out)
+		return out, err
+	}
+	a, err := decode(x)
+	if err != nil {
+		return false, err
+	}
+	b, err := decode(y)
+	if err != nil {
+		return false, err
+	}
+	return !reflect.DeepEqual(a, b), nil
+}
+
+func (x *orderInstaller) upgradePackage(chrt *releasesapi.ChartSelection) error {
+	err := x.deployRelease(chrt)
+	if err != nil {
+		return err
+	}
+
+	err = x.waitForPackage(chrt)
+	if err != nil {
+		return err
+	}
+
+	_, err = x.applyAppRelease(chrt)
+	return err
+}
+
+func (x *orderInstaller) deployRelease(chrt *releasesapi.ChartSelection) error {
+	f3, err := action.NewDeployer(x.getter, chrt.Namespace, "secret")
+	if err != nil {
+		return err
+	}
+	f3.
+		WithRegistry(x.reg).
+		WithOptions(action.DeployOptions{
+			ChartSourceFlatRef: releasesapi.ChartSourceFlatRef{
+				Name:            chrt.Name,
+				Version:         chrt.Version,
+				SourceAPIGroup:  chrt.SourceRef.APIGroup,
+				SourceKind:      chrt.SourceRef.Kind,
+				SourceNamespace: chrt.SourceRef.Namespace,
+				SourceName:      chrt.SourceRef.Name,
+			},
+			Options: values.Options{
+				ValuesFile:  chrt.ValuesFile,
+				ValuesPatch: chrt.ValuesPatch,
+			},
+			Namespace:       chrt.Namespace,
+			CreateNamespace: !apis.BuiltinNamespaces.Has(chrt.Namespace),
+			ReleaseName:     chrt.ReleaseName,
+		})
+	err = f3.Do()
+	if f3.Result() != nil {
+		x.status.setRevision(chrt, f3.Result().Version)
+	}
+	return err
+}
+
+// applyAppRelease creates or updates the AppRelease of chrt. It returns nil
+// if the AppRelease CRD is disabled or the installer has no client for it.
+func (x *orderInstaller) applyAppRelease(chrt *releasesapi.ChartSelection) (*driversapi.AppRelease, error) {
+	if x.opts.DisableAppReleaseCRD || x.kc == nil {
+		return nil, nil
+	}
+
+	f6 := &ApplicationGenerator{
+		Registry:    x.reg,
+		Chart:       *chrt,
+		KubeVersion: x.kubeVersion,
+	}
+	err := f6.Do()
+	if err != nil {
+		return nil, err
+	}
+
+	app := f6.Result()
+	obj := &driversapi.AppRelease{
+		ObjectMeta: app.ObjectMeta,
+	}
+	_, err = cu.CreateOrPatch(context.TODO(), x.kc, obj, func(obj client.Object, createOp bool) client.Object {
+		in := obj.(*driversapi.AppRelease)
+		in.Annotations = app.Annotations
+		in.Spec = app.Spec
+		return in
+	})
+	if err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
@@ -0,0 +1,215 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"reflect"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	kmapi "kmodules.xyz/client-go/api/v1"
+	releasesapi "x-helm.dev/apimachinery/apis/releases/v1alpha1"
+)
+
+func TestPackageChanged(t *testing.T) {
+	patch := func(s string) *runtime.RawExtension {
+		return &runtime.RawExtension{Raw: []byte(s)}
+	}
+	base := releasesapi.ChartSelection{
+		ChartRef: releasesapi.ChartRef{
+			Name: "stash",
+			SourceRef: kmapi.TypedObjectReference{
+				Kind: releasesapi.SourceKindLegacy,
+				Name: "https://charts.appscode.com/stable/",
+			},
+		},
+		Version:     "v0.9.0",
+		ReleaseName: "stash",
+		Namespace:   "kube-system",
+		ValuesPatch: patch(`[{"op":"replace","path":"/replicas","value":2}]`),
+	}
+
+	cases := []struct {
+		name   string
+		change func(c *releasesapi.ChartSelection)
+		want   bool
+	}{
+		{
+			name:   "same",
+			change: func(c *releasesapi.ChartSelection) {},
+		},
+		{
+			name: "values patch with other key order",
+			change: func(c *releasesapi.ChartSelection) {
+				c.ValuesPatch = patch(`[ {"value": 2, "path": "/replicas", "op": "replace"} ]`)
+			},
+		},
+		{
+			name: "ignored fields",
+			change: func(c *releasesapi.ChartSelection) {
+				c.Bundle = &releasesapi.ChartSourceRef{Name: "stash-community"}
+				c.WaitFors = []releasesapi.WaitFlags{{ForCondition: "condition=Available"}}
+			},
+		},
+		{
+			name:   "chart",
+			change: func(c *releasesapi.ChartSelection) { c.Name = "stash-enterprise" },
+			want:   true,
+		},
+		{
+			name:   "source",
+			change: func(c *releasesapi.ChartSelection) { c.SourceRef.Name = "https://bundles.kubepack.com" },
+			want:   true,
+		},
+		{
+			name:   "version",
+			change: func(c *releasesapi.ChartSelection) { c.Version = "v0.9.1" },
+			want:   true,
+		},
+		{
+			name:   "values file",
+			change: func(c *releasesapi.ChartSelection) { c.ValuesFile = "values-ha.yaml" },
+			want:   true,
+		},
+		{
+			name: "values patch",
+			change: func(c *releasesapi.ChartSelection) {
+				c.ValuesPatch = patch(`[{"op":"replace","path":"/replicas","value":3}]`)
+			},
+			want: true,
+		},
+		{
+			name:   "values patch removed",
+			change: func(c *releasesapi.ChartSelection) { c.ValuesPatch = nil },
+			want:   true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			b := base.DeepCopy()
+			c.change(b)
+			got, err := packageChanged(&base, b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != c.want {
+				t.Errorf("got changed %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestValuesPatchChanged(t *testing.T) {
+	cases := []struct {
+		name string
+		a, b *runtime.RawExtension
+		want bool
+	}{
+		{name: "both nil"},
+		{
+			name: "equal objects in other key order",
+			a:    &runtime.RawExtension{Raw: []byte(`{"a":1,"b":{"c":true,"d":[1,2]}}`)},
+			b:    &runtime.RawExtension{Raw: []byte(`{"b":{"d":[1,2],"c":true},"a":1}`)},
+		},
+		{
+			name: "list order matters",
+			a:    &runtime.RawExtension{Raw: []byte(`{"d":[1,2]}`)},
+			b:    &runtime.RawExtension{Raw: []byte(`{"d":[2,1]}`)},
+			want: true,
+		},
+		{
+			name: "added",
+			b:    &runtime.RawExtension{Raw: []byte(`{"a":1}`)},
+			want: true,
+		},
+		{
+			name: "number type",
+			a:    &runtime.RawExtension{Raw: []byte(`{"a":1}`)},
+			b:    &runtime.RawExtension{Raw: []byte(`{"a":"1"}`)},
+			want: true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := valuesPatchChanged(c.a, c.b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != c.want {
+				t.Errorf("got changed %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestPlanUpgrade(t *testing.T) {
+	pkg := func(name, version string, owned, required []string) releasesapi.PackageSelection {
+		p := testPackage(name, owned, required)
+		p.Chart.Version = version
+		return p
+	}
+	old := releasesapi.Order{
+		Spec: releasesapi.OrderSpec{
+			Packages: []releasesapi.PackageSelection{
+				pkg("unchanged", "1.0.0", nil, nil),
+				// removed is required by removed-dependent, so it is
+				// uninstalled last
+				pkg("removed", "1.0.0", []string{"foos.example.com"}, nil),
+				pkg("removed-dependent", "1.0.0", nil, []string{"foos.example.com"}),
+				pkg("changed", "1.0.0", nil, nil),
+			},
+		},
+	}
+	desired := releasesapi.Order{
+		Spec: releasesapi.OrderSpec{
+			Packages: []releasesapi.PackageSelection{
+				pkg("added", "1.0.0", nil, []string{"bars.example.com"}),
+				pkg("unchanged", "1.0.0", nil, nil),
+				pkg("changed", "2.0.0", []string{"bars.example.com"}, nil),
+			},
+		},
+	}
+
+	steps, err := planUpgrade(old, desired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []PackageAction
+	var indices []int
+	for _, step := range steps {
+		got = append(got, step.PackageAction)
+		indices = append(indices, step.index)
+	}
+
+	release := func(name string) types.NamespacedName {
+		return types.NamespacedName{Namespace: "ns", Name: name}
+	}
+	want := []PackageAction{
+		{Release: release("unchanged"), Action: PackageUnchanged, FromVersion: "1.0.0", ToVersion: "1.0.0"},
+		{Release: release("changed"), Action: PackageUpgrade, FromVersion: "1.0.0", ToVersion: "2.0.0"},
+		{Release: release("added"), Action: PackageInstall, ToVersion: "1.0.0"},
+		{Release: release("removed-dependent"), Action: PackageUninstall, FromVersion: "1.0.0"},
+		{Release: release("removed"), Action: PackageUninstall, FromVersion: "1.0.0"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got actions\n%v\nwant\n%v", got, want)
+	}
+	if want := []int{1, 2, 0, -1, -1}; !reflect.DeepEqual(indices, want) {
+		t.Errorf("got package indices %v, want %v", indices, want)
+	}
+}
@@ -0,0 +1,208 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"fmt"
+	"strings"
+
+	"kubepack.dev/lib-helm/pkg/repo"
+	"kubepack.dev/lib-helm/pkg/values"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"kmodules.xyz/client-go/tools/parser"
+	"x-helm.dev/apimachinery/apis"
+	releasesapi "x-helm.dev/apimachinery/apis/releases/v1alpha1"
+)
+
+// ValidateOrder checks an Order without connecting to a cluster. It returns
+// every problem found, such as duplicate or invalid release names, chart
+// versions missing from the registry, values patches that don't apply and
+// waitFors that don't match any object rendered by the chart.
+func ValidateOrder(reg repo.IRegistry, order releasesapi.Order) field.ErrorList {
+	var errs field.ErrorList
+
+	fldPath := field.NewPath("spec", "packages")
+	seen := map[types.NamespacedName]bool{}
+	for i, pkg := range order.Spec.Packages {
+		if pkg.Chart == nil {
+			continue
+		}
+		errs = append(errs, validatePackage(reg, pkg.Chart, seen, fldPath.Index(i).Child("chart"))...)
+	}
+
+	_, err := SortPackages(order.Spec.Packages)
+	if err != nil {
+		errs = append(errs, field.Invalid(fldPath, "", err.Error()))
+	}
+	return errs
+}
+
+func validatePackage(reg repo.IRegistry, chrt *releasesapi.ChartSelection, seen map[types.NamespacedName]bool, fldPath *field.Path) field.ErrorList {
+	var errs field.ErrorList
+
+	for _, msg := range validation.IsDNS1123Label(chrt.Namespace) {
+		errs = append(errs, field.Invalid(fldPath.Child("namespace"), chrt.Namespace, msg))
+	}
+	for _, msg := range validation.IsDNS1123Subdomain(chrt.ReleaseName) {
+		errs = append(errs, field.Invalid(fldPath.Child("releaseName"), chrt.ReleaseName, msg))
+	}
+	if len(chrt.ReleaseName) > releaseNameMaxLen {
+		errs = append(errs, field.TooLong(fldPath.Child("releaseName"), chrt.ReleaseName, releaseNameMaxLen))
+	}
+
+	key := releaseKey(chrt)
+	if seen[key] {
+		errs = append(errs, field.Duplicate(fldPath.Child("releaseName"), key.String()))
+	}
+	seen[key] = true
+
+	c, err := reg.GetChart(releasesapi.ChartSourceRef{
+		Name:      chrt.Name,
+		Version:   chrt.Version,
+		SourceRef: chrt.SourceRef,
+	})
+	if err != nil {
+		return append(errs, field.Invalid(fldPath.Child("version"), chrt.Version, fmt.Sprintf("failed to find chart %s: %v", chrt.Name, err)))
+	}
+
+	opts := values.Options{
+		ValuesFile:  chrt.ValuesFile,
+		ValuesPatch: chrt.ValuesPatch,
+	}
+	if _, err = opts.MergeValues(c.Chart); err != nil {
+		var patch string
+		if chrt.ValuesPatch != nil {
+			patch = string(chrt.ValuesPatch.Raw)
+		}
+		return append(errs, field.Invalid(fldPath.Child("valuesPatch"), patch, err.Error()))
+	}
+
+	if len(chrt.WaitFors) == 0 {
+		return errs
+	}
+
+	return append(errs, validateWaitFors(reg, chrt, fldPath)...)
+}
+
+// validateWaitFors checks that every WaitFor of a package selects an object
+// rendered by its chart.
+func validateWaitFors(reg repo.IRegistry, chrt *releasesapi.ChartSelection, fldPath *field.Path) field.ErrorList {
+	var errs field.ErrorList
+
+	manifests, err := renderPackage(reg, chrt, apis.DefaultKubernetesVersion)
+	if err != nil {
+		return append(errs, field.Invalid(fldPath.Child("name"), chrt.Name, fmt.Sprintf("failed to render chart: %v", err)))
+	}
+	var objects []*unstructured.Unstructured
+	for _, data := range manifests {
+		err = parser.ProcessResources(data, func(ri parser.ResourceInfo) error {
+			objects = append(objects, ri.Object)
+			return nil
+		})
+		if err != nil {
+			return append(errs, field.Invalid(fldPath.Child("name"), chrt.Name, fmt.Sprintf("failed to parse rendered chart: %v", err)))
+		}
+	}
+
+	for i, w := range chrt.WaitFors {
+		matches, err := waitForObjects(w, objects)
+		if err != nil {
+			errs = append(errs, field.Invalid(fldPath.Child("waitFors").Index(i).Child("labels"), w.Labels, err.Error()))
+		} else if len(matches) == 0 {
+			errs = append(errs, field.NotFound(fldPath.Child("waitFors").Index(i).Child("resource"), waitForTarget(w)))
+		}
+	}
+	return errs
+}
+
+func waitForTarget(w releasesapi.WaitFlags) string {
+	if w.Resource.Resource != "" {
+		return w.Resource.Group + "/" + w.Resource.Resource
+	}
+	return w.Resource.Group
+}
+
+// shortNames holds the short names of the built-in resources accepted by
+// kubectl wait.
+var shortNames = map[string]string{
+	"cm":     "configmaps",
+	"cj":     "cronjobs",
+	"crd":    "customresourcedefinitions",
+	"crds":   "customresourcedefinitions",
+	"deploy": "deployments",
+	"ds":     "daemonsets",
+	"ep":     "endpoints",
+	"hpa":    "horizontalpodautoscalers",
+	"ing":    "ingresses",
+	"no":     "nodes",
+	"ns":     "namespaces",
+	"pdb":    "poddisruptionbudgets",
+	"po":     "pods",
+	"pv":     "persistentvolumes",
+	"pvc":    "persistentvolumeclaims",
+	"rs":     "replicasets",
+	"sa":     "serviceaccounts",
+	"sts":    "statefulsets",
+	"svc":    "services",
+}
+
+// waitForObjects returns the objects selected by the resource type, name and
+// labels of a WaitFor. The resource type uses the kubectl format, eg,
+// deployments.apps.
+func waitForObjects(w releasesapi.WaitFlags, objects []*unstructured.Unstructured) ([]*unstructured.Unstructured, error) {
+	resource, group, hasGroup := strings.Cut(strings.ToLower(w.Resource.Group), ".")
+	if r, ok := shortNames[resource]; ok {
+		resource = r
+	}
+
+	selector := labels.Everything()
+	if w.Labels != nil {
+		var err error
+		selector, err = metav1.LabelSelectorAsSelector(w.Labels)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var out []*unstructured.Unstructured
+	for _, obj := range objects {
+		gvk := obj.GroupVersionKind()
+		if hasGroup && gvk.Group != group {
+			continue
+		}
+		kind := strings.ToLower(gvk.Kind)
+		plural, _ := meta.UnsafeGuessKindToResource(gvk)
+		if resource != kind && resource != plural.Resource {
+			continue
+		}
+		if w.Resource.Resource != "" && obj.GetName() != w.Resource.Resource {
+			continue
+		}
+		if !selector.Matches(labels.Set(obj.GetLabels())) {
+			continue
+		}
+		out = append(out, obj)
+	}
+	return out, nil
+}
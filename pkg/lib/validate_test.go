@@ -0,0 +1,199 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"reflect"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	releasesapi "x-helm.dev/apimachinery/apis/releases/v1alpha1"
+)
+
+func stashSelection(release, namespace, version string) *releasesapi.ChartSelection {
+	ref := archiveChartRef("stash", version)
+	return &releasesapi.ChartSelection{
+		ChartRef: releasesapi.ChartRef{
+			Name:      ref.Name,
+			SourceRef: ref.SourceRef,
+		},
+		Version:     ref.Version,
+		ReleaseName: release,
+		Namespace:   namespace,
+	}
+}
+
+func TestValidateOrder(t *testing.T) {
+	reg, err := NewArchiveRegistry("../../testdata/archives")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type finding struct {
+		Type  field.ErrorType
+		Field string
+	}
+	cases := []struct {
+		name     string
+		packages func() []*releasesapi.ChartSelection
+		want     []finding
+	}{
+		{
+			name: "valid",
+			packages: func() []*releasesapi.ChartSelection {
+				chrt := stashSelection("stash", "kube-system", "v0.9.0-rc.6")
+				chrt.WaitFors = []releasesapi.WaitFlags{
+					{
+						Resource: metav1.GroupResource{Group: "deployments.apps"},
+						Labels: &metav1.LabelSelector{
+							MatchLabels: map[string]string{"app": "stash", "release": "stash"},
+						},
+					},
+					{Resource: metav1.GroupResource{Group: "deploy", Resource: "stash"}},
+				}
+				return []*releasesapi.ChartSelection{chrt}
+			},
+		},
+		{
+			name: "duplicate release",
+			packages: func() []*releasesapi.ChartSelection {
+				return []*releasesapi.ChartSelection{
+					stashSelection("stash", "kube-system", "v0.9.0-rc.6"),
+					stashSelection("stash", "kube-system", "v0.9.0-rc.6"),
+				}
+			},
+			want: []finding{
+				{field.ErrorTypeDuplicate, "spec.packages[1].chart.releaseName"},
+			},
+		},
+		{
+			name: "same release name in other namespace",
+			packages: func() []*releasesapi.ChartSelection {
+				return []*releasesapi.ChartSelection{
+					stashSelection("stash", "kube-system", "v0.9.0-rc.6"),
+					stashSelection("stash", "demo", "v0.9.0-rc.6"),
+				}
+			},
+		},
+		{
+			name: "invalid names",
+			packages: func() []*releasesapi.ChartSelection {
+				return []*releasesapi.ChartSelection{
+					stashSelection("Stash_Operator", "kube.system", "v0.9.0-rc.6"),
+				}
+			},
+			want: []finding{
+				{field.ErrorTypeInvalid, "spec.packages[0].chart.namespace"},
+				{field.ErrorTypeInvalid, "spec.packages[0].chart.releaseName"},
+			},
+		},
+		{
+			name: "release name too long",
+			packages: func() []*releasesapi.ChartSelection {
+				return []*releasesapi.ChartSelection{
+					stashSelection("stash-operator-with-a-release-name-longer-than-helm-allows", "kube-system", "v0.9.0-rc.6"),
+				}
+			},
+			want: []finding{
+				{field.ErrorTypeTooLong, "spec.packages[0].chart.releaseName"},
+			},
+		},
+		{
+			name: "unknown version",
+			packages: func() []*releasesapi.ChartSelection {
+				return []*releasesapi.ChartSelection{
+					stashSelection("stash", "kube-system", "v0.8.0"),
+				}
+			},
+			want: []finding{
+				{field.ErrorTypeInvalid, "spec.packages[0].chart.version"},
+			},
+		},
+		{
+			name: "values patch does not apply",
+			packages: func() []*releasesapi.ChartSelection {
+				chrt := stashSelection("stash", "kube-system", "v0.9.0-rc.6")
+				chrt.ValuesPatch = &runtime.RawExtension{
+					Raw: []byte(`[{"op":"replace","path":"/no/such/value","value":1}]`),
+				}
+				return []*releasesapi.ChartSelection{chrt}
+			},
+			want: []finding{
+				{field.ErrorTypeInvalid, "spec.packages[0].chart.valuesPatch"},
+			},
+		},
+		{
+			name: "unknown waitFor",
+			packages: func() []*releasesapi.ChartSelection {
+				chrt := stashSelection("stash", "kube-system", "v0.9.0-rc.6")
+				chrt.WaitFors = []releasesapi.WaitFlags{
+					{Resource: metav1.GroupResource{Group: "deployments.apps", Resource: "stash"}},
+					{Resource: metav1.GroupResource{Group: "statefulsets.apps"}},
+					{
+						Resource: metav1.GroupResource{Group: "deployments.apps"},
+						Labels: &metav1.LabelSelector{
+							MatchLabels: map[string]string{"app": "vault"},
+						},
+					},
+				}
+				return []*releasesapi.ChartSelection{chrt}
+			},
+			want: []finding{
+				{field.ErrorTypeNotFound, "spec.packages[0].chart.waitFors[1].resource"},
+				{field.ErrorTypeNotFound, "spec.packages[0].chart.waitFors[2].resource"},
+			},
+		},
+		{
+			name: "all findings",
+			packages: func() []*releasesapi.ChartSelection {
+				bad := stashSelection("stash", "kube-system", "v0.9.0-rc.6")
+				bad.ValuesPatch = &runtime.RawExtension{
+					Raw: []byte(`[{"op":"remove","path":"/no/such/value"}]`),
+				}
+				return []*releasesapi.ChartSelection{
+					stashSelection("stash", "kube-system", "v0.9.0-rc.6"),
+					bad,
+					stashSelection("stash_2", "kube-system", "v0.8.0"),
+				}
+			},
+			want: []finding{
+				{field.ErrorTypeDuplicate, "spec.packages[1].chart.releaseName"},
+				{field.ErrorTypeInvalid, "spec.packages[1].chart.valuesPatch"},
+				{field.ErrorTypeInvalid, "spec.packages[2].chart.releaseName"},
+				{field.ErrorTypeInvalid, "spec.packages[2].chart.version"},
+			},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var order releasesapi.Order
+			for _, chrt := range c.packages() {
+				order.Spec.Packages = append(order.Spec.Packages, releasesapi.PackageSelection{Chart: chrt})
+			}
+
+			var got []finding
+			for _, err := range ValidateOrder(reg, order) {
+				got = append(got, finding{Type: err.Type, Field: err.Field})
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("got findings %v, want %v", got, c.want)
+			}
+		})
+	}
+}